@@ -0,0 +1,148 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// Routes requests under /api/weather/ to the matching API handler.
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+    if validTrendPath.MatchString(r.URL.Path) {
+        s.api(s.handleTrend)(w, r)
+    } else if validForecastPath.MatchString(r.URL.Path) {
+        s.api(s.handleAPIForecast)(w, r)
+    } else if validCompareDatePath.MatchString(r.URL.Path) {
+        s.api(s.handleCompareDate)(w, r)
+    } else {
+        s.api(s.handleAPIWeather)(w, r)
+    }
+}
+
+// Returns the curated phrase for each weather condition ID, so that clients
+// and translators can see how conditions are described.
+func (s *Server) handleConditions(r *http.Request) (interface{}, int, error) {
+    return conditionPhrases.all(), http.StatusOK, nil
+}
+
+/*
+The current weather with its readings in both metric and imperial units, for
+'units=both':
+  - Metric: The readings in °C, m/s and hPa
+  - Imperial: The readings in °F, mph and inHg
+*/
+type BothUnitsData struct {
+    WeatherData
+    Metric UnitReadings `json:"metric" xml:"metric"`
+    Imperial UnitReadings `json:"imperial" xml:"imperial"`
+}
+
+// Looks up the current weather for a city. The readings may be converted with
+// 'units', which is "metric", "imperial", "standard" or "both", or otherwise
+// DEFAULT_UNITS.
+func (s *Server) handleAPIWeather(r *http.Request) (interface{}, int, error) {
+    var m []string = validAPIPath.FindStringSubmatch(r.URL.Path)
+    if m == nil {
+        return nil, http.StatusNotFound, errInvalidPage
+    }
+
+    units, err := parseAPIUnits(r.URL.Query(), s.config.DefaultUnits)
+    if err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+
+    datum, err := s.lookupWeather(m[1], s.getLookupOptions(r))
+    if err != nil {
+        return nil, lookupStatus(err), fmt.Errorf("looking up %q: %w", m[1], err)
+    }
+    return s.getAPIWeather(datum, units), http.StatusOK, nil
+}
+
+// Reads the unit system for the API from the 'units' query parameter, which
+// may also be "both", or 'fallback' if it isn't given.
+func parseAPIUnits(query url.Values, fallback string) (string, error) {
+    if query.Get("units") == "both" {
+        return "both", nil
+    }
+    units, err := parseUnits(query, fallback)
+    if err != nil {
+        return "", errors.New("units must be metric, imperial, standard or both")
+    }
+    return units, nil
+}
+
+// Returns looked-up weather as the API serves it, in the given unit system or
+// in both metric and imperial. The temperatures are kept precise, rather than
+// rounded as the pages show them, so that scripts can do their own rounding.
+func (s *Server) getAPIWeather(datum WeatherData, units string) interface{} {
+    if units == "both" {
+        var metric, imperial UnitReadings = getUnitReadings(datum, "metric"), getUnitReadings(datum, "imperial")
+        return BothUnitsData{datum, metric, imperial}
+    }
+    return s.convertForDisplay(datum, units)
+}
+
+// Looks up a city's forecast grouped by day. The number of days may be limited
+// with the 'days' query parameter, which is clamped to 1-5.
+func (s *Server) handleAPIForecast(r *http.Request) (interface{}, int, error) {
+    var m []string = validForecastPath.FindStringSubmatch(r.URL.Path)
+    if m == nil {
+        return nil, http.StatusNotFound, errInvalidPage
+    }
+
+    var days int = maxForecastDays
+    if d := r.URL.Query().Get("days"); d != "" {
+        n, err := strconv.Atoi(d)
+        if err != nil {
+            return nil, http.StatusBadRequest, errors.New("days must be a number")
+        }
+        days = clampInt(n, 1, maxForecastDays)
+    }
+
+    forecast, err := s.weather.Forecast(r.Context(), s.resolveAlias(m[1]))
+    if err != nil {
+        return nil, lookupStatus(err), fmt.Errorf("getting the forecast for %q: %w", m[1], err)
+    } else if len(forecast.List) == 0 {
+        return nil, http.StatusNotFound, errCityNotFound
+    }
+
+    var summary ForecastSummary = getForecastSummary(forecast)
+    summary.Days = summary.Days[:min(days, len(summary.Days))]
+    return summary, http.StatusOK, nil
+}
+
+// Builds a temperature, humidity and pressure series for the last few hours in
+// a city. The number of points may be chosen with the 'points' query parameter.
+func (s *Server) handleTrend(r *http.Request) (interface{}, int, error) {
+    var m []string = validTrendPath.FindStringSubmatch(r.URL.Path)
+    if m == nil {
+        return nil, http.StatusNotFound, errInvalidPage
+    }
+
+    // Validate the number of points
+    var count int = defaultTrendPoints
+    if p := r.URL.Query().Get("points"); p != "" {
+        n, err := strconv.Atoi(p)
+        if err != nil || n < 1 || n > maxTrendPoints {
+            return nil, http.StatusBadRequest, fmt.Errorf("points must be between 1 and %d", maxTrendPoints)
+        }
+        count = n
+    }
+
+    // Look up the city as the weather endpoint would, then its recent history
+    datum, err := s.lookupWeather(m[1], s.getLookupOptions(r))
+    if err != nil {
+        return nil, lookupStatus(err), fmt.Errorf("looking up %q for trend: %w", m[1], err)
+    }
+
+    history, err := s.weather.Historical(r.Context(), datum.CityId, time.Unix(datum.Time - int64(count) * 3600, 0), provider.Hourly, count)
+    if err != nil {
+        return nil, lookupStatus(err), fmt.Errorf("getting history for trend: %w", err)
+    }
+    return Trend{datum.Name, datum.CityId, getTrend(history, count)}, http.StatusOK, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+func TestTrendPointsAreRounded(t *testing.T) {
+    var history provider.List
+    history.List = make([]provider.Observation, 3)
+    for i, kelvin := range []float64{280.3, 281.17, 279.99} {
+        history.List[i].Time = int64(3 - i)
+        history.List[i].Main.Temperature = kelvin
+    }
+    var points []TrendPoint = getTrend(history, 2)
+    if len(points) != 2 || points[0].Time != 2 || points[1].Time != 3 {
+        t.Fatalf("points = %+v, want the last two in order", points)
+    }
+    if points[0].Temperature != 8.02 || points[1].Temperature != 7.15 {
+        t.Errorf("temperatures = %v and %v, want 8.02 and 7.15", points[0].Temperature, points[1].Temperature)
+    }
+}
+
+func TestTrendEndpoint(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London/trend?points=5")
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body)
+    }
+    var trend Trend
+    if err := json.Unmarshal(w.Body.Bytes(), &trend); err != nil {
+        t.Fatal(err)
+    }
+    if len(trend.Points) != 5 {
+        t.Fatalf("%d points, want 5", len(trend.Points))
+    }
+    for _, point := range trend.Points {
+        if point.Temperature != roundHundredths(point.Temperature) {
+            t.Errorf("temperature %v isn't rounded to hundredths", point.Temperature)
+        }
+    }
+
+    if w = serve(s, http.MethodGet, "/api/weather/London/trend?points=0"); w.Code != http.StatusBadRequest {
+        t.Errorf("points=0: status %d, want 400", w.Code)
+    }
+}
+
+// The trend is built from the history of the city the weather endpoint would
+// find, looked up with the request's options, such as its language.
+func TestTrendFromHistory(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"TRUSTED_LANGS": "fr"})
+    var lang string
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        switch {
+            case strings.HasSuffix(req.URL.Path, "/find"):
+                lang = req.URL.Query().Get("lang")
+                return stubResponse(req, http.StatusOK, stubLondon), nil
+            case strings.HasSuffix(req.URL.Path, "/history/city"):
+                return stubResponse(req, http.StatusOK, `{"list":[
+                    {"dt":1699996400,"main":{"temp":280.3,"humidity":80,"pressure":1012}},
+                    {"dt":1699989200,"main":{"temp":279.99,"humidity":85,"pressure":1011}},
+                    {"dt":1699992800,"main":{"temp":281.17,"humidity":82,"pressure":1013}}]}`), nil
+        }
+        return stubResponse(req, http.StatusOK, `{"list":[]}`), nil
+    })
+
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London/trend?points=2&lang=fr")
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body)
+    }
+    var want string = `{"name":"London","id":2643743,"points":[` +
+        `{"time":1699992800,"temp":8.02,"humidity":82,"pressure":1013},` +
+        `{"time":1699996400,"temp":7.15,"humidity":80,"pressure":1012}]}`
+    if got := strings.TrimSpace(w.Body.String()); got != want {
+        t.Errorf("trend =\n%s\nwant\n%s", got, want)
+    }
+    if lang != "fr" {
+        t.Errorf("looked up the city in %q, want fr", lang)
+    }
+}
+
+// A city that doesn't exist is a 404 with a small JSON error body, under
+// either API path, rather than a redirect to the not-found page.
+func TestAPICityNotFound(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        if strings.HasSuffix(req.URL.Path, "/geo/1.0/direct") {
+            return stubResponse(req, http.StatusOK, `[]`), nil
+        }
+        return stubResponse(req, http.StatusOK, `{"list":[]}`), nil
+    })
+    for _, path := range []string{"/api/weather/Nowhere", "/api/v1/weather/Nowhere"} {
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, path)
+        if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" {
+            t.Errorf("%s: status %d with %q, want a JSON 404", path, w.Code, w.Header().Get("Content-Type"))
+        }
+        if got, want := strings.TrimSpace(w.Body.String()), `{"error":"city not found","code":"not_found"}`; got != want {
+            t.Errorf("%s: body %s, want %s", path, got, want)
+        }
+    }
+}
+
+// The raw condition IDs are in the response, in the upstream's order, and are
+// an empty array rather than null when there are none.
+func TestAPIConditionIds(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London")
+    var doc map[string]json.RawMessage
+    if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+        t.Fatalf("status %d: %v", w.Code, err)
+    }
+    if got := string(doc["condition_ids"]); got != "[500,701]" {
+        t.Errorf("condition_ids = %s, want [500,701]", got)
+    }
+
+    buf, _ := json.Marshal(getConditionIds(nil))
+    if string(buf) != "[]" {
+        t.Errorf("no conditions encode as %s, want []", buf)
+    }
+}
+
+// The 'days' parameter trims the forecast to that many days, clamped to 1-5.
+func TestAPIForecastDays(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var tests = []struct {
+        query string
+        want int
+    }{
+        {"", 5},
+        {"?days=3", 3},
+        {"?days=1", 1},
+        {"?days=5", 5},
+        {"?days=0", 1},
+        {"?days=-2", 1},
+        {"?days=9", 5},
+    }
+    for _, test := range tests {
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London/forecast" + test.query)
+        var summary ForecastSummary
+        if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+            t.Fatalf("%q: status %d: %v", test.query, w.Code, err)
+        }
+        if len(summary.Days) != test.want {
+            t.Errorf("%q: %d days, want %d", test.query, len(summary.Days), test.want)
+        }
+        for i := 1; i < len(summary.Days); i = i + 1 {
+            if !summary.Days[i].Date.After(summary.Days[i - 1].Date) {
+                t.Errorf("%q: days aren't in order: %v", test.query, summary.Days)
+                break
+            }
+        }
+    }
+    if w := serve(s, http.MethodGet, "/api/weather/London/forecast?days=three"); w.Code != http.StatusBadRequest {
+        t.Errorf("days=three: status %d, want 400", w.Code)
+    }
+}
+
+// Each trend point has the temperature, humidity and pressure of the same
+// history sample, for as many points as asked for, oldest first.
+func TestTrendSeriesAligned(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var counts []string
+    var mock http.RoundTripper = s.http.Transport
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        if !strings.HasSuffix(req.URL.Path, "/history/city") {
+            return mock.RoundTrip(req)
+        }
+        // The trend's window ends now; the comparison's ends yesterday
+        start, _ := strconv.ParseInt(req.URL.Query().Get("start"), 10, 64)
+        count, _ := strconv.Atoi(req.URL.Query().Get("cnt"))
+        if start + int64(count) * 3600 == 1714564800 {
+            counts = append(counts, req.URL.Query().Get("cnt"))
+        }
+        var samples []string
+        for i := 0; i < 6; i = i + 1 {
+            // Sample i is i hours old, i degrees warmer than 0°C, at 60+i% and 1000+i hPa
+            samples = append(samples, fmt.Sprintf(`{"dt":%d,"main":{"temp":%v,"humidity":%d,"pressure":%d}}`,
+                1714564800 - i * 3600, 273.15 + float64(i), 60 + i, 1000 + i))
+        }
+        return stubResponse(req, http.StatusOK, `{"list":[` + strings.Join(samples, ",") + `]}`), nil
+    })
+
+    for _, points := range []int{6, 4} {
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, fmt.Sprintf("/api/weather/London/trend?points=%d", points))
+        var trend Trend
+        if err := json.Unmarshal(w.Body.Bytes(), &trend); err != nil {
+            t.Fatalf("points=%d: status %d: %v", points, w.Code, err)
+        }
+        if len(trend.Points) != points {
+            t.Fatalf("points=%d: got %d points", points, len(trend.Points))
+        }
+        for j, point := range trend.Points {
+            var age int = int(1714564800 - point.Time) / 3600
+            if j > 0 && point.Time <= trend.Points[j - 1].Time {
+                t.Errorf("points=%d: point %d is out of order", points, j)
+            }
+            if point.Temperature != float64(age) || point.Humidity != float64(60 + age) || point.Pressure != float64(1000 + age) {
+                t.Errorf("points=%d: point %+v mixes samples", points, point)
+            }
+        }
+    }
+    if got := strings.Join(counts, ","); got != "6,4" {
+        t.Errorf("asked upstream for %s samples, want 6 then 4", got)
+    }
+}
+
+// /api/conditions lists every curated phrase by condition ID, the same ones
+// the descriptions are built from.
+func TestAPIConditions(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/conditions")
+    var phrases map[string]string
+    if err := json.Unmarshal(w.Body.Bytes(), &phrases); err != nil {
+        t.Fatalf("status %d: %v", w.Code, err)
+    }
+    if phrases["800"] != "clear skies" || phrases["502"] != "heavy rain" {
+        t.Errorf("800 = %q and 502 = %q, want clear skies and heavy rain", phrases["800"], phrases["502"])
+    }
+    for id, phrase := range phrases {
+        n, err := strconv.Atoi(id)
+        if err != nil {
+            t.Errorf("key %q isn't a condition ID", id)
+        } else if got := getWeatherDescription(provider.WeatherDesc{Id: n, Description: "upstream"}, "en"); got != phrase {
+            t.Errorf("%s is %q in the list but described as %q", id, phrase, got)
+        }
+    }
+}
+
+// /api/v1/weather/ serves the same JSON as the unversioned path, and answers
+// bad requests with the error envelope rather than a redirect.
+func TestAPIv1Weather(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/v1/weather/London")
+    if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+        t.Fatalf("status %d with %q, want JSON", w.Code, w.Header().Get("Content-Type"))
+    }
+    if unversioned := serve(s, http.MethodGet, "/api/weather/London").Body.String(); w.Body.String() != unversioned {
+        t.Errorf("v1 body\n%s\nisn't the unversioned\n%s", w.Body, unversioned)
+    }
+
+    w = serve(s, http.MethodGet, "/api/v1/weather/London?units=kelvin")
+    if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != "application/json" {
+        t.Fatalf("units=kelvin: status %d with %q, want a JSON 400", w.Code, w.Header().Get("Content-Type"))
+    }
+    var body APIError
+    if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+        t.Fatal(err)
+    }
+    if body.Code != "bad_request" || body.Error != "units must be metric, imperial, standard or both" {
+        t.Errorf("units=kelvin: error %+v", body)
+    }
+}
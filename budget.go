@@ -0,0 +1,32 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "time"
+)
+
+// Returns a copy of the request whose context expires once the configured
+// time budget for a request is spent, along with a function to release it. A
+// request is returned unchanged if there's no budget.
+func (s *Server) withBudget(r *http.Request) (*http.Request, context.CancelFunc) {
+    if s.config.RequestBudget <= 0 {
+        return r, func() {}
+    }
+    ctx, cancel := context.WithTimeout(r.Context(), s.config.RequestBudget)
+    return r.WithContext(ctx), cancel
+}
+
+// Returns whether at least half of a request's time budget is left, which is
+// when optional data such as the comparison is still worth fetching. Requests
+// without a budget always have time left.
+func (s *Server) hasBudgetLeft(ctx context.Context) bool {
+    if ctx == nil {
+        return true
+    }
+    deadline, ok := ctx.Deadline()
+    if !ok {
+        return true
+    }
+    return time.Until(deadline) >= s.config.RequestBudget / 2
+}
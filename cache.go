@@ -0,0 +1,161 @@
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+/*
+A cache of upstream results, such as looked-up weather, so repeated requests
+within the TTL don't go upstream. Safe for concurrent use:
+  - mu: Guards entries
+  - entries: Maps each cache key to its entry
+  - ttl: How long entries stay fresh; a cache with no TTL stores nothing
+  - max: The most entries kept; once it's reached, expired entries are pruned
+    and then the ones closest to expiring are evicted
+  - hits, misses: Counts of lookups found and not found, for /status
+*/
+type Cache[V any] struct {
+    mu sync.RWMutex
+    entries map[string]cacheEntry[V]
+    ttl time.Duration
+    max int
+    hits atomic.Int64
+    misses atomic.Int64
+}
+
+// A cached value and the time it stops being fresh.
+type cacheEntry[V any] struct {
+    Datum V `json:"datum"`
+    Expires time.Time `json:"expires"`
+}
+
+func newCache[V any](ttl time.Duration, max int) *Cache[V] {
+    return &Cache[V]{entries: make(map[string]cacheEntry[V]), ttl: ttl, max: max}
+}
+
+// Returns the cache key for a city looked up with the given options.
+func cacheKey(city string, opts lookupOptions) string {
+    var key string = strings.ToLower(city) + "|" + strings.Join(opts.Langs, ",")
+    if opts.SkipComparison {
+        key = key + "|nocomparison"
+    } else if opts.Reference != "" {
+        key = key + "|" + opts.Reference
+    }
+    if opts.Disambiguate {
+        key = key + "|disambiguate"
+    }
+    if opts.CityID != 0 {
+        key = key + "|" + strconv.Itoa(int(opts.CityID))
+    }
+    return key
+}
+
+// Returns the cached value for a key, if there is one that hasn't expired.
+func (c *Cache[V]) get(key string, now time.Time) (V, bool) {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    entry, ok := c.entries[key]
+    if !ok || !now.Before(entry.Expires) {
+        c.misses.Add(1)
+        var zero V
+        return zero, false
+    }
+    c.hits.Add(1)
+    return entry.Datum, true
+}
+
+// Stores a value for a key until the TTL has passed.
+func (c *Cache[V]) set(key string, datum V, now time.Time) {
+    if c.ttl <= 0 {
+        return
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.put(key, cacheEntry[V]{datum, now.Add(c.ttl)}, now)
+}
+
+// Stores an entry, first making room for it if the cache is full. The caller
+// must hold mu.
+func (c *Cache[V]) put(key string, entry cacheEntry[V], now time.Time) {
+    if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+        c.prune(now)
+    }
+    c.entries[key] = entry
+}
+
+// Deletes every expired entry, then, if the cache is still full, the entry
+// closest to expiring, which is the oldest. The caller must hold mu.
+func (c *Cache[V]) prune(now time.Time) {
+    var oldestKey string
+    var oldest time.Time
+    for key, entry := range c.entries {
+        if !now.Before(entry.Expires) {
+            delete(c.entries, key)
+        } else if oldestKey == "" || entry.Expires.Before(oldest) {
+            oldestKey, oldest = key, entry.Expires
+        }
+    }
+    if len(c.entries) >= c.max {
+        delete(c.entries, oldestKey)
+    }
+}
+
+// Writes the entries that haven't expired to a JSON file, so that a restarted
+// server can start warm.
+func (c *Cache[V]) save(path string, now time.Time) error {
+    c.mu.RLock()
+    var live map[string]cacheEntry[V] = make(map[string]cacheEntry[V], len(c.entries))
+    for key, entry := range c.entries {
+        if now.Before(entry.Expires) {
+            live[key] = entry
+        }
+    }
+    c.mu.RUnlock()
+
+    buf, err := json.Marshal(live)
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(path, buf, 0600)
+}
+
+// Reads entries saved by save, dropping any that have expired since. They're
+// restored oldest first, so that if there are too many the newest are kept. A
+// missing file isn't an error; there's just nothing to restore.
+func (c *Cache[V]) load(path string, now time.Time) error {
+    buf, err := ioutil.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil
+    } else if err != nil {
+        return err
+    }
+
+    var saved map[string]cacheEntry[V]
+    err = json.Unmarshal(buf, &saved)
+    if err != nil {
+        return err
+    }
+
+    var keys []string = make([]string, 0, len(saved))
+    for key := range saved {
+        keys = append(keys, key)
+    }
+    sort.Slice(keys, func(i, j int) bool { return saved[keys[i]].Expires.Before(saved[keys[j]].Expires) })
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for _, key := range keys {
+        if now.Before(saved[key].Expires) {
+            c.put(key, saved[key], now)
+        }
+    }
+    return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+    "net/http"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// Wraps a server's upstream transport so its requests are counted.
+func countUpstream(s *Server) *stubTransport {
+    var mock http.RoundTripper = s.http.Transport
+    var transport *stubTransport = &stubTransport{respond: mock.RoundTrip}
+    s.http.Transport = transport
+    return transport
+}
+
+func TestCacheSkipsUpstream(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"CACHE_TTL": "10m"})
+    var transport *stubTransport = countUpstream(s)
+
+    if w := serve(s, http.MethodGet, "/api/weather/London"); w.Code != http.StatusOK {
+        t.Fatalf("first lookup: status %d", w.Code)
+    }
+    var first int64 = transport.calls.Load()
+    if first == 0 {
+        t.Fatal("first lookup made no upstream requests")
+    }
+    if w := serve(s, http.MethodGet, "/api/weather/london"); w.Code != http.StatusOK {
+        t.Fatalf("second lookup: status %d", w.Code)
+    }
+    if got := transport.calls.Load(); got != first {
+        t.Errorf("second lookup made %d upstream requests, want none", got - first)
+    }
+
+    // Once the TTL has passed, the city is fetched again
+    var start time.Time = now()
+    now = func() time.Time { return start.Add(11 * time.Minute) }
+    serve(s, http.MethodGet, "/api/weather/London")
+    if got := transport.calls.Load(); got == first {
+        t.Error("lookup after the TTL made no upstream requests")
+    }
+}
+
+func TestCachePrunesExpiredEntries(t *testing.T) {
+    var c *Cache[int] = newCache[int](time.Minute, 3)
+    var start time.Time = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    c.set("a", 1, start)
+    c.set("b", 2, start.Add(40 * time.Second))
+    c.set("c", 3, start.Add(50 * time.Second))
+
+    // "a" has expired, so it makes room for "d"
+    c.set("d", 4, start.Add(70 * time.Second))
+    if len(c.entries) != 3 {
+        t.Fatalf("%d entries, want 3", len(c.entries))
+    }
+    if _, ok := c.entries["a"]; ok {
+        t.Error("the expired entry was kept")
+    }
+
+    // Nothing has expired, so the oldest, "b", makes room for "e"
+    c.set("e", 5, start.Add(80 * time.Second))
+    if _, ok := c.entries["b"]; ok || len(c.entries) != 3 {
+        t.Errorf("entries = %v, want b evicted", c.entries)
+    }
+
+    // Replacing an entry doesn't evict another
+    c.set("e", 6, start.Add(80 * time.Second))
+    if v, ok := c.get("e", start.Add(80 * time.Second)); !ok || v != 6 || len(c.entries) != 3 {
+        t.Errorf("got %v, %v with %d entries, want 6 with 3", v, ok, len(c.entries))
+    }
+}
+
+func TestServerCachesAreBounded(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"CACHE_TTL": "10m", "CACHE_MAX_ENTRIES": "2"})
+    for i, city := range []string{"London", "Paris", "Tokyo", "Berlin"} {
+        s.cache.set(city, WeatherData{Observation: provider.Observation{Name: city}}, now().Add(time.Duration(i) * time.Second))
+        s.histories.set(city, provider.List{}, now().Add(time.Duration(i) * time.Second))
+    }
+    if len(s.cache.entries) != 2 || len(s.histories.entries) != 2 {
+        t.Errorf("%d weather and %d history entries, want 2 of each", len(s.cache.entries), len(s.histories.entries))
+    }
+    if _, ok := s.cache.get("Berlin", now()); !ok {
+        t.Error("the newest entry was evicted")
+    }
+}
+
+func TestCacheSaveAndLoad(t *testing.T) {
+    var path string = filepath.Join(t.TempDir(), "cache.json")
+    var start time.Time = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    var saved *Cache[WeatherData] = newCache[WeatherData](10 * time.Minute, 10)
+    saved.set("old", WeatherData{Observation: provider.Observation{Name: "Old"}}, start)
+    saved.set("london", WeatherData{Observation: provider.Observation{Name: "London"}}, start.Add(5 * time.Minute))
+    saved.set("paris", WeatherData{Observation: provider.Observation{Name: "Paris"}}, start.Add(6 * time.Minute))
+    if err := saved.save(path, start.Add(11 * time.Minute)); err != nil {
+        t.Fatal(err)
+    }
+
+    // The expired entry isn't restored, and the smaller cache keeps the newest
+    var loaded *Cache[WeatherData] = newCache[WeatherData](10 * time.Minute, 1)
+    if err := loaded.load(path, start.Add(11 * time.Minute)); err != nil {
+        t.Fatal(err)
+    }
+    if len(loaded.entries) != 1 {
+        t.Fatalf("%d entries, want 1", len(loaded.entries))
+    }
+    if datum, ok := loaded.get("paris", start.Add(11 * time.Minute)); !ok || datum.Name != "Paris" {
+        t.Errorf("got %q, %v, want Paris", datum.Name, ok)
+    }
+
+    if err := loaded.load(filepath.Join(t.TempDir(), "missing.json"), start); err != nil {
+        t.Errorf("loading a missing file: %v", err)
+    }
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+    "fmt"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+/*
+Returned by lookupWeather when a search matches more than one city and the
+caller asked to choose between them:
+  - Matches: Every city the search matched, best match first
+*/
+type AmbiguousError struct {
+    Matches []provider.Observation
+}
+
+func (e *AmbiguousError) Error() string {
+    return fmt.Sprintf("%d cities match", len(e.Matches))
+}
+
+/*
+The data for the page listing the cities a search matched:
+  - Query: The search as the visitor typed it
+  - Candidates: The matches to offer, capped at the configured maximum
+  - Truncated: Whether some matches were left out, in which case the visitor
+    is asked to refine their search
+*/
+type Disambiguation struct {
+    Query string
+    Candidates []provider.Observation
+    Truncated bool
+}
+
+func (d Disambiguation) templateName() string {
+    return "choose"
+}
+
+// Builds the list of candidates for an ambiguous search, keeping at most 'max'.
+func getDisambiguation(query string, matches []provider.Observation, max int) Disambiguation {
+    var d Disambiguation = Disambiguation{Query: query, Candidates: matches}
+    if len(matches) > max {
+        d.Candidates = matches[:max]
+        d.Truncated = true
+    }
+    return d
+}
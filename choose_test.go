@@ -0,0 +1,48 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+// A search matching more cities than MAX_CANDIDATES, 10 by default, lists only
+// that many and asks the visitor to refine it.
+func TestDisambiguationCap(t *testing.T) {
+    var matches []string
+    for i := 1; i <= 20; i = i + 1 {
+        matches = append(matches, fmt.Sprintf(`{"name":"San %d","id":%d,"dt":1714564800,"sys":{"country":"US"},"main":{"temp":20}}`, i, 1000 + i))
+    }
+    var tests = []struct {
+        max string
+        want int
+        truncated bool
+    }{
+        {"", 10, true},
+        {"5", 5, true},
+        {"20", 20, false},
+        {"25", 20, false},
+    }
+    for _, test := range tests {
+        var s *Server = newTestServer(t, map[string]string{"MAX_CANDIDATES": test.max})
+        var mock http.RoundTripper = s.http.Transport
+        stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+            if strings.HasSuffix(req.URL.Path, "/find") {
+                return stubResponse(req, http.StatusOK, `{"list":[` + strings.Join(matches, ",") + `]}`), nil
+            }
+            return mock.RoundTrip(req)
+        })
+
+        var page string = serve(s, http.MethodGet, "/weather/San").Body.String()
+        if got := strings.Count(page, "?id="); got != test.want {
+            t.Errorf("MAX_CANDIDATES=%q: %d candidates listed, want %d", test.max, got, test.want)
+        }
+        if !strings.Contains(page, "San 1<") || strings.Contains(page, fmt.Sprintf("San %d<", test.want + 1)) {
+            t.Errorf("MAX_CANDIDATES=%q: didn't list the first %d matches", test.max, test.want)
+        }
+        if got := strings.Contains(page, "Refine your search"); got != test.truncated {
+            t.Errorf("MAX_CANDIDATES=%q: asked to refine = %v, want %v", test.max, got, test.truncated)
+        }
+    }
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "regexp"
+    "time"
+)
+
+// The most cities that may be compared side by side.
+const maxCompareCities = 4
+
+var validCompareCity = regexp.MustCompile("^[a-zA-Z0-9 ,]+$")
+
+/*
+The data for the comparison page:
+  - Cities: The current weather in each city, in the order they were given
+  - Units: The unit system the readings are shown in
+  - Permalink: A link that reproduces this comparison exactly
+*/
+type CompareData struct {
+    Cities []WeatherData
+    Units string
+    Permalink string
+}
+
+// Builds the shareable link for a comparison. Each city is its own 'cities'
+// parameter, since city queries may themselves contain commas, and repeated
+// parameters keep their order, so following the link gives the same page.
+func comparePermalink(cities []string, units string) string {
+    var v url.Values = url.Values{"cities": cities, "units": {units}}
+    return "/compare?" + v.Encode()
+}
+
+// Reads the cities and unit system for a comparison from a query string. The
+// unit system is 'defaultUnits' if none is given.
+func parseCompareQuery(query url.Values, defaultUnits string) ([]string, string, error) {
+    var cities []string = query["cities"]
+    if len(cities) == 0 {
+        return nil, "", errors.New("no cities to compare")
+    } else if len(cities) > maxCompareCities {
+        return nil, "", fmt.Errorf("at most %d cities may be compared", maxCompareCities)
+    }
+    for _, city := range cities {
+        if !validCompareCity.MatchString(city) {
+            return nil, "", fmt.Errorf("invalid city %q", city)
+        }
+    }
+
+    units, err := parseUnits(query, defaultUnits)
+    if err != nil {
+        return nil, "", err
+    }
+    return cities, units, nil
+}
+
+// Looks up the weather in several cities to show side by side.
+func (s *Server) handleCompare(r *http.Request) (interface{}, int, error) {
+    cities, units, err := parseCompareQuery(r.URL.Query(), s.config.DefaultUnits)
+    if err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+
+    var data CompareData = CompareData{Units: units, Permalink: comparePermalink(cities, units)}
+    var opts lookupOptions = s.getLookupOptions(r)
+    for _, city := range cities {
+        datum, err := s.lookupWeather(city, opts)
+        if err != nil {
+            return nil, lookupStatus(err), fmt.Errorf("comparing %q: %w", city, err)
+        }
+        data.Cities = append(data.Cities, s.convertForDisplay(datum, units))
+    }
+    return data, http.StatusOK, nil
+}
+
+/*
+A city's current temperature compared with the same time on a past date:
+  - Name, CityId: The city compared
+  - Date: The past date, as YYYY-MM-DD in the city's time zone
+  - Temperature: The current temperature, in degrees Celsius
+  - Then: The temperature at the same time of day on Date, in degrees Celsius,
+    rounded to hundredths
+  - Comparison: How the current temperature differs from then, worked out
+    before either is rounded
+*/
+type DateComparison struct {
+    XMLName xml.Name `json:"-" xml:"date_comparison"`
+    Name string `json:"name" xml:"name"`
+    CityId int32 `json:"id" xml:"id"`
+    Date string `json:"date" xml:"date"`
+    Temperature float64 `json:"temp" xml:"temp"`
+    Then float64 `json:"then_temp" xml:"then_temp"`
+    Comparison
+}
+
+// Checks that a date may be compared with: it must be before 'today' and no
+// more than 'historyDays' before it, since upstream has no history otherwise.
+// Returns midnight on the date in today's time zone.
+func parseCompareDate(date string, today time.Time, historyDays int) (time.Time, error) {
+    day, err := time.ParseInLocation("2006-01-02", date, today.Location())
+    if err != nil {
+        return time.Time{}, errors.New("date must be given as YYYY-MM-DD")
+    }
+    var midnight time.Time = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, today.Location())
+    if !day.Before(midnight) {
+        return time.Time{}, errors.New("date must be in the past")
+    } else if day.Before(midnight.AddDate(0, 0, -historyDays)) {
+        return time.Time{}, fmt.Errorf("date must be within the last %d days", historyDays)
+    }
+    return day, nil
+}
+
+// Compares a city's current temperature with the same time of day on the
+// past date given by 'date', which must be within HISTORY_DAYS. With daily
+// history the date's single sample is used whatever the time.
+func (s *Server) handleCompareDate(r *http.Request) (interface{}, int, error) {
+    var m []string = validCompareDatePath.FindStringSubmatch(r.URL.Path)
+    if m == nil {
+        return nil, http.StatusNotFound, errInvalidPage
+    }
+
+    // The date can only be checked against today once we know the city's
+    // time zone, but a malformed one needn't wait for the lookup
+    var date string = r.URL.Query().Get("date")
+    if _, err := time.Parse("2006-01-02", date); err != nil {
+        return nil, http.StatusBadRequest, errors.New("date must be given as YYYY-MM-DD")
+    }
+
+    var opts lookupOptions = s.getLookupOptions(r)
+    opts.SkipComparison = true
+    datum, err := s.lookupWeather(m[1], opts)
+    if err != nil {
+        return nil, lookupStatus(err), fmt.Errorf("looking up %q: %w", m[1], err)
+    }
+    var today time.Time = cityTime(now().Unix(), datum.Timezone)
+    day, err := parseCompareDate(date, today, s.config.HistoryDays)
+    if err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+
+    // Fetch the sample at this time of day on the date
+    var start time.Time = day
+    if s.config.HistoryType == "hour" {
+        start = day.Add(today.Sub(time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, today.Location())))
+    }
+    history, err := s.weather.Historical(r.Context(), datum.CityId, start, s.config.HistoryType, 1)
+    if err != nil {
+        return nil, lookupStatus(err), fmt.Errorf("getting history for %s: %w", date, err)
+    } else if len(history.List) == 0 {
+        return nil, http.StatusNotFound, fmt.Errorf("no history for %s", date)
+    }
+
+    // History is in Kelvin
+    var then float64 = history.List[0].Main.Temperature - 273.15
+    return DateComparison{
+        Name: datum.Name,
+        CityId: datum.CityId,
+        Date: date,
+        Temperature: datum.Main.Temperature,
+        Then: roundHundredths(then),
+        Comparison: compareTemperatures(datum.Main.Temperature - then, s.config.SimilarBand),
+    }, http.StatusOK, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "context"
+    "html"
+    "net/http"
+    "net/http/httptest"
+    "regexp"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Today's 6.64°C is within a degree of yesterday's 5.7°C, so it's similar,
+// in every unit system. Rounding today's temperature first would make it 7°C
+// and so 1.3°C warmer.
+func TestComparisonUsesUnroundedTemperature(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        return stubResponse(req, http.StatusOK, `{"list":[{"dt":1714478400,"main":{"temp":278.85}}]}`), nil
+    })
+
+    var datum WeatherData
+    datum.Name, datum.CityId, datum.Time, datum.Units = "London", 2643743, 1714564800, "metric"
+    datum.Main.Temperature = 6.64
+    comparison, _, _ := s.getComparison(context.Background(), datum, "hour")
+    if comparison == nil {
+        t.Fatal("no comparison")
+    } else if comparison.Direction != "similar" || comparison.Diff != 0.94 {
+        t.Errorf("comparison = %+v, want similar with a diff of 0.94", *comparison)
+    }
+
+    datum.ComparisonDetail = comparison
+    for _, units := range []string{"metric", "imperial", "standard"} {
+        var converted WeatherData = s.convertForDisplay(datum, units)
+        if converted.ComparisonDetail.Direction != "similar" {
+            t.Errorf("%s: direction = %q, want similar", units, converted.ComparisonDetail.Direction)
+        }
+    }
+}
+
+func TestCompareTemperatures(t *testing.T) {
+    var tests = []struct {
+        diff float64
+        direction string
+        magnitude string
+    }{
+        {0, "similar", "none"},
+        {-1, "similar", "none"},
+        {0.99, "similar", "none"},
+        {1, "warmer", "slight"},
+        {-1.01, "cooler", "slight"},
+        {2.5, "warmer", "moderate"},
+        {-5.01, "cooler", "large"},
+        {5, "warmer", "large"},
+    }
+    for _, test := range tests {
+        var got Comparison = compareTemperatures(test.diff, 1)
+        if got.Direction != test.direction || got.Magnitude != test.magnitude {
+            t.Errorf("compareTemperatures(%v) = %s/%s, want %s/%s", test.diff, got.Direction, got.Magnitude, test.direction, test.magnitude)
+        }
+    }
+}
+
+// The mock's history for the date is the current temperature converted to
+// Kelvin and back, which leaves floating-point noise for the handler to round
+// away.
+func TestCompareDateIsRounded(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London/compare?date=2024-04-30")
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body)
+    }
+    var want string = `"temp":6.64,"then_temp":6.64,"diff":0,"direction":"similar"`
+    if !strings.Contains(w.Body.String(), want) {
+        t.Errorf("got %s, want %s", w.Body, want)
+    }
+}
+
+func TestParseCompareDate(t *testing.T) {
+    var today time.Time = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    var tests = []struct {
+        date string
+        ok bool
+    }{
+        {"2024-04-30", true},
+        {"2024-04-26", true},
+        {"2024-04-25", false},
+        {"2024-05-01", false},
+        {"2024-05-02", false},
+        {"2025-01-01", false},
+        {"30/04/2024", false},
+        {"2024-02-30", false},
+        {"yesterday", false},
+        {"", false},
+    }
+    for _, test := range tests {
+        day, err := parseCompareDate(test.date, today, 5)
+        if (err == nil) != test.ok {
+            t.Errorf("parseCompareDate(%q) = %v, %v, want ok = %v", test.date, day, err, test.ok)
+        } else if test.ok && (day.Format("2006-01-02") != test.date || day.Hour() != 0) {
+            t.Errorf("parseCompareDate(%q) = %v, want midnight on the date", test.date, day)
+        }
+    }
+}
+
+// Dates in the future, beyond the history or not dates at all are refused
+// with a 400, not looked up.
+func TestCompareDateRejectsBadDates(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var transport *stubTransport = countUpstream(s)
+    for _, date := range []string{"2024-05-02", "2030-01-01", "2024-04-01", "2024-13-01", "01-05-2024", ""} {
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London/compare?date=" + date)
+        if w.Code != http.StatusBadRequest {
+            t.Errorf("date=%q: status %d, want 400", date, w.Code)
+        }
+    }
+    for _, date := range []string{"2024-13-01", "01-05-2024", ""} {
+        var before int64 = transport.calls.Load()
+        serve(s, http.MethodGet, "/api/weather/London/compare?date=" + date)
+        if got := transport.calls.Load(); got != before {
+            t.Errorf("date=%q: made %d upstream requests for a malformed date", date, got - before)
+        }
+    }
+}
+
+// SIMILAR_BAND widens or narrows what counts as about the same, in Celsius or
+// Fahrenheit degrees.
+func TestSimilarBand(t *testing.T) {
+    var tests = []struct {
+        band string
+        diff float64
+        direction string
+    }{
+        {"", 1.5, "warmer"},
+        {"", -1.5, "cooler"},
+        {"2", 1.5, "similar"},
+        {"2C", -1.99, "similar"},
+        {"2", 2, "warmer"},
+        {"3F", 1.5, "similar"},
+        {"3F", -1.7, "cooler"},
+        {"0.5", 0.75, "warmer"},
+    }
+    for _, test := range tests {
+        config, err := loadConfig(withAPIKey(map[string]string{"SIMILAR_BAND": test.band}))
+        if err != nil {
+            t.Fatalf("SIMILAR_BAND=%q: %v", test.band, err)
+        }
+        if got := compareTemperatures(test.diff, config.SimilarBand); got.Direction != test.direction {
+            t.Errorf("SIMILAR_BAND=%q: %v degrees is %s, want %s", test.band, test.diff, got.Direction, test.direction)
+        }
+    }
+}
+
+// Following a comparison's permalink gives the same comparison: the same
+// cities in the same order, in the same units, with the same permalink.
+func TestComparePermalink(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var cities []string = []string{"San Francisco,US", "London", "Paris,FR"}
+    var permalink string = comparePermalink(cities, "imperial")
+
+    data, status, err := s.handleCompare(httptest.NewRequest(http.MethodGet, permalink, nil))
+    if err != nil {
+        t.Fatalf("following %s: status %d: %v", permalink, status, err)
+    }
+    var compared CompareData = data.(CompareData)
+    if compared.Permalink != permalink || compared.Units != "imperial" {
+        t.Errorf("following %s gave %q in %s", permalink, compared.Permalink, compared.Units)
+    }
+    var names []string
+    for _, datum := range compared.Cities {
+        names = append(names, datum.Name)
+        if datum.Units != "imperial" {
+            t.Errorf("%s is in %s, want imperial", datum.Name, datum.Units)
+        }
+    }
+    if got := strings.Join(names, ";"); got != "San Francisco;London;Paris" {
+        t.Errorf("compared %q, want the cities in the order given", got)
+    }
+
+    var page string = serve(s, http.MethodGet, permalink).Body.String()
+    var m []string = regexp.MustCompile(`id="permalink" href="([^"]*)"`).FindStringSubmatch(page)
+    if m == nil || html.UnescapeString(m[1]) != permalink {
+        t.Errorf("the page doesn't link to %s:\n%s", permalink, page)
+    }
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+    "crypto/subtle"
+    _ "embed"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "sync"
+)
+
+// The curated English phrase for each weather condition ID, worded to fit our
+// sentences, such as "clear skies" for 800.
+//go:embed conditions.json
+var defaultConditions []byte
+var conditionPhrases *ConditionPhrases = &ConditionPhrases{phrases: mustParseConditions(defaultConditions)}
+
+/*
+The condition phrases in use, which may be replaced at runtime by reloading
+CONDITIONS_FILE. Safe for concurrent use:
+  - mu: Guards phrases
+  - phrases: Maps each condition ID to its phrase
+*/
+type ConditionPhrases struct {
+    mu sync.RWMutex
+    phrases map[int]string
+}
+
+// Returns the phrase for a condition ID, if there is one.
+func (c *ConditionPhrases) get(id int) (string, bool) {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    phrase, ok := c.phrases[id]
+    return phrase, ok
+}
+
+// Returns a copy of every phrase, keyed by condition ID.
+func (c *ConditionPhrases) all() map[int]string {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    var phrases map[int]string = make(map[int]string, len(c.phrases))
+    for id, phrase := range c.phrases {
+        phrases[id] = phrase
+    }
+    return phrases
+}
+
+// Replaces every phrase with those in the given JSON file. The phrases in use
+// are left alone if the file can't be read or is malformed.
+func (c *ConditionPhrases) load(path string) error {
+    buf, err := ioutil.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    phrases, err := parseConditions(buf)
+    if err != nil {
+        return err
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.phrases = phrases
+    return nil
+}
+
+// Parses a JSON object of condition phrases keyed by condition ID. Every
+// phrase must be non-empty.
+func parseConditions(buf []byte) (map[int]string, error) {
+    var phrases map[int]string
+    err := json.Unmarshal(buf, &phrases)
+    if err != nil {
+        return nil, err
+    }
+    for id, phrase := range phrases {
+        if phrase == "" {
+            return nil, fmt.Errorf("no phrase for condition %d", id)
+        }
+    }
+    return phrases, nil
+}
+
+// Parses the built-in condition phrases, panicking if they're malformed since
+// they're built into the binary.
+func mustParseConditions(buf []byte) map[int]string {
+    phrases, err := parseConditions(buf)
+    if err != nil {
+        panic(fmt.Sprintf("invalid conditions.json: %v", err))
+    }
+    return phrases
+}
+
+// Reloads the condition phrases from CONDITIONS_FILE, so translators can try
+// new wording without a restart. Only POST requests bearing ADMIN_TOKEN are
+// allowed.
+func (s *Server) handleReloadConditions(r *http.Request) (interface{}, int, error) {
+    if r.Method != http.MethodPost {
+        return nil, http.StatusMethodNotAllowed, errors.New("use POST")
+    }
+    var token []byte = []byte("Bearer " + s.config.AdminToken)
+    if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+        return nil, http.StatusUnauthorized, errors.New("missing or incorrect admin token")
+    }
+
+    err := conditionPhrases.load(s.config.ConditionsFile)
+    if err != nil {
+        return nil, http.StatusInternalServerError, fmt.Errorf("reloading %s: %w", s.config.ConditionsFile, err)
+    }
+    var phrases map[int]string = conditionPhrases.all()
+    log.Printf("Reloaded %d condition phrases from %s", len(phrases), s.config.ConditionsFile)
+    return map[string]int{"conditions": len(phrases)}, http.StatusOK, nil
+}
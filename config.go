@@ -0,0 +1,560 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net/url"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+/*
+The server's configuration, loaded once at startup by loadConfig. Each field is
+set from an environment variable or, where that's unset, the same setting in
+the file named by CONFIG_FILE or the -config flag; see withConfigFile:
+  - APIKey: OWM_API_KEY, or the -apikey flag, or else the contents of the
+    file named by OWM_API_KEY_FILE, the OpenWeatherMap API key sent with every
+    upstream request; required unless in mock mode
+  - Proxy: OWM_PROXY, a proxy for all upstream requests
+  - APIVersion: OWM_API_VERSION, the data API version, "2.5" or "3.0"
+  - UpstreamFormat: OWM_FORMAT, "json", the default, or "xml" to request
+    current weather from the upstream as XML
+  - GeocodeFirst: GEOCODE=1, resolve names to coordinates before lookups
+  - UpstreamRateLimits: UPSTREAM_RATE_LIMITS, the most requests a minute each
+    upstream endpoint may be sent, such as "history=10;find=60"; endpoints
+    not listed aren't limited
+  - Providers: PROVIDERS, the comma-separated weather providers whose
+    current readings are averaged: "openweathermap", which is always
+    included, "open-meteo" and "weatherbit"; OpenWeatherMap alone by default
+  - WeatherbitAPIKey: WEATHERBIT_API_KEY, required to use Weatherbit
+  - ProviderTimeout: PROVIDER_TIMEOUT, how long each provider other than
+    OpenWeatherMap is given to answer before it's left out; 3s by default
+  - MockMode: MOCK_MODE=1, answer every lookup with canned data instead of
+    calling the upstream API
+  - NearbyFallback: NEARBY_FALLBACK=1, show the closest city when a name
+    isn't found
+  - ConditionFallback: CONDITION_FALLBACK=0 turns off describing readings
+    that come without any conditions from their cloud cover and precipitation
+  - FeaturedCities: FEATURED_CITIES, the semicolon-separated cities linked
+    from the index page with their current temperatures
+  - HomeCity: HOME_CITY, the city shown when none is given; the index is
+    shown if unset
+  - GeoIPURL: GEOIP_URL, the geo-IP service used to locate clients for
+    /weather/here, with "{ip}" standing in for their address; unset, the
+    default, means clients are never located
+  - GeoIPFallbackCity: GEOIP_FALLBACK_CITY, the city shown by /weather/here
+    when the client can't be located; HOME_CITY, or London, by default
+  - MaxCandidates: MAX_CANDIDATES, the most cities listed when a search is
+    ambiguous
+  - AliasesFile: ALIASES_FILE, a JSON file of city aliases
+  - TemplateDir: TEMPLATE_DIR, the directory holding the page templates
+  - UnitLabelsFile: UNIT_LABELS_FILE, a JSON file of unit label overrides
+  - ConditionsFile: CONDITIONS_FILE, a JSON file of condition phrases used
+    instead of the built-in ones, which may be reloaded while running
+  - AdminToken: ADMIN_TOKEN, the bearer token required by the /admin/
+    endpoints, which are off without it
+  - TrustedLangs: TRUSTED_LANGS, the comma-separated description languages
+    we're willing to show; English is always trusted
+  - DefaultLang: DEFAULT_LANG, the language tried when the requested one fails
+  - SimilarBand: SIMILAR_BAND, the temperature difference, in degrees Celsius,
+    within which today is described as similar to yesterday
+  - ComparisonDenylist: COMPARISON_DENYLIST, the semicolon-separated city IDs
+    or names whose history is never fetched, stored lowercased
+  - HistoryType: HISTORY_TYPE, the granularity of the history fetched for
+    comparisons, "hour", the default, or "day" for subscriptions without
+    hourly history
+  - HistoryCount: HISTORY_COUNT, how many samples of history to fetch for a
+    comparison with the same time yesterday, 1-24 hours or 1-7 days; the
+    whole window is checked for records. 3 hours or 1 day by default
+  - HistoryDays: HISTORY_DAYS, how many days back the subscription's history
+    reaches, and so how far back a date may be compared with; 5 by default
+  - SeasonalYears: SEASONAL_YEARS, how many past years of the same week to
+    average into a seasonal normal to compare with; 0, the default, disables it
+  - DayAverage: DAY_AVERAGE=1, compare the current temperature with the
+    average so far today
+  - StaleAfter: STALE_AFTER, the age after which readings are flagged stale
+  - Clock: CLOCK, "24h", the default, or "12h" to show times with AM/PM
+  - DefaultUnits: DEFAULT_UNITS, the unit system readings are shown in when a
+    request doesn't ask for one: "metric", the default, "imperial" or
+    "standard"
+  - Rounding: ROUNDING, how temperatures are rounded to whole degrees:
+    "half-up", the default, or "half-even" to avoid biasing them upwards
+  - CoarseTemperature: COARSE_TEMPERATURE=1, show temperatures on the pages
+    to the nearest five degrees; the API is unaffected
+  - HourlyGraph: HOURLY_GRAPH=1, graph the last day's temperatures
+  - Maintenance: MAINTENANCE=1, serve the maintenance page for everything
+  - SelfTest: SELF_TEST=1, look up SelfTestCity at startup
+  - SelfTestCity: SELF_TEST_CITY, the city used by the self-test
+  - SelfTestRequired: SELF_TEST_REQUIRED=1, refuse to start if it fails
+  - VAPIDPrivateKey: VAPID_PRIVATE_KEY, the base64url-encoded P-256 key used
+    to sign push notifications; push notifications are off without it
+  - VAPIDSubject: VAPID_SUBJECT, a mailto: or https: contact for the push
+    services, required with VAPIDPrivateKey
+  - PushInterval: PUSH_INTERVAL, how often subscribed cities are checked
+  - PushHosts: PUSH_HOSTS, the comma-separated push service hosts that
+    subscription endpoints may be on, including their subdomains; see
+    defaultPushHosts
+  - MaxPushSubscriptions: MAX_PUSH_SUBSCRIPTIONS, the most subscriptions kept
+  - DailyQuota: DAILY_QUOTA, the most requests each client IP may make a day;
+    0, the default, means no limit
+  - RequestBudget: REQUEST_BUDGET, the most time a page or API request may
+    spend on upstream requests; optional data such as the comparison is left
+    out once half of it is spent. 0, the default, means no limit
+  - CacheTTL: CACHE_TTL, how long looked-up weather is reused; 0 disables
+    the cache
+  - CacheMaxEntries: CACHE_MAX_ENTRIES, the most entries kept in each of the
+    weather and history caches
+  - MinRefresh: MIN_REFRESH, the least time between upstream fetches for any
+    one city in one language, even when its lookups miss the cache; 0, the
+    default, disables it
+  - PrefetchInterval: PREFETCH_INTERVAL, how often the comparisons of recently
+    viewed cities are fetched in the background; 0, the default, disables it
+  - CachePersist: CACHE_PERSIST=1, save the cache on shutdown and reload it
+    at startup
+  - CacheFile: CACHE_FILE, where the cache is saved
+  - ListenAddr: LISTEN_ADDR, or the -addr flag, the address to listen on;
+    every interface by default
+  - Port: PORT, or the -port flag, the port to listen on, 8080 by default
+  - WriteTimeout: WRITE_TIMEOUT, the most time a response may take to write,
+    which must be longer than REQUEST_BUDGET; 30s by default
+*/
+type Config struct {
+    APIKey string
+    Proxy string
+    APIVersion string
+    UpstreamFormat string
+    GeocodeFirst bool
+    UpstreamRateLimits map[string]int
+    Providers []string
+    WeatherbitAPIKey string
+    ProviderTimeout time.Duration
+    MockMode bool
+    NearbyFallback bool
+    ConditionFallback bool
+    FeaturedCities []string
+    HomeCity string
+    GeoIPURL string
+    GeoIPFallbackCity string
+    MaxCandidates int
+    AliasesFile string
+    TemplateDir string
+    UnitLabelsFile string
+    ConditionsFile string
+    AdminToken string
+    TrustedLangs map[string]bool
+    DefaultLang string
+    SimilarBand float64
+    ComparisonDenylist map[string]bool
+    HistoryType string
+    HistoryCount int
+    HistoryDays int
+    SeasonalYears int
+    DayAverage bool
+    StaleAfter time.Duration
+    Clock string
+    DefaultUnits string
+    Rounding string
+    CoarseTemperature bool
+    HourlyGraph bool
+    Maintenance bool
+    SelfTest bool
+    SelfTestCity string
+    SelfTestRequired bool
+    VAPIDPrivateKey string
+    VAPIDSubject string
+    PushInterval time.Duration
+    PushHosts []string
+    MaxPushSubscriptions int
+    DailyQuota int
+    RequestBudget time.Duration
+    CacheTTL time.Duration
+    CacheMaxEntries int
+    MinRefresh time.Duration
+    PrefetchInterval time.Duration
+    CachePersist bool
+    CacheFile string
+    ListenAddr string
+    Port int
+    WriteTimeout time.Duration
+}
+
+// Reads a configuration file of settings named as the environment variables
+// are, one "NAME=value" per line, such as "OWM_API_KEY=abc123". Blank lines
+// and lines starting with "#" are ignored.
+func loadConfigFile(path string) (map[string]string, error) {
+    buf, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var settings map[string]string = make(map[string]string)
+    for i, line := range strings.Split(string(buf), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        name, value, ok := strings.Cut(line, "=")
+        name = strings.TrimSpace(name)
+        if !ok || !validSettingName.MatchString(name) {
+            return nil, fmt.Errorf("line %d: expected NAME=value", i + 1)
+        }
+        settings[name] = strings.TrimSpace(value)
+    }
+    return settings, nil
+}
+
+var validSettingName = regexp.MustCompile("^[A-Z][A-Z0-9_]*$")
+
+// Returns 'getenv' extended with the settings in the file named by its
+// CONFIG_FILE, if there is one. A setting in the environment overrides the
+// same one in the file.
+func withConfigFile(getenv func(string) string) (func(string) string, error) {
+    var path string = getenv("CONFIG_FILE")
+    if path == "" {
+        return getenv, nil
+    }
+    settings, err := loadConfigFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("invalid CONFIG_FILE: %v", err)
+    }
+    return func(key string) string {
+        if value := getenv(key); value != "" {
+            return value
+        }
+        return settings[key]
+    }, nil
+}
+
+// Builds the configuration from environment variables, looked up with
+// 'getenv', and CONFIG_FILE, applying defaults for anything unset. Returns an
+// error if any value or combination of values is invalid.
+func loadConfig(getenv func(string) string) (*Config, error) {
+    var config *Config = &Config{
+        APIVersion: "2.5",
+        UpstreamFormat: "json",
+        Providers: []string{"openweathermap"},
+        ProviderTimeout: 3 * time.Second,
+        MaxCandidates: 10,
+        Clock: "24h",
+        DefaultUnits: "metric",
+        Rounding: "half-up",
+        HistoryType: "hour",
+        HistoryDays: 5,
+        TrustedLangs: map[string]bool{"en": true},
+        DefaultLang: "en",
+        SimilarBand: 1.0,
+        StaleAfter: 3 * time.Hour,
+        SelfTestCity: "London",
+        PushInterval: 30 * time.Minute,
+        PushHosts: defaultPushHosts,
+        MaxPushSubscriptions: 10000,
+        CacheTTL: 10 * time.Minute,
+        CacheMaxEntries: 10000,
+        CacheFile: "weather-cache.json",
+        Port: 8080,
+        WriteTimeout: 30 * time.Second,
+    }
+    var err error
+    getenv, err = withConfigFile(getenv)
+    if err != nil {
+        return nil, err
+    }
+
+    config.Proxy = getenv("OWM_PROXY")
+    if config.Proxy != "" {
+        if _, err = url.Parse(config.Proxy); err != nil {
+            return nil, fmt.Errorf("invalid OWM_PROXY: %v", err)
+        }
+    }
+    if version := getenv("OWM_API_VERSION"); version != "" {
+        if version != "2.5" && version != "3.0" {
+            return nil, fmt.Errorf("invalid OWM_API_VERSION %q: must be 2.5 or 3.0", version)
+        }
+        config.APIVersion = version
+    }
+    if format := getenv("OWM_FORMAT"); format != "" {
+        if format != "json" && format != "xml" {
+            return nil, fmt.Errorf("invalid OWM_FORMAT %q: must be json or xml", format)
+        }
+        config.UpstreamFormat = format
+    }
+    config.GeocodeFirst = getenv("GEOCODE") == "1"
+    config.UpstreamRateLimits, err = provider.ParseRateLimits(getenv("UPSTREAM_RATE_LIMITS"))
+    if err != nil {
+        return nil, fmt.Errorf("invalid UPSTREAM_RATE_LIMITS: %v", err)
+    }
+    config.MockMode = getenv("MOCK_MODE") == "1"
+    config.APIKey = strings.TrimSpace(getenv("OWM_API_KEY"))
+    if path := getenv("OWM_API_KEY_FILE"); config.APIKey == "" && path != "" {
+        buf, err := ioutil.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("invalid OWM_API_KEY_FILE: %v", err)
+        }
+        config.APIKey = strings.TrimSpace(string(buf))
+    }
+    if config.APIKey == "" && !config.MockMode {
+        return nil, errors.New("no OpenWeatherMap API key: set OWM_API_KEY or OWM_API_KEY_FILE, in the environment or CONFIG_FILE, or pass -apikey")
+    }
+    config.Providers, err = parseProviders(getenv("PROVIDERS"))
+    if err != nil {
+        return nil, fmt.Errorf("invalid PROVIDERS: %v", err)
+    }
+    config.WeatherbitAPIKey = strings.TrimSpace(getenv("WEATHERBIT_API_KEY"))
+    for _, provider := range config.Providers {
+        if provider == "weatherbit" && config.WeatherbitAPIKey == "" && !config.MockMode {
+            return nil, errors.New("PROVIDERS includes weatherbit but WEATHERBIT_API_KEY is unset")
+        }
+    }
+    if timeout := getenv("PROVIDER_TIMEOUT"); timeout != "" {
+        config.ProviderTimeout, err = time.ParseDuration(timeout)
+        if err != nil || config.ProviderTimeout <= 0 {
+            return nil, fmt.Errorf("invalid PROVIDER_TIMEOUT %q: must be a positive duration such as 3s", timeout)
+        }
+    }
+    config.NearbyFallback = getenv("NEARBY_FALLBACK") == "1"
+    config.ConditionFallback = getenv("CONDITION_FALLBACK") != "0"
+    for _, city := range strings.Split(getenv("FEATURED_CITIES"), ";") {
+        if city = strings.TrimSpace(city); city != "" {
+            if !validPath.MatchString("/weather/" + city) {
+                return nil, fmt.Errorf("invalid city %q in FEATURED_CITIES", city)
+            }
+            config.FeaturedCities = append(config.FeaturedCities, city)
+        }
+    }
+    config.HomeCity = getenv("HOME_CITY")
+    if config.HomeCity != "" && !validPath.MatchString("/weather/" + config.HomeCity) {
+        return nil, fmt.Errorf("invalid HOME_CITY %q", config.HomeCity)
+    }
+    config.GeoIPURL = getenv("GEOIP_URL")
+    if config.GeoIPURL != "" {
+        if u, err := url.Parse(config.GeoIPURL); err != nil || u.Host == "" || !strings.Contains(config.GeoIPURL, "{ip}") {
+            return nil, fmt.Errorf("invalid GEOIP_URL %q: must be a URL containing {ip}", config.GeoIPURL)
+        }
+    }
+    config.GeoIPFallbackCity = "London"
+    if config.HomeCity != "" {
+        config.GeoIPFallbackCity = config.HomeCity
+    }
+    if city := getenv("GEOIP_FALLBACK_CITY"); city != "" {
+        if !validPath.MatchString("/weather/" + city) {
+            return nil, fmt.Errorf("invalid GEOIP_FALLBACK_CITY %q", city)
+        }
+        config.GeoIPFallbackCity = city
+    }
+    if max := getenv("MAX_CANDIDATES"); max != "" {
+        config.MaxCandidates, err = strconv.Atoi(max)
+        if err != nil || config.MaxCandidates < 1 {
+            return nil, fmt.Errorf("invalid MAX_CANDIDATES %q: must be a positive number", max)
+        }
+    }
+
+    config.AliasesFile = getenv("ALIASES_FILE")
+    config.TemplateDir = getenv("TEMPLATE_DIR")
+    config.UnitLabelsFile = getenv("UNIT_LABELS_FILE")
+    config.ConditionsFile = getenv("CONDITIONS_FILE")
+    config.AdminToken = getenv("ADMIN_TOKEN")
+
+    for _, lang := range strings.Split(getenv("TRUSTED_LANGS"), ",") {
+        if lang = strings.ToLower(strings.TrimSpace(lang)); lang != "" {
+            config.TrustedLangs[lang] = true
+        }
+    }
+    if lang := strings.ToLower(getenv("DEFAULT_LANG")); lang != "" {
+        if !config.TrustedLangs[lang] {
+            return nil, fmt.Errorf("DEFAULT_LANG %q isn't in TRUSTED_LANGS", lang)
+        }
+        config.DefaultLang = lang
+    }
+
+    if band := getenv("SIMILAR_BAND"); band != "" {
+        config.SimilarBand, err = parseTemperatureDelta(band)
+        if err != nil || config.SimilarBand <= 0 {
+            return nil, fmt.Errorf("invalid SIMILAR_BAND %q: must be a positive temperature difference", band)
+        }
+    }
+    config.ComparisonDenylist = make(map[string]bool)
+    for _, city := range strings.Split(getenv("COMPARISON_DENYLIST"), ";") {
+        if city = strings.ToLower(strings.TrimSpace(city)); city != "" {
+            config.ComparisonDenylist[city] = true
+        }
+    }
+    if historyType := getenv("HISTORY_TYPE"); historyType != "" {
+        if historyType != "hour" && historyType != "day" {
+            return nil, fmt.Errorf("invalid HISTORY_TYPE %q: must be hour or day", historyType)
+        }
+        config.HistoryType = historyType
+    }
+    var maxHistoryCount int = 24
+    config.HistoryCount = 3
+    if config.HistoryType == "day" {
+        maxHistoryCount = 7
+        config.HistoryCount = 1
+    }
+    if count := getenv("HISTORY_COUNT"); count != "" {
+        config.HistoryCount, err = strconv.Atoi(count)
+        if err != nil || config.HistoryCount < 1 || config.HistoryCount > maxHistoryCount {
+            return nil, fmt.Errorf("invalid HISTORY_COUNT %q: must be between 1 and %d with %s history", count, maxHistoryCount, config.HistoryType)
+        }
+    }
+    if days := getenv("HISTORY_DAYS"); days != "" {
+        config.HistoryDays, err = strconv.Atoi(days)
+        if err != nil || config.HistoryDays < 1 || config.HistoryDays > 366 {
+            return nil, fmt.Errorf("invalid HISTORY_DAYS %q: must be between 1 and 366", days)
+        }
+    }
+    if years := getenv("SEASONAL_YEARS"); years != "" {
+        config.SeasonalYears, err = strconv.Atoi(years)
+        if err != nil || config.SeasonalYears < 0 || config.SeasonalYears > 10 {
+            return nil, fmt.Errorf("invalid SEASONAL_YEARS %q: must be between 0 and 10", years)
+        }
+    }
+    config.DayAverage = getenv("DAY_AVERAGE") == "1"
+    if stale := getenv("STALE_AFTER"); stale != "" {
+        config.StaleAfter, err = time.ParseDuration(stale)
+        if err != nil || config.StaleAfter <= 0 {
+            return nil, fmt.Errorf("invalid STALE_AFTER %q: must be a positive duration such as 3h", stale)
+        }
+    }
+    if clock := getenv("CLOCK"); clock != "" {
+        if clock != "12h" && clock != "24h" {
+            return nil, fmt.Errorf("invalid CLOCK %q: must be 12h or 24h", clock)
+        }
+        config.Clock = clock
+    }
+    if units := getenv("DEFAULT_UNITS"); units != "" {
+        if _, ok := unitSystems[units]; !ok {
+            return nil, fmt.Errorf("invalid DEFAULT_UNITS %q: must be metric, imperial or standard", units)
+        }
+        config.DefaultUnits = units
+    }
+    if rounding := getenv("ROUNDING"); rounding != "" {
+        if rounding != "half-up" && rounding != "half-even" {
+            return nil, fmt.Errorf("invalid ROUNDING %q: must be half-up or half-even", rounding)
+        }
+        config.Rounding = rounding
+    }
+    config.CoarseTemperature = getenv("COARSE_TEMPERATURE") == "1"
+    config.HourlyGraph = getenv("HOURLY_GRAPH") == "1"
+    config.Maintenance = getenv("MAINTENANCE") == "1"
+
+    config.SelfTest = getenv("SELF_TEST") == "1"
+    if city := getenv("SELF_TEST_CITY"); city != "" {
+        config.SelfTestCity = city
+    }
+    config.SelfTestRequired = getenv("SELF_TEST_REQUIRED") == "1"
+    if config.SelfTestRequired && !config.SelfTest {
+        return nil, fmt.Errorf("SELF_TEST_REQUIRED is set but SELF_TEST isn't")
+    }
+
+    config.VAPIDPrivateKey = getenv("VAPID_PRIVATE_KEY")
+    config.VAPIDSubject = getenv("VAPID_SUBJECT")
+    if config.VAPIDPrivateKey != "" && config.VAPIDSubject == "" {
+        return nil, fmt.Errorf("VAPID_SUBJECT is required with VAPID_PRIVATE_KEY")
+    }
+    if interval := getenv("PUSH_INTERVAL"); interval != "" {
+        config.PushInterval, err = time.ParseDuration(interval)
+        if err != nil || config.PushInterval < time.Minute {
+            return nil, fmt.Errorf("invalid PUSH_INTERVAL %q: must be a duration of at least 1m", interval)
+        }
+    }
+    if hosts := getenv("PUSH_HOSTS"); hosts != "" {
+        config.PushHosts = nil
+        for _, host := range strings.Split(hosts, ",") {
+            if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+                config.PushHosts = append(config.PushHosts, host)
+            }
+        }
+    }
+    if max := getenv("MAX_PUSH_SUBSCRIPTIONS"); max != "" {
+        config.MaxPushSubscriptions, err = strconv.Atoi(max)
+        if err != nil || config.MaxPushSubscriptions < 1 {
+            return nil, fmt.Errorf("invalid MAX_PUSH_SUBSCRIPTIONS %q: must be a positive number", max)
+        }
+    }
+
+    if quota := getenv("DAILY_QUOTA"); quota != "" {
+        config.DailyQuota, err = strconv.Atoi(quota)
+        if err != nil || config.DailyQuota < 0 {
+            return nil, fmt.Errorf("invalid DAILY_QUOTA %q: must be a number of requests, or 0", quota)
+        }
+    }
+
+    if budget := getenv("REQUEST_BUDGET"); budget != "" {
+        config.RequestBudget, err = time.ParseDuration(budget)
+        if err != nil || config.RequestBudget < 0 {
+            return nil, fmt.Errorf("invalid REQUEST_BUDGET %q: must be a duration such as 5s, or 0", budget)
+        }
+    }
+    if ttl := getenv("CACHE_TTL"); ttl != "" {
+        config.CacheTTL, err = time.ParseDuration(ttl)
+        if err != nil || config.CacheTTL < 0 {
+            return nil, fmt.Errorf("invalid CACHE_TTL %q: must be a duration such as 10m, or 0", ttl)
+        }
+    }
+    if max := getenv("CACHE_MAX_ENTRIES"); max != "" {
+        config.CacheMaxEntries, err = strconv.Atoi(max)
+        if err != nil || config.CacheMaxEntries < 1 {
+            return nil, fmt.Errorf("invalid CACHE_MAX_ENTRIES %q: must be a positive number", max)
+        }
+    }
+    if interval := getenv("MIN_REFRESH"); interval != "" {
+        config.MinRefresh, err = time.ParseDuration(interval)
+        if err != nil || config.MinRefresh < 0 {
+            return nil, fmt.Errorf("invalid MIN_REFRESH %q: must be a duration such as 1m, or 0", interval)
+        }
+    }
+    if interval := getenv("PREFETCH_INTERVAL"); interval != "" {
+        config.PrefetchInterval, err = time.ParseDuration(interval)
+        if err != nil || config.PrefetchInterval < 0 {
+            return nil, fmt.Errorf("invalid PREFETCH_INTERVAL %q: must be a duration such as 5m, or 0", interval)
+        }
+    }
+    if config.PrefetchInterval > 0 && config.PrefetchInterval >= config.CacheTTL {
+        return nil, fmt.Errorf("PREFETCH_INTERVAL must be shorter than CACHE_TTL, or prefetched comparisons expire unused")
+    }
+    config.CachePersist = getenv("CACHE_PERSIST") == "1"
+    if file := getenv("CACHE_FILE"); file != "" {
+        config.CacheFile = file
+    }
+    if config.CachePersist && config.CacheTTL == 0 {
+        return nil, fmt.Errorf("CACHE_PERSIST is set but the cache is disabled")
+    }
+    config.ListenAddr = getenv("LISTEN_ADDR")
+    if port := getenv("PORT"); port != "" {
+        config.Port, err = strconv.Atoi(port)
+        if err != nil || config.Port < 1 || config.Port > 65535 {
+            return nil, fmt.Errorf("invalid PORT %q: must be between 1 and 65535", port)
+        }
+    }
+    if timeout := getenv("WRITE_TIMEOUT"); timeout != "" {
+        config.WriteTimeout, err = time.ParseDuration(timeout)
+        if err != nil || config.WriteTimeout <= 0 {
+            return nil, fmt.Errorf("invalid WRITE_TIMEOUT %q: must be a positive duration such as 30s", timeout)
+        }
+    }
+    if config.RequestBudget > 0 && config.WriteTimeout <= config.RequestBudget {
+        return nil, fmt.Errorf("WRITE_TIMEOUT must be longer than REQUEST_BUDGET, or slow responses are cut off before they're written")
+    }
+    return config, nil
+}
+
+// Parses a temperature difference such as "1.5", "1.5C", "3F" or "2K" into
+// degrees Celsius. A bare number is taken to be in Celsius.
+func parseTemperatureDelta(s string) (float64, error) {
+    s = strings.ToUpper(strings.TrimSpace(s))
+    var scale float64 = 1.0
+    if strings.HasSuffix(s, "F") {
+        scale = 5.0 / 9.0
+    }
+    s = strings.TrimRight(s, "CFK")
+
+    delta, err := strconv.ParseFloat(s, 64)
+    if err != nil {
+        return 0, err
+    }
+    return delta * scale, nil
+}
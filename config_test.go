@@ -0,0 +1,173 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Writes a configuration file and returns its path.
+func writeConfigFile(t *testing.T, contents string) string {
+    t.Helper()
+    var path string = filepath.Join(t.TempDir(), "weather.conf")
+    if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestConfigFile(t *testing.T) {
+    var path string = writeConfigFile(t, `
+# Settings for the tests
+OWM_API_KEY = filekey
+PORT=9090
+CACHE_TTL=5m
+`)
+    var env map[string]string = map[string]string{"CONFIG_FILE": path, "PORT": "7070"}
+    config, err := loadConfig(func(key string) string { return env[key] })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if config.APIKey != "filekey" || config.CacheTTL != 5 * time.Minute {
+        t.Errorf("got key %q and TTL %v, want the file's", config.APIKey, config.CacheTTL)
+    }
+    if config.Port != 7070 {
+        t.Errorf("got port %d, want the environment's 7070", config.Port)
+    }
+}
+
+func TestConfigFileErrors(t *testing.T) {
+    var tests = []struct {
+        contents string
+        want string
+    }{
+        {"OWM_API_KEY=key\nPORT\n", "line 2"},
+        {"owm_api_key=key\n", "line 1"},
+        {"OWM_API_KEY=key\nPORT=0\n", "invalid PORT"},
+        {"PORT=9090\n", "no OpenWeatherMap API key"},
+    }
+    for _, test := range tests {
+        var env map[string]string = map[string]string{"CONFIG_FILE": writeConfigFile(t, test.contents)}
+        _, err := loadConfig(func(key string) string { return env[key] })
+        if err == nil || !strings.Contains(err.Error(), test.want) {
+            t.Errorf("%q: got %v, want an error containing %q", test.contents, err, test.want)
+        }
+    }
+
+    var env map[string]string = map[string]string{"CONFIG_FILE": filepath.Join(t.TempDir(), "missing.conf")}
+    if _, err := loadConfig(func(key string) string { return env[key] }); err == nil || !strings.Contains(err.Error(), "CONFIG_FILE") {
+        t.Errorf("a missing file: got %v", err)
+    }
+}
+
+// Returns a getenv that looks up 'env', with an API key set.
+func withAPIKey(env map[string]string) func(string) string {
+    return func(key string) string {
+        if key == "OWM_API_KEY" {
+            return "key"
+        }
+        return env[key]
+    }
+}
+
+func TestConfigDefaults(t *testing.T) {
+    config, err := loadConfig(withAPIKey(nil))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var tests = []struct {
+        name string
+        got interface{}
+        want interface{}
+    }{
+        {"APIVersion", config.APIVersion, "2.5"},
+        {"Port", config.Port, 8080},
+        {"CacheTTL", config.CacheTTL, 10 * time.Minute},
+        {"WriteTimeout", config.WriteTimeout, 30 * time.Second},
+        {"RequestBudget", config.RequestBudget, time.Duration(0)},
+        {"PrefetchInterval", config.PrefetchInterval, time.Duration(0)},
+        {"HistoryType", config.HistoryType, "hour"},
+        {"HistoryCount", config.HistoryCount, 3},
+        {"HistoryDays", config.HistoryDays, 5},
+        {"DefaultUnits", config.DefaultUnits, "metric"},
+        {"DefaultLang", config.DefaultLang, "en"},
+        {"Rounding", config.Rounding, "half-up"},
+        {"MaxCandidates", config.MaxCandidates, 10},
+        {"SelfTest", config.SelfTest, false},
+        {"SelfTestCity", config.SelfTestCity, "London"},
+    }
+    for _, test := range tests {
+        if test.got != test.want {
+            t.Errorf("%s = %v, want %v", test.name, test.got, test.want)
+        }
+    }
+    if len(config.Providers) != 1 || config.Providers[0] != "openweathermap" {
+        t.Errorf("Providers = %v, want only openweathermap", config.Providers)
+    }
+}
+
+func TestConfigRejectsCombinations(t *testing.T) {
+    var tests = []struct {
+        env map[string]string
+        want string
+    }{
+        {map[string]string{"PREFETCH_INTERVAL": "10m"}, "PREFETCH_INTERVAL must be shorter than CACHE_TTL"},
+        {map[string]string{"PREFETCH_INTERVAL": "5m", "CACHE_TTL": "2m"}, "PREFETCH_INTERVAL must be shorter than CACHE_TTL"},
+        {map[string]string{"REQUEST_BUDGET": "30s"}, "WRITE_TIMEOUT must be longer than REQUEST_BUDGET"},
+        {map[string]string{"REQUEST_BUDGET": "10s", "WRITE_TIMEOUT": "5s"}, "WRITE_TIMEOUT must be longer than REQUEST_BUDGET"},
+        {map[string]string{"SELF_TEST_REQUIRED": "1"}, "SELF_TEST_REQUIRED is set but SELF_TEST isn't"},
+        {map[string]string{"CACHE_PERSIST": "1", "CACHE_TTL": "0"}, "CACHE_PERSIST is set but the cache is disabled"},
+    }
+    for _, test := range tests {
+        _, err := loadConfig(withAPIKey(test.env))
+        if err == nil || !strings.Contains(err.Error(), test.want) {
+            t.Errorf("%v: got %v, want an error containing %q", test.env, err, test.want)
+        }
+    }
+
+    // Each is fine once the other setting makes room for it
+    for _, env := range []map[string]string{
+        {"PREFETCH_INTERVAL": "5m", "CACHE_TTL": "10m"},
+        {"REQUEST_BUDGET": "10s", "WRITE_TIMEOUT": "30s"},
+        {"SELF_TEST_REQUIRED": "1", "SELF_TEST": "1"},
+    } {
+        if _, err := loadConfig(withAPIKey(env)); err != nil {
+            t.Errorf("%v: %v", env, err)
+        }
+    }
+}
+
+// The address, port and write timeout the server listens with, and the
+// settings that can't be used.
+func TestListenSettings(t *testing.T) {
+    var tests = []struct {
+        env map[string]string
+        wantAddr string
+        wantPort int
+        wantTimeout time.Duration
+        wantErr string
+    }{
+        {nil, "", 8080, 30 * time.Second, ""},
+        {map[string]string{"LISTEN_ADDR": "127.0.0.1", "PORT": "9090"}, "127.0.0.1", 9090, 30 * time.Second, ""},
+        {map[string]string{"WRITE_TIMEOUT": "1m"}, "", 8080, time.Minute, ""},
+        {map[string]string{"PORT": "65536"}, "", 0, 0, "invalid PORT"},
+        {map[string]string{"PORT": "http"}, "", 0, 0, "invalid PORT"},
+        {map[string]string{"WRITE_TIMEOUT": "0s"}, "", 0, 0, "invalid WRITE_TIMEOUT"},
+    }
+    for _, test := range tests {
+        config, err := loadConfig(withAPIKey(test.env))
+        if test.wantErr != "" {
+            if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+                t.Errorf("%v: got %v, want an error containing %q", test.env, err, test.wantErr)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%v: %v", test.env, err)
+        } else if config.ListenAddr != test.wantAddr || config.Port != test.wantPort || config.WriteTimeout != test.wantTimeout {
+            t.Errorf("%v: got %q, %d and %v, want %q, %d and %v", test.env, config.ListenAddr, config.Port, config.WriteTimeout, test.wantAddr, test.wantPort, test.wantTimeout)
+        }
+    }
+}
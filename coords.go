@@ -0,0 +1,99 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "regexp"
+    "strconv"
+)
+
+// Coordinates are given as "lat,lon" in decimal degrees, such as
+// "40.71,-74.01".
+var validCoordsPath = regexp.MustCompile(`^/weather/coords/(-?[0-9]+(?:\.[0-9]+)?),(-?[0-9]+(?:\.[0-9]+)?)$`)
+
+// Parses a latitude and longitude in decimal degrees, checking that they're
+// on the globe.
+func parseCoords(latString, lonString string) (float64, float64, error) {
+    lat, err := strconv.ParseFloat(latString, 64)
+    if err != nil || lat < -90 || lat > 90 {
+        return 0, 0, errors.New("lat must be between -90 and 90")
+    }
+    lon, err := strconv.ParseFloat(lonString, 64)
+    if err != nil || lon < -180 || lon > 180 {
+        return 0, 0, errors.New("lon must be between -180 and 180")
+    }
+    return lat, lon, nil
+}
+
+// Finds the city whose weather is reported for a location, returning its name
+// and ID, or errCityNotFound if there isn't one.
+func (s *Server) findCityAt(ctx context.Context, lat, lon float64, lang string) (string, int32, error) {
+    data, err := s.weather.CurrentAt(ctx, lat, lon, lang)
+    if err != nil {
+        return "", 0, err
+    } else if len(data.List) == 0 || data.List[0].CityId == 0 {
+        return "", 0, errCityNotFound
+    }
+    return data.List[0].Name, data.List[0].CityId, nil
+}
+
+// Looks up the weather at a location. The location is resolved to the nearest
+// city first, and that city is looked up by its ID, so coordinates share the
+// cache and the comparison with lookups by name.
+func (s *Server) lookupCoords(r *http.Request, lat, lon float64) (WeatherData, error) {
+    var opts lookupOptions = s.getLookupOptions(r)
+    city, id, err := s.findCityAt(r.Context(), lat, lon, opts.Langs[0])
+    if err != nil {
+        return WeatherData{}, fmt.Errorf("looking up %f,%f: %w", lat, lon, err)
+    }
+    opts.CityID = id
+    return s.lookupWeather(city, opts)
+}
+
+// Shows the weather at the coordinates in the path, such as
+// /weather/coords/40.71,-74.01, for the weather page. The readings are shown
+// in the unit system given by 'units', or DEFAULT_UNITS.
+func (s *Server) handleCoords(r *http.Request, m []string) (interface{}, int, error) {
+    lat, lon, err := parseCoords(m[1], m[2])
+    if err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+    units, err := parseUnits(r.URL.Query(), s.config.DefaultUnits)
+    if err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+
+    datum, err := s.lookupCoords(r, lat, lon)
+    if err != nil {
+        return nil, lookupStatus(err), err
+    }
+    datum = s.convertForDisplay(datum, units)
+    datum.Clock = s.getClock(r)
+    return datum, http.StatusOK, nil
+}
+
+// Looks up the current weather at the 'lat' and 'lon' query parameters. The
+// readings may be converted with 'units' as for a lookup by name.
+func (s *Server) handleAPICoords(r *http.Request) (interface{}, int, error) {
+    var query url.Values = r.URL.Query()
+    if !query.Has("lat") || !query.Has("lon") {
+        return nil, http.StatusBadRequest, errors.New("lat and lon are required")
+    }
+    lat, lon, err := parseCoords(query.Get("lat"), query.Get("lon"))
+    if err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+    units, err := parseAPIUnits(query, s.config.DefaultUnits)
+    if err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+
+    datum, err := s.lookupCoords(r, lat, lon)
+    if err != nil {
+        return nil, lookupStatus(err), err
+    }
+    return s.getAPIWeather(datum, units), http.StatusOK, nil
+}
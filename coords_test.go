@@ -0,0 +1,68 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestParseCoords(t *testing.T) {
+    var tests = []struct {
+        lat string
+        lon string
+        wantErr string
+    }{
+        {"40.71", "-74.01", ""},
+        {"-90", "180", ""},
+        {"90.5", "0", "lat must be between -90 and 90"},
+        {"0", "-180.1", "lon must be between -180 and 180"},
+        {"north", "0", "lat must be between -90 and 90"},
+        {"0", "", "lon must be between -180 and 180"},
+    }
+    for _, test := range tests {
+        _, _, err := parseCoords(test.lat, test.lon)
+        if test.wantErr == "" && err != nil {
+            t.Errorf("%s,%s: %v", test.lat, test.lon, err)
+        } else if test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+            t.Errorf("%s,%s: got %v, want %q", test.lat, test.lon, err, test.wantErr)
+        }
+    }
+}
+
+// Coordinates are looked up at upstream's current weather by location, both
+// for the page and the API, and bad ones are a 400.
+func TestCoordsLookup(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var located []string
+    var mock http.RoundTripper = s.http.Transport
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        if strings.HasSuffix(req.URL.Path, "/weather") && req.URL.Query().Has("lat") {
+            located = append(located, req.URL.Query().Get("lat") + "," + req.URL.Query().Get("lon"))
+        }
+        return mock.RoundTrip(req)
+    })
+
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/weather/coords/51.51,-0.13")
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Piscataway") {
+        t.Errorf("page: status %d:\n%s", w.Code, w.Body)
+    }
+    w = serve(s, http.MethodGet, "/api/v1/weather?lat=40.71&lon=-74.01")
+    var datum WeatherData
+    if err := json.Unmarshal(w.Body.Bytes(), &datum); err != nil {
+        t.Fatalf("API: status %d: %v", w.Code, err)
+    }
+    if datum.Name != "Piscataway" || datum.CityId != 5104746 {
+        t.Errorf("API: got %q (%d), want the mock's Piscataway", datum.Name, datum.CityId)
+    }
+    if got := strings.Join(located, " "); got != "51.510000,-0.130000 40.710000,-74.010000" {
+        t.Errorf("looked up locations %s", got)
+    }
+
+    for _, path := range []string{"/weather/coords/91,0", "/api/v1/weather?lat=0&lon=181", "/api/v1/weather?lat=10"} {
+        if w = serve(s, http.MethodGet, path); w.Code != http.StatusBadRequest {
+            t.Errorf("%s: status %d, want 400", path, w.Code)
+        }
+    }
+}
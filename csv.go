@@ -0,0 +1,64 @@
+package main
+
+import (
+    "encoding/csv"
+    "mime"
+    "net/http"
+    "path"
+    "strconv"
+    "strings"
+)
+
+// Implemented by API data that can be flattened into a single CSV row for
+// spreadsheet users.
+type csvRecord interface {
+    csvHeader() []string
+    csvRow() []string
+}
+
+// Returns the column names for a WeatherData CSV row.
+func (datum WeatherData) csvHeader() []string {
+    return []string{"name", "country", "id", "dt", "units", "temp", "feels_like",
+        "temp_min", "temp_max", "humidity", "pressure", "wind_speed", "description"}
+}
+
+// Returns the key fields of the reading as a CSV row, matching csvHeader.
+func (datum WeatherData) csvRow() []string {
+    var descriptions []string
+    for _, w := range datum.Weather {
+        descriptions = append(descriptions, w.Description)
+    }
+    return []string{
+        datum.Name,
+        datum.Sys.Country,
+        strconv.Itoa(int(datum.CityId)),
+        strconv.FormatInt(datum.Time, 10),
+        datum.Units,
+        formatCSVFloat(datum.Main.Temperature),
+        formatCSVFloat(datum.Main.FeelsLike),
+        formatCSVFloat(datum.Main.TempMin),
+        formatCSVFloat(datum.Main.TempMax),
+        formatCSVFloat(datum.Main.Humidity),
+        formatCSVFloat(datum.Main.Pressure),
+        formatCSVFloat(datum.Wind.Speed),
+        strings.Join(descriptions, "; "),
+    }
+}
+
+func formatCSVFloat(v float64) string {
+    return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Writes a record as a header line and a single value row, offered as a
+// download named after the last segment of the request path.
+func writeCSV(w http.ResponseWriter, r *http.Request, status int, record csvRecord) {
+    var filename string = path.Base(r.URL.Path) + ".csv"
+    w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+    w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+    w.WriteHeader(status)
+
+    var out *csv.Writer = csv.NewWriter(w)
+    out.Write(record.csvHeader())
+    out.Write(record.csvRow())
+    out.Flush()
+}
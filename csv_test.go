@@ -0,0 +1,25 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// The CSV form of a reading is a header and a single row of its key fields,
+// offered as a download.
+func TestAPICSV(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London?format=csv")
+    if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+        t.Fatalf("status %d with %q, want CSV", w.Code, w.Header().Get("Content-Type"))
+    }
+    if got, want := w.Header().Get("Content-Disposition"), `attachment; filename=London.csv`; got != want {
+        t.Errorf("Content-Disposition = %q, want %q", got, want)
+    }
+    var want string = "name,country,id,dt,units,temp,feels_like,temp_min,temp_max,humidity,pressure,wind_speed,description\n" +
+        "London,United States of America,5104746,1714564800,metric,6.64,0,5.7,8,93,1000,2.31,light rain; mist\n"
+    if got := w.Body.String(); got != want {
+        t.Errorf("CSV =\n%s\nwant\n%s", got, want)
+    }
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "bytes"
+    "context"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// Renders the body of a weekly digest email for a city, summarizing each day's
+// forecast highs, lows and notable conditions. Sending the email is left to
+// the operator.
+func (s *Server) renderDigest(city string) ([]byte, error) {
+    forecast, err := s.weather.Forecast(context.Background(), s.resolveAlias(city))
+    if err != nil {
+        return nil, err
+    } else if len(forecast.List) == 0 {
+        return nil, errCityNotFound
+    }
+    return s.renderDigestForecast(forecast)
+}
+
+// Renders the weekly digest email for an already-fetched forecast.
+func (s *Server) renderDigestForecast(forecast provider.Forecast) ([]byte, error) {
+    var digest ForecastSummary = getForecastSummary(forecast)
+    for i := range digest.Days {
+        digest.Days[i].High = roundWhole(digest.Days[i].High, s.config.Rounding)
+        digest.Days[i].Low = roundWhole(digest.Days[i].Low, s.config.Rounding)
+    }
+
+    var buf bytes.Buffer
+    err := s.templates.ExecuteTemplate(&buf, "digest.html", digest)
+    if err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
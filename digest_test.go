@@ -0,0 +1,57 @@
+package main
+
+import (
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// Builds a forecast slot at a UTC time with a high, low and condition.
+func digestSlot(t time.Time, high, low float64, id int, description string) provider.Observation {
+    var slot provider.Observation
+    slot.Time = t.Unix()
+    slot.Main.TempMax = high
+    slot.Main.TempMin = low
+    slot.Weather = []provider.WeatherDesc{{Id: id, Description: description}}
+    return slot
+}
+
+// The digest lists each day of the forecast by name with its rounded high and
+// low, calling out notable conditions but not plain clouds.
+func TestRenderDigest(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var forecast provider.Forecast
+    forecast.City.Name = "London"
+    forecast.City.Country = "GB"
+    forecast.List = []provider.Observation{
+        digestSlot(time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC), 12.4, 6.6, 803, "broken clouds"),
+        digestSlot(time.Date(2024, 5, 1, 15, 0, 0, 0, time.UTC), 17.6, 11, 500, "light rain"),
+        digestSlot(time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC), 14, 3.2, 800, "clear sky"),
+        digestSlot(time.Date(2024, 5, 2, 15, 0, 0, 0, time.UTC), 21.5, 9, 800, "clear sky"),
+    }
+    buf, err := s.renderDigestForecast(forecast)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var body string = string(buf)
+    var wednesday int = strings.Index(body, "Wednesday")
+    var thursday int = strings.Index(body, "Thursday")
+    if !strings.Contains(body, "This week in London") || wednesday < 0 || thursday < wednesday {
+        t.Fatalf("digest doesn't list Wednesday then Thursday for London:\n%s", body)
+    }
+    if day := body[wednesday:thursday]; !strings.Contains(day, "18°C / 7°C") || !strings.Contains(day, "Expect light rain.") {
+        t.Errorf("Wednesday isn't 18°C / 7°C with light rain:\n%s", day)
+    } else if strings.Contains(day, "broken clouds") {
+        t.Errorf("Wednesday calls out clouds:\n%s", day)
+    }
+    if day := body[thursday:]; !strings.Contains(day, "22°C / 3°C") || strings.Contains(day, "Expect") {
+        t.Errorf("Thursday isn't a clear 22°C / 3°C:\n%s", day)
+    }
+
+    if _, err = s.renderDigest("London"); err != nil {
+        t.Errorf("renderDigest from the mocked forecast: %v", err)
+    }
+}
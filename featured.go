@@ -0,0 +1,52 @@
+package main
+
+import (
+    "log"
+    "time"
+)
+
+/*
+A featured city on the index page:
+  - Query: The city as configured, used for its link
+  - Datum: Its current weather, if it's in the cache
+*/
+type FeaturedCity struct {
+    Query string
+    Datum *WeatherData
+}
+
+// The options featured cities are looked up with: the default language and
+// comparison, so the index shares cache entries with plain API lookups.
+func (s *Server) featuredOptions() lookupOptions {
+    return lookupOptions{Langs: s.getLangChain(""), Reference: "hour"}
+}
+
+// Returns the featured cities with whatever weather the cache holds for them.
+// This never goes upstream, so the index stays fast; the warmer keeps the
+// cache filled.
+func (s *Server) getFeaturedCities(now time.Time) []FeaturedCity {
+    var featured []FeaturedCity = make([]FeaturedCity, len(s.config.FeaturedCities))
+    var opts lookupOptions = s.featuredOptions()
+    for i, city := range s.config.FeaturedCities {
+        featured[i].Query = city
+        if datum, ok := s.cache.get(cacheKey(s.resolveAlias(city), opts), now); ok {
+            featured[i].Datum = &datum
+        }
+    }
+    return featured
+}
+
+// Looks up every featured city now and then again every 'interval', keeping
+// them in the cache for the index page. Runs forever, so should be started in
+// its own goroutine.
+func (s *Server) runFeaturedWarmer(interval time.Duration) {
+    for {
+        for _, city := range s.config.FeaturedCities {
+            _, err := s.lookupWeather(city, s.featuredOptions())
+            if err != nil {
+                log.Printf("Couldn't warm featured city %q: %v", city, err)
+            }
+        }
+        time.Sleep(interval)
+    }
+}
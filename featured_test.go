@@ -0,0 +1,41 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// The index links every featured city, in order, with the temperature of
+// those the warmer has cached, and never goes upstream for the rest.
+func TestFeaturedCities(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"FEATURED_CITIES": "London;Paris"})
+    datum, err := s.lookupWeather("London", s.featuredOptions())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var transport *stubTransport = countUpstream(s)
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/")
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body)
+    }
+    if calls := transport.calls.Load(); calls != 0 {
+        t.Errorf("rendering the index made %d upstream requests, want none", calls)
+    }
+
+    var body string = w.Body.String()
+    var london int = strings.Index(body, `<a href="/weather/London">London</a>`)
+    var paris int = strings.Index(body, `<a href="/weather/Paris">Paris</a>`)
+    if london < 0 || paris < london {
+        t.Fatalf("index doesn't link London then Paris:\n%s", body)
+    }
+    var temperature string = s.format.temperature(datum.Main.Temperature, datum.Units)
+    if !strings.Contains(body[london:paris], temperature) {
+        t.Errorf("London's row doesn't show its cached %s:\n%s", temperature, body[london:paris])
+    }
+    if strings.Contains(body[paris:], temperature) {
+        t.Errorf("Paris's row shows a temperature it has no cached weather for:\n%s", body[paris:])
+    }
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+/*
+A summary of the forecast for a single day:
+  - Date: The day the forecast is for
+  - High: The highest temperature forecast for the day
+  - Low: The lowest temperature forecast for the day
+  - Conditions: The distinct conditions expected over the day, in order
+  - Notable: The subset of Conditions worth calling out, such as rain
+*/
+type ForecastDay struct {
+    Date time.Time `json:"date"`
+    High float64 `json:"high"`
+    Low float64 `json:"low"`
+    Conditions []string `json:"conditions"`
+    Notable []string `json:"notable"`
+}
+
+/*
+A city's forecast grouped by day, as served by the API and used for the
+weekly digest.
+*/
+type ForecastSummary struct {
+    Name string `json:"name"`
+    Country string `json:"country"`
+    Days []ForecastDay `json:"days"`
+}
+
+// The number of days covered by the 5-day forecast.
+const maxForecastDays = 5
+
+// Groups forecast data points by the city's local day and computes each day's
+// high, low and conditions. Days are returned in chronological order.
+func getForecastDays(forecast provider.Forecast) []ForecastDay {
+    var days []ForecastDay
+    for _, datum := range forecast.List {
+        var t time.Time = cityTime(datum.Time, forecast.City.Timezone)
+        var date time.Time = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+
+        // Data points are chronological, so a new date starts a new day
+        if len(days) == 0 || !days[len(days)-1].Date.Equal(date) {
+            days = append(days, ForecastDay{Date: date, High: datum.Main.TempMax, Low: datum.Main.TempMin})
+        }
+        var day *ForecastDay = &days[len(days)-1]
+        if datum.Main.TempMax > day.High {
+            day.High = datum.Main.TempMax
+        }
+        if datum.Main.TempMin < day.Low {
+            day.Low = datum.Main.TempMin
+        }
+
+        for _, weather := range datum.Weather {
+            var desc string = getWeatherDescription(weather, "en")
+            if contains(day.Conditions, desc) {
+                continue
+            }
+            day.Conditions = append(day.Conditions, desc)
+            if isNotable(weather) {
+                day.Notable = append(day.Notable, desc)
+            }
+        }
+    }
+    return days
+}
+
+// Summarizes a forecast by day.
+func getForecastSummary(forecast provider.Forecast) ForecastSummary {
+    return ForecastSummary{forecast.City.Name, forecast.City.Country, getForecastDays(forecast)}
+}
+
+// Returns whether a condition is worth calling out: anything other than clear
+// skies or clouds.
+func isNotable(weather provider.WeatherDesc) bool {
+    return weather.Id < 800 || weather.Id >= 900
+}
+
+// Returns whether a list of strings contains the given string.
+func contains(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+/*
+A part of the day, used to describe how the weather changes over a day:
+  - Name: The name of the part of the day, such as "morning"
+  - Start: The local hour at which it starts
+*/
+type DayPart struct {
+    Name string
+    Start int
+}
+
+var dayParts = []DayPart{{"night", 0}, {"morning", 5}, {"afternoon", 12}, {"evening", 18}, {"night", 22}}
+
+// Returns the part of the day that a local hour falls in.
+func getDayPart(hour int) string {
+    var name string
+    for _, part := range dayParts {
+        if hour >= part.Start {
+            name = part.Name
+        }
+    }
+    return name
+}
+
+/*
+What to expect over the rest of a city's local day, kept apart from the
+sentence it's phrased as so that the high can be shown in any unit system:
+  - Conditions: How the conditions change, such as "some broken clouds this
+    morning, clearing by afternoon"
+  - High: The day's high, in the unit system of the weather it belongs to
+*/
+type Narrative struct {
+    Conditions string `json:"conditions" xml:"conditions"`
+    High float64 `json:"high" xml:"high"`
+}
+
+// Composes a short description of what to expect over the rest of the local
+// day, with the high in Celsius, or returns nil if there are no slots. Slots
+// should be chronological forecast data points; only those on the same local
+// day as the first are used.
+func getNarrative(slots []provider.Observation, offset int) *Narrative {
+    if len(slots) == 0 {
+        return nil
+    }
+
+    var phrases []string
+    var lastPart, lastDesc string
+    var lastSeverity int
+    var high float64 = math.Inf(-1)
+    var day int = cityTime(slots[0].Time, offset).YearDay()
+    for _, slot := range slots {
+        var t time.Time = cityTime(slot.Time, offset)
+        if t.YearDay() != day {
+            break
+        }
+        high = math.Max(high, slot.Main.TempMax)
+
+        // Describe each part of the day by its most significant condition,
+        // and only mention it when the conditions change
+        var part string = getDayPart(t.Hour())
+        var primary provider.WeatherDesc = getPrimaryCondition(slot.Weather)
+        var desc string = getWeatherDescription(primary, "en")
+        var severity int = getSeverity(primary)
+        if part == lastPart && severity <= lastSeverity {
+            continue
+        } else if len(phrases) == 0 {
+            if part == "night" {
+                phrases = append(phrases, desc + " tonight")
+            } else {
+                phrases = append(phrases, desc + " this " + part)
+            }
+        } else if desc != lastDesc {
+            var when string = "by " + part
+            if part == "night" {
+                when = "overnight"
+            }
+            if severity == 0 {
+                phrases = append(phrases, "clearing " + when)
+            } else if severity > lastSeverity {
+                phrases = append(phrases, "turning to " + desc + " " + when)
+            } else {
+                phrases = append(phrases, "easing to " + desc + " " + when)
+            }
+        }
+        lastPart, lastDesc, lastSeverity = part, desc, severity
+    }
+
+    return &Narrative{strings.Join(phrases, ", "), high}
+}
+
+// Phrases a narrative as a sentence with the high in the given unit system,
+// such as "Some broken clouds this morning, clearing by afternoon, high of
+// 18°C."
+func getNarrativeSentence(narrative Narrative, units string, format UnitFormat) string {
+    var sentence string = narrative.Conditions + ", high of " + format.temperature(narrative.High, units) + "."
+    return strings.ToUpper(sentence[:1]) + sentence[1:]
+}
+
+/*
+The data for the forecast page:
+  - Query: The city as it was asked for, to link back to its weather page
+  - Units: The unit system the highs and lows are shown in
+*/
+type ForecastPage struct {
+    ForecastSummary
+    Query string
+    Units string
+}
+
+// Shows a city's forecast for the next few days, grouped by day, with the
+// highs and lows in the unit system given by 'units', or DEFAULT_UNITS.
+func (s *Server) handleForecast(r *http.Request) (interface{}, int, error) {
+    var city string = r.PathValue("city")
+    if !validPath.MatchString("/weather/" + city) {
+        return nil, http.StatusNotFound, errInvalidPage
+    }
+    units, err := parseUnits(r.URL.Query(), s.config.DefaultUnits)
+    if err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+
+    forecast, err := s.weather.Forecast(r.Context(), s.resolveAlias(city))
+    if err != nil {
+        return nil, lookupStatus(err), fmt.Errorf("getting the forecast for %q: %w", city, err)
+    } else if len(forecast.List) == 0 {
+        return nil, http.StatusNotFound, errCityNotFound
+    }
+
+    var page ForecastPage = ForecastPage{getForecastSummary(forecast), city, units}
+    for i := range page.Days {
+        page.Days[i].High = convertTemperature(page.Days[i].High, units)
+        page.Days[i].Low = convertTemperature(page.Days[i].Low, units)
+    }
+    return page, http.StatusOK, nil
+}
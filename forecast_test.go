@@ -0,0 +1,52 @@
+package main
+
+import (
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// Builds a three-hourly forecast slot at a local hour on 1 May 2024, in a city
+// an hour ahead of UTC.
+func narrativeSlot(hour int, high float64, id int, description string) provider.Observation {
+    var slot provider.Observation
+    slot.Time = time.Date(2024, 5, 1, hour, 0, 0, 0, time.FixedZone("", 3600)).Unix()
+    slot.Main.TempMax = high
+    slot.Weather = []provider.WeatherDesc{{Id: id, Description: description}}
+    return slot
+}
+
+// A day of slots is described by how its conditions change from one part of
+// the day to the next, with the day's high, leaving out the next day.
+func TestNarrative(t *testing.T) {
+    var slots []provider.Observation = []provider.Observation{
+        narrativeSlot(6, 11, 803, "broken clouds"),
+        narrativeSlot(9, 14, 803, "broken clouds"),
+        narrativeSlot(12, 17, 800, "clear sky"),
+        narrativeSlot(15, 18.4, 800, "clear sky"),
+        narrativeSlot(18, 15, 500, "light rain"),
+        narrativeSlot(21, 12, 500, "light rain"),
+        narrativeSlot(24, 25, 200, "thunderstorm"),
+    }
+    var narrative *Narrative = getNarrative(slots, 3600)
+    if narrative == nil {
+        t.Fatal("no narrative for a day of slots")
+    }
+    var want string = "some broken clouds this morning, clearing by afternoon, turning to light rain by evening"
+    if narrative.Conditions != want {
+        t.Errorf("conditions = %q, want %q", narrative.Conditions, want)
+    }
+    if narrative.High != 18.4 {
+        t.Errorf("high = %v, want 18.4, from today's slots only", narrative.High)
+    }
+    var sentence string = getNarrativeSentence(*narrative, "metric", UnitFormat{defaultUnitLabels, ""})
+    if !strings.HasPrefix(sentence, "Some broken clouds this morning") || !strings.Contains(sentence, "high of 18°C") {
+        t.Errorf("sentence = %q, want the trend and the high", sentence)
+    }
+
+    if narrative = getNarrative(nil, 0); narrative != nil {
+        t.Errorf("narrative = %+v for no slots, want nil", narrative)
+    }
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+var errNotLocated = errors.New("couldn't locate the client")
+
+// Finds the approximate coordinates of an IP address.
+type GeoIPResolver interface {
+    locate(ip string) (lat, lon float64, err error)
+}
+
+/*
+Locates IPs with a third-party geo-IP service over HTTP:
+  - http: The client used for requests to the service
+  - url: The service's URL, with "{ip}" standing in for the address; it must
+    answer with a JSON object with "lat" and "lon" fields
+*/
+type httpGeoIP struct {
+    http *http.Client
+    url string
+}
+
+func newHTTPGeoIP(url string) *httpGeoIP {
+    return &httpGeoIP{&http.Client{Timeout: 5 * time.Second}, url}
+}
+
+func (g *httpGeoIP) locate(ip string) (float64, float64, error) {
+    // Private and loopback addresses can't be located, so don't ask
+    var addr net.IP = net.ParseIP(ip)
+    if addr == nil || addr.IsPrivate() || addr.IsLoopback() {
+        return 0, 0, errNotLocated
+    }
+
+    resp, err := g.http.Get(strings.ReplaceAll(g.url, "{ip}", url.PathEscape(ip)))
+    if err != nil {
+        return 0, 0, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return 0, 0, fmt.Errorf("geo-IP service returned %s", resp.Status)
+    }
+
+    var location struct {
+        Lat *float64 `json:"lat"`
+        Lon *float64 `json:"lon"`
+    }
+    err = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&location)
+    if err != nil {
+        return 0, 0, err
+    } else if location.Lat == nil || location.Lon == nil {
+        return 0, 0, errNotLocated
+    }
+    return *location.Lat, *location.Lon, nil
+}
+
+// Finds the city closest to the client, returning its name and ID. Returns
+// an error if the client's IP can't be located or nothing is near it.
+func (s *Server) locateClient(r *http.Request, lang string) (string, int32, error) {
+    if s.geoip == nil {
+        return "", 0, errNotLocated
+    }
+    lat, lon, err := s.geoip.locate(clientIP(r))
+    if err != nil {
+        return "", 0, err
+    }
+    city, id, err := s.findCityAt(r.Context(), lat, lon, lang)
+    if err == errCityNotFound {
+        return "", 0, errNotLocated
+    }
+    return city, id, err
+}
+
+// Shows the weather near the client, as located by its IP address, or in
+// GEOIP_FALLBACK_CITY if it can't be located. The readings are shown in the
+// unit system given by 'units', or DEFAULT_UNITS.
+func (s *Server) handleHere(r *http.Request) (interface{}, int, error) {
+    units, err := parseUnits(r.URL.Query(), s.config.DefaultUnits)
+    if err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+
+    var opts lookupOptions = s.getLookupOptions(r)
+    city, id, err := s.locateClient(r, opts.Langs[0])
+    if err != nil {
+        if err != errNotLocated {
+            log.Printf("Couldn't locate %s: %v", clientIP(r), err)
+        }
+        city = s.config.GeoIPFallbackCity
+    } else {
+        opts.CityID = id
+    }
+
+    datum, err := s.lookupWeather(city, opts)
+    if err != nil {
+        return nil, lookupStatus(err), err
+    }
+    datum = s.convertForDisplay(datum, units)
+    datum.Clock = s.getClock(r)
+    return datum, http.StatusOK, nil
+}
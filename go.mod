@@ -0,0 +1,3 @@
+module github.com/ksuarz/weather
+
+go 1.22
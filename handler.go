@@ -0,0 +1,216 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "runtime/debug"
+    "strings"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+/* The core of a request handler. It returns the data to respond with, the HTTP
+status and any error, leaving the response itself to a wrapper so that the
+success, not-found and upstream-error paths are written the same way
+everywhere.
+
+A status of 0 means 200 OK on success and 500 Internal Server Error on failure.
+Client errors (4xx) are shown to the client verbatim; server errors are logged
+and answered with the generic status text so upstream details don't leak. */
+type handlerFunc func(r *http.Request) (interface{}, int, error)
+
+// Picks the status for a lookup error: 404 if the city doesn't exist, 503 if
+// the circuit breaker or a rate limit is refusing upstream requests, 504 if the
+// request's time budget ran out, or 502 since anything else, including a
+// provider.UpstreamError such as a rejected API key, means the upstream
+// couldn't be reached or understood.
+func lookupStatus(err error) int {
+    if errors.Is(err, errCityNotFound) {
+        return http.StatusNotFound
+    } else if errors.Is(err, context.DeadlineExceeded) {
+        return http.StatusGatewayTimeout
+    } else if errors.Is(err, provider.ErrCircuitOpen) || errors.Is(err, provider.ErrRateLimited) {
+        return http.StatusServiceUnavailable
+    }
+    return http.StatusBadGateway
+}
+
+// Returns the message to show a client for a handlerFunc's status and error:
+// the error itself for client errors, or the status text for server errors,
+// which are logged instead so upstream details don't leak. A missing city is
+// always just "city not found", however the lookup wrapped it.
+func errorMessage(r *http.Request, status int, err error) string {
+    if status >= 500 {
+        log.Printf("Error serving %s: %v", r.URL.Path, err)
+        return http.StatusText(status)
+    } else if errors.Is(err, errCityNotFound) {
+        return errCityNotFound.Error()
+    }
+    return err.Error()
+}
+
+// Writes a plain-text error response for a handlerFunc's status and error.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+    if status == 0 {
+        status = http.StatusInternalServerError
+    }
+    http.Error(w, errorMessage(r, status, err), status)
+}
+
+// The machine-readable code for each status an API error may have.
+var apiErrorCodes = map[int]string{
+    http.StatusBadRequest: "bad_request",
+    http.StatusUnauthorized: "unauthorized",
+    http.StatusNotFound: "not_found",
+    http.StatusMethodNotAllowed: "method_not_allowed",
+    http.StatusTooManyRequests: "rate_limited",
+    http.StatusInternalServerError: "internal_error",
+    http.StatusBadGateway: "upstream_error",
+    http.StatusServiceUnavailable: "unavailable",
+    http.StatusGatewayTimeout: "timeout",
+}
+
+/*
+The body of an API error response:
+  - Error: A human-readable description of the error
+  - Code: A machine-readable code such as "not_found"; see apiErrorCodes
+*/
+type APIError struct {
+    Error string `json:"error"`
+    Code string `json:"code"`
+}
+
+// Writes a JSON error response for a handlerFunc's status and error, such as
+// {"error":"city not found","code":"not_found"}.
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, err error) {
+    if status == 0 {
+        status = http.StatusInternalServerError
+    }
+    var body APIError = APIError{Error: errorMessage(r, status, err), Code: apiErrorCodes[status]}
+    if body.Code == "" {
+        body.Code = "error"
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(body)
+}
+
+// Wraps an API handlerFunc, encoding its data as JSON or, with 'format=xml',
+// as XML. Data that can be flattened to a single row may also be requested
+// with 'format=csv'. Errors are always JSON. Where the time went is logged.
+func (s *Server) api(h handlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var format string = r.URL.Query().Get("format")
+        if format != "" && format != "json" && format != "xml" && format != "csv" {
+            writeAPIError(w, r, http.StatusBadRequest, errors.New("format must be json, xml or csv"))
+            return
+        }
+
+        r, cancel := s.withBudget(r)
+        defer cancel()
+        r, timings := withTimings(r)
+        defer timings.log(r)
+        data, status, err := h(r)
+        if err != nil {
+            writeAPIError(w, r, status, err)
+            return
+        } else if status == 0 {
+            status = http.StatusOK
+        }
+
+        var start time.Time = time.Now()
+        defer func() { timings.Render = time.Since(start) }()
+
+        if format == "csv" {
+            record, ok := data.(csvRecord)
+            if !ok {
+                writeAPIError(w, r, http.StatusBadRequest, errors.New("csv is not available for this endpoint"))
+                return
+            }
+            writeCSV(w, r, status, record)
+        } else if format == "xml" {
+            // Not everything has an XML form, so find out before writing
+            buf, err := xml.Marshal(data)
+            if err != nil {
+                writeAPIError(w, r, http.StatusBadRequest, errors.New("xml is not available for this endpoint"))
+                return
+            }
+            w.Header().Set("Content-Type", "application/xml")
+            w.WriteHeader(status)
+            w.Write([]byte(xml.Header))
+            w.Write(buf)
+        } else {
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(status)
+            json.NewEncoder(w).Encode(data)
+        }
+    }
+}
+
+// Implemented by page data that is rendered with a template other than the
+// page's usual one, such as the list of candidates for an ambiguous search.
+type templateOverride interface {
+    templateName() string
+}
+
+// Wraps a page handlerFunc, rendering its data with the named template. A 404
+// shows the not-found page instead, and other errors the error page, both in
+// the request's language. Where the time went is logged.
+func (s *Server) page(name string, h handlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        r, cancel := s.withBudget(r)
+        defer cancel()
+        r, timings := withTimings(r)
+        defer timings.log(r)
+        data, status, err := h(r)
+        if status == http.StatusNotFound {
+            s.renderNotFound(w, r, http.StatusNotFound)
+            return
+        } else if err != nil {
+            s.renderErrorPage(w, r, status, err)
+            return
+        } else if status == 0 {
+            status = http.StatusOK
+        }
+        var tmpl string = name
+        if override, ok := data.(templateOverride); ok {
+            tmpl = override.templateName()
+        }
+        var start time.Time = time.Now()
+        s.renderTemplate(w, status, tmpl, data)
+        timings.Render = time.Since(start)
+    }
+}
+
+// Wraps a handler so that a panic while serving one request is logged with its
+// stack and answered with a 500, the API's JSON error or the error page,
+// rather than dropping the connection. Aborted responses, which panic with
+// http.ErrAbortHandler on purpose, are left to the server.
+func (s *Server) withRecovery(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        defer func() {
+            v := recover()
+            if v == nil {
+                return
+            } else if v == http.ErrAbortHandler {
+                panic(v)
+            }
+            log.Printf("Panic serving %s: %v\n%s", r.URL.Path, v, debug.Stack())
+            var err error = fmt.Errorf("panic: %v", v)
+            if strings.HasPrefix(r.URL.Path, "/api/") {
+                writeAPIError(w, r, http.StatusInternalServerError, err)
+                return
+            }
+            s.renderErrorPage(w, r, http.StatusInternalServerError, err)
+        }()
+        h.ServeHTTP(w, r)
+    })
+}
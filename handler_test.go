@@ -0,0 +1,293 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// Runs a handlerFunc through the API wrapper, returning the response.
+func serveAPI(s *Server, h handlerFunc) *httptest.ResponseRecorder {
+    var w *httptest.ResponseRecorder = httptest.NewRecorder()
+    s.api(h)(w, httptest.NewRequest(http.MethodGet, "/api/weather/London", nil))
+    return w
+}
+
+func TestAPIWrapper(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var tests = []struct {
+        name string
+        data interface{}
+        status int
+        err error
+        wantStatus int
+        wantCode string
+        wantMessage string
+    }{
+        {"success", map[string]int{"temp": 7}, 0, nil, http.StatusOK, "", ""},
+        {"created", map[string]int{"temp": 7}, http.StatusCreated, nil, http.StatusCreated, "", ""},
+        {"not found", nil, http.StatusNotFound, errCityNotFound, http.StatusNotFound, "not_found", "city not found"},
+        {"bad request", nil, http.StatusBadRequest, errors.New("units must be metric"), http.StatusBadRequest, "bad_request", "units must be metric"},
+        {"upstream", nil, http.StatusBadGateway, errors.New("secret upstream detail"), http.StatusBadGateway, "upstream_error", "Bad Gateway"},
+        {"no status", nil, 0, errors.New("oops"), http.StatusInternalServerError, "internal_error", "Internal Server Error"},
+    }
+    for _, test := range tests {
+        var w *httptest.ResponseRecorder = serveAPI(s, func(r *http.Request) (interface{}, int, error) {
+            return test.data, test.status, test.err
+        })
+        if w.Code != test.wantStatus {
+            t.Errorf("%s: status %d, want %d", test.name, w.Code, test.wantStatus)
+        }
+        if test.err == nil {
+            continue
+        }
+        var body APIError
+        json.Unmarshal(w.Body.Bytes(), &body)
+        if body.Code != test.wantCode || body.Error != test.wantMessage {
+            t.Errorf("%s: error %+v, want code %q and message %q", test.name, body, test.wantCode, test.wantMessage)
+        }
+    }
+}
+
+func TestPageWrapper(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var tests = []struct {
+        name string
+        status int
+        err error
+        wantStatus int
+        wantBody string
+    }{
+        {"not found", http.StatusNotFound, errCityNotFound, http.StatusNotFound, "could not be found"},
+        {"upstream", http.StatusBadGateway, errors.New("secret upstream detail"), http.StatusBadGateway, "Something went wrong."},
+        {"timeout", http.StatusGatewayTimeout, errors.New("secret deadline"), http.StatusGatewayTimeout, "Something went wrong."},
+        {"bad request", http.StatusBadRequest, errors.New("units must be metric"), http.StatusBadRequest, "units must be metric"},
+    }
+    for _, test := range tests {
+        var w *httptest.ResponseRecorder = httptest.NewRecorder()
+        s.page("weather", func(r *http.Request) (interface{}, int, error) {
+            return nil, test.status, test.err
+        })(w, httptest.NewRequest(http.MethodGet, "/weather/London", nil))
+        if w.Code != test.wantStatus {
+            t.Errorf("%s: status %d, want %d", test.name, w.Code, test.wantStatus)
+        } else if !strings.Contains(w.Body.String(), test.wantBody) {
+            t.Errorf("%s: body doesn't contain %q:\n%s", test.name, test.wantBody, w.Body.String())
+        } else if strings.Contains(w.Body.String(), "secret") {
+            t.Errorf("%s: body leaks the upstream error", test.name)
+        }
+    }
+}
+
+func TestGarbageUpstreamIsBadGateway(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    s.http.Transport = &stubTransport{respond: func(req *http.Request) (*http.Response, error) {
+        return stubResponse(req, http.StatusOK, "<html>not json"), nil
+    }}
+    for _, path := range []string{"/weather/London", "/api/weather/London"} {
+        if w := serve(s, http.MethodGet, path); w.Code != http.StatusBadGateway {
+            t.Errorf("%s: status %d, want 502", path, w.Code)
+        }
+    }
+    // The server is still up and serving
+    if w := serve(s, http.MethodGet, "/healthz"); w.Code != http.StatusOK {
+        t.Errorf("/healthz: status %d after upstream errors", w.Code)
+    }
+}
+
+func TestSanitizeRedirect(t *testing.T) {
+    var tests = []struct {
+        target string
+        want string
+    }{
+        {"/weather/London", "/weather/London"},
+        {"/", "/"},
+        {"https://evil.com/", "/"},
+        {"//evil.com", "/"},
+        {"/\\evil.com", "/"},
+        {"javascript:alert(1)", "/"},
+        {"weather/London", "/"},
+        {"http://user@evil.com", "/"},
+    }
+    for _, test := range tests {
+        if got := sanitizeRedirect(test.target); got != test.want {
+            t.Errorf("sanitizeRedirect(%q) = %q, want %q", test.target, got, test.want)
+        }
+    }
+}
+
+func TestHomeRedirect(t *testing.T) {
+    var tests = []struct {
+        home string
+        want string
+    }{
+        {"", "/"},
+        {"London", "/weather/London"},
+        {"New York", "/weather/New%20York"},
+        {"San Francisco,US", "/weather/San%20Francisco%2CUS"},
+    }
+    for _, test := range tests {
+        var s *Server = newTestServer(t, map[string]string{"HOME_CITY": test.home})
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/weather/")
+        if w.Code != http.StatusFound || w.Header().Get("Location") != test.want {
+            t.Errorf("HOME_CITY=%q: got %d to %q, want 302 to %q", test.home, w.Code, w.Header().Get("Location"), test.want)
+        }
+    }
+}
+
+// Returns the keys in a decoded JSON document that aren't snake_case.
+func nonSnakeKeys(v interface{}, path string) []string {
+    var bad []string
+    switch v := v.(type) {
+        case map[string]interface{}:
+            for key, value := range v {
+                if strings.ToLower(key) != key || strings.Contains(key, "-") {
+                    bad = append(bad, path + key)
+                }
+                bad = append(bad, nonSnakeKeys(value, path + key + ".")...)
+            }
+        case []interface{}:
+            for _, value := range v {
+                bad = append(bad, nonSnakeKeys(value, path)...)
+            }
+    }
+    return bad
+}
+
+func TestAPIKeysAreSnakeCase(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"HOURLY_GRAPH": "1"})
+    for _, path := range []string{"/api/weather/London", "/api/weather/London?units=both"} {
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, path)
+        var doc map[string]interface{}
+        if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+            t.Fatalf("%s: %v", path, err)
+        }
+        if bad := nonSnakeKeys(doc, ""); len(bad) > 0 {
+            t.Errorf("%s: keys aren't snake_case: %v", path, bad)
+        }
+        for _, key := range []string{"record_high", "record_low", "main_icon", "full_description", "narrative"} {
+            if _, ok := doc[key]; !ok {
+                t.Errorf("%s: no %q", path, key)
+            }
+        }
+    }
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+    var tests = []struct {
+        header string
+        want string
+    }{
+        {"", ""},
+        {"fr", "fr"},
+        {"fr-CH, fr;q=0.9, en;q=0.8, *;q=0.5", "fr,fr,en"},
+        {"en;q=0.5, DE", "de,en"},
+        {"es;q=0, it", "it"},
+        {"ja;q=bad, ko", "ko"},
+    }
+    for _, test := range tests {
+        if got := strings.Join(parseAcceptLanguage(test.header), ","); got != test.want {
+            t.Errorf("parseAcceptLanguage(%q) = %q, want %q", test.header, got, test.want)
+        }
+    }
+}
+
+// The not-found page is in the language asked for with 'lang' or, failing
+// that, Accept-Language, if it's trusted and translated, and otherwise English.
+func TestNotFoundPageLanguage(t *testing.T) {
+    var tests = []struct {
+        trusted string
+        query string
+        header string
+        want string
+    }{
+        {"fr,de", "", "fr-CH, fr;q=0.9", "fr"},
+        {"fr,de", "", "ja, de;q=0.5", "de"},
+        {"fr,de", "?lang=de", "fr", "de"},
+        {"fr,de", "?lang=ja", "", "en"},
+        {"fr,de", "", "ja", "en"},
+        {"", "", "fr", "en"},
+    }
+    for _, test := range tests {
+        var s *Server = newTestServer(t, map[string]string{"TRUSTED_LANGS": test.trusted})
+        var w *httptest.ResponseRecorder = httptest.NewRecorder()
+        var r *http.Request = httptest.NewRequest(http.MethodGet, "/weather/Nowhere" + test.query, nil)
+        r.Header.Set("Accept-Language", test.header)
+        s.page("weather", func(r *http.Request) (interface{}, int, error) {
+            return nil, http.StatusNotFound, errCityNotFound
+        })(w, r)
+        if got := w.Header().Get("Content-Language"); got != test.want {
+            t.Errorf("%s with Accept-Language %q: language %q, want %q", test.query, test.header, got, test.want)
+        } else if !strings.Contains(w.Body.String(), pageTexts[test.want].NotFoundDetail) {
+            t.Errorf("%s with Accept-Language %q: body isn't in %s:\n%s", test.query, test.header, test.want, w.Body)
+        }
+    }
+}
+
+// The XML form of a reading decodes to the same weather as the JSON form.
+func TestAPIXML(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London?format=xml")
+    if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/xml" {
+        t.Fatalf("status %d with %q, want XML", w.Code, w.Header().Get("Content-Type"))
+    }
+    var fromXML WeatherData
+    if err := xml.Unmarshal(w.Body.Bytes(), &fromXML); err != nil {
+        t.Fatalf("%v:\n%s", err, w.Body)
+    }
+
+    var fromJSON WeatherData
+    if err := json.Unmarshal(serve(s, http.MethodGet, "/api/weather/London").Body.Bytes(), &fromJSON); err != nil {
+        t.Fatal(err)
+    }
+    if fromXML.XMLName.Local != "current" {
+        t.Errorf("root element <%s>, want <current>", fromXML.XMLName.Local)
+    }
+    fromXML.XMLName = fromJSON.XMLName
+    if !reflect.DeepEqual(fromXML, fromJSON) {
+        t.Errorf("XML decodes to\n%+v\nwant the JSON's\n%+v", fromXML, fromJSON)
+    }
+}
+
+// Failing upstream requests and panicking handlers are answered with an error
+// page of the right status, and the server goes on serving.
+func TestFailuresKeepServing(t *testing.T) {
+    var tests = []struct {
+        name string
+        err error
+        want int
+    }{
+        {"refused", errors.New("connection refused"), http.StatusBadGateway},
+        {"timeout", fmt.Errorf("dialing: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+    }
+    for _, test := range tests {
+        var s *Server = newTestServer(t, nil)
+        s.http.Transport = &stubTransport{respond: func(req *http.Request) (*http.Response, error) {
+            return nil, test.err
+        }}
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/weather/London")
+        if w.Code != test.want || !strings.Contains(w.Body.String(), "Something went wrong.") {
+            t.Errorf("%s: status %d, want %d with the error page:\n%s", test.name, w.Code, test.want, w.Body)
+        }
+        if w = serve(s, http.MethodGet, "/healthz"); w.Code != http.StatusOK {
+            t.Errorf("%s: /healthz: status %d afterwards", test.name, w.Code)
+        }
+    }
+
+    var s *Server = newTestServer(t, nil)
+    for _, path := range []string{"/weather/London", "/api/weather/London"} {
+        var w *httptest.ResponseRecorder = httptest.NewRecorder()
+        s.withRecovery(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+            panic("secret bug")
+        })).ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+        if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "secret") {
+            t.Errorf("%s: panic answered with %d:\n%s", path, w.Code, w.Body)
+        }
+    }
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// The upper bounds, in seconds, of the latency histograms' buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+/*
+A latency histogram over latencyBuckets:
+  - counts: The number of observations in each bucket, not cumulative; the
+    last counts those above every bound
+  - sum: The total of every observation, in seconds
+  - count: The number of observations
+*/
+type histogram struct {
+    counts []int64
+    sum float64
+    count int64
+}
+
+func newHistogram() *histogram {
+    return &histogram{counts: make([]int64, len(latencyBuckets) + 1)}
+}
+
+func (h *histogram) observe(seconds float64) {
+    var i int = sort.SearchFloat64s(latencyBuckets, seconds)
+    h.counts[i] = h.counts[i] + 1
+    h.sum = h.sum + seconds
+    h.count = h.count + 1
+}
+
+/*
+The counters and histograms served at /metrics for Prometheus, keyed by their
+labels. Safe for concurrent use:
+  - mu: Guards the rest
+  - requests: The number of responses, by route and status code
+  - latency: How long responses took, by route
+  - errors: The number of error responses, by class; see apiErrorCodes
+  - upstream: The number of upstream requests, by provider, endpoint and
+    result: "success", "error", or "refused" if the circuit breaker or a rate
+    limit stopped it being made
+  - upstreamLatency: How long upstream requests took, by provider and endpoint
+*/
+type Metrics struct {
+    mu sync.Mutex
+    requests map[[2]string]int64
+    latency map[string]*histogram
+    errors map[string]int64
+    upstream map[[3]string]int64
+    upstreamLatency map[[2]string]*histogram
+}
+
+func newMetrics() *Metrics {
+    return &Metrics{
+        requests: make(map[[2]string]int64),
+        latency: make(map[string]*histogram),
+        errors: make(map[string]int64),
+        upstream: make(map[[3]string]int64),
+        upstreamLatency: make(map[[2]string]*histogram),
+    }
+}
+
+// Records a response to a request on 'route', the pattern it was routed by.
+func (m *Metrics) observeRequest(route string, status int, elapsed time.Duration) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    var key [2]string = [2]string{route, fmt.Sprint(status)}
+    m.requests[key] = m.requests[key] + 1
+    if m.latency[route] == nil {
+        m.latency[route] = newHistogram()
+    }
+    m.latency[route].observe(elapsed.Seconds())
+    if status >= 400 {
+        var class string = apiErrorCodes[status]
+        if class == "" {
+            class = "error"
+        }
+        m.errors[class] = m.errors[class] + 1
+    }
+}
+
+// Records an upstream request to a provider's endpoint, or "other" if it's not
+// one we know. Requests that were refused before being made have no latency
+// to record.
+func (m *Metrics) observeUpstream(provider, endpoint, result string, elapsed time.Duration) {
+    if endpoint == "" {
+        endpoint = "other"
+    }
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    var key [3]string = [3]string{provider, endpoint, result}
+    m.upstream[key] = m.upstream[key] + 1
+    if result == "refused" {
+        return
+    }
+    var latencyKey [2]string = [2]string{provider, endpoint}
+    if m.upstreamLatency[latencyKey] == nil {
+        m.upstreamLatency[latencyKey] = newHistogram()
+    }
+    m.upstreamLatency[latencyKey].observe(elapsed.Seconds())
+}
+
+// Returns the result label for an upstream request's error.
+func upstreamResult(err error) string {
+    if err == nil {
+        return "success"
+    } else if err == provider.ErrCircuitOpen || err == provider.ErrRateLimited {
+        return "refused"
+    }
+    return "error"
+}
+
+// Formats label names and values as {name="value",...}, escaped as the text
+// exposition format requires.
+func formatLabels(names []string, values ...string) string {
+    var pairs []string
+    for i, name := range names {
+        var value string = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+        pairs = append(pairs, name + `="` + value + `"`)
+    }
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Writes a histogram's buckets, sum and count under 'name', each labeled with
+// 'names' and 'values' and, for the buckets, their upper bound.
+func writeHistogram(w io.Writer, name string, names []string, values []string, h *histogram) {
+    var cumulative int64 = 0
+    for i, bound := range latencyBuckets {
+        cumulative = cumulative + h.counts[i]
+        fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(append(names, "le"), append(values, fmt.Sprint(bound))...), cumulative)
+    }
+    fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(append(names, "le"), append(values, "+Inf")...), h.count)
+    fmt.Fprintf(w, "%s_sum%s %g\n", name, formatLabels(names, values...), h.sum)
+    fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(names, values...), h.count)
+}
+
+// Returns a map's keys in order, so that the metrics are always written in the
+// same order.
+func sortedKeys[K interface{ ~string | ~[2]string | ~[3]string }, V any](m map[K]V) []K {
+    var keys []K = make([]K, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+    return keys
+}
+
+// Writes every metric in the Prometheus text exposition format.
+func (m *Metrics) write(w io.Writer) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    fmt.Fprintln(w, "# HELP weather_http_requests_total Responses served, by route and status code.")
+    fmt.Fprintln(w, "# TYPE weather_http_requests_total counter")
+    for _, k := range sortedKeys(m.requests) {
+        fmt.Fprintf(w, "weather_http_requests_total%s %d\n", formatLabels([]string{"route", "code"}, k[0], k[1]), m.requests[k])
+    }
+    fmt.Fprintln(w, "# HELP weather_http_request_duration_seconds How long responses took, by route.")
+    fmt.Fprintln(w, "# TYPE weather_http_request_duration_seconds histogram")
+    for _, route := range sortedKeys(m.latency) {
+        writeHistogram(w, "weather_http_request_duration_seconds", []string{"route"}, []string{route}, m.latency[route])
+    }
+    fmt.Fprintln(w, "# HELP weather_http_errors_total Error responses, by class.")
+    fmt.Fprintln(w, "# TYPE weather_http_errors_total counter")
+    for _, class := range sortedKeys(m.errors) {
+        fmt.Fprintf(w, "weather_http_errors_total%s %d\n", formatLabels([]string{"class"}, class), m.errors[class])
+    }
+    fmt.Fprintln(w, "# HELP weather_upstream_requests_total Upstream requests, by provider, endpoint and result.")
+    fmt.Fprintln(w, "# TYPE weather_upstream_requests_total counter")
+    for _, k := range sortedKeys(m.upstream) {
+        fmt.Fprintf(w, "weather_upstream_requests_total%s %d\n", formatLabels([]string{"provider", "endpoint", "result"}, k[0], k[1], k[2]), m.upstream[k])
+    }
+    fmt.Fprintln(w, "# HELP weather_upstream_request_duration_seconds How long upstream requests took, by provider and endpoint.")
+    fmt.Fprintln(w, "# TYPE weather_upstream_request_duration_seconds histogram")
+    for _, k := range sortedKeys(m.upstreamLatency) {
+        writeHistogram(w, "weather_upstream_request_duration_seconds", []string{"provider", "endpoint"}, []string{k[0], k[1]}, m.upstreamLatency[k])
+    }
+}
+
+// Serves the metrics for Prometheus to scrape, along with the cache's hits
+// and misses and the state of the upstream circuit breaker.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    s.metrics.write(w)
+
+    var status Status = s.getStatus(now())
+    fmt.Fprintln(w, "# HELP weather_cache_hits_total Lookups answered from the cache.")
+    fmt.Fprintln(w, "# TYPE weather_cache_hits_total counter")
+    fmt.Fprintf(w, "weather_cache_hits_total %d\n", status.Cache.Hits)
+    fmt.Fprintln(w, "# HELP weather_cache_misses_total Lookups not found in the cache.")
+    fmt.Fprintln(w, "# TYPE weather_cache_misses_total counter")
+    fmt.Fprintf(w, "weather_cache_misses_total %d\n", status.Cache.Misses)
+    fmt.Fprintln(w, "# HELP weather_cache_hit_ratio The fraction of lookups answered from the cache.")
+    fmt.Fprintln(w, "# TYPE weather_cache_hit_ratio gauge")
+    fmt.Fprintf(w, "weather_cache_hit_ratio %g\n", status.Cache.HitRatio)
+    var open int = 0
+    if status.Upstream.Breaker == "open" {
+        open = 1
+    }
+    fmt.Fprintln(w, "# HELP weather_upstream_breaker_open Whether the circuit breaker is refusing OpenWeatherMap requests.")
+    fmt.Fprintln(w, "# TYPE weather_upstream_breaker_open gauge")
+    fmt.Fprintf(w, "weather_upstream_breaker_open %d\n", open)
+}
+
+/*
+Records the status code written through it, for the metrics:
+  - status: The status written, or 200 if none was written explicitly
+*/
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+    rec.status = status
+    rec.ResponseWriter.WriteHeader(status)
+}
+
+// Lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+    return rec.ResponseWriter
+}
+
+// Wraps a handler so that every response is counted and timed by the route
+// pattern in 'mux' that matches it. Requests the mux can't route are counted
+// under "other", so arbitrary paths don't each get their own series.
+func (s *Server) withMetrics(mux *http.ServeMux, h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var start time.Time = time.Now()
+        var rec *statusRecorder = &statusRecorder{w, http.StatusOK}
+        _, route := mux.Handler(r)
+        h.ServeHTTP(rec, r)
+        if route == "" {
+            route = "other"
+        }
+        s.metrics.observeRequest(route, rec.status, time.Since(start))
+    })
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+    "bytes"
+    _ "embed"
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// The canned reading served for every city in mock mode.
+//go:embed sample/response.json
+var mockFixture []byte
+
+/*
+An http.RoundTripper that answers upstream requests from the embedded fixture
+without touching the network, for offline demos and CI. Every city exists and
+has the fixture's weather; searches return it under the name searched for.
+The canned readings are moved to the current time, as returned by now.
+*/
+type mockTransport struct{}
+
+// Answers an upstream request with canned data shaped like the real response.
+func (m *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    var datum provider.Observation
+    err := json.Unmarshal(mockFixture, &datum)
+    if err != nil {
+        return nil, err
+    }
+
+    // Move the reading to now so it isn't flagged stale
+    var unix int64 = now().Unix()
+    var days int64 = (unix - datum.Time) / 86400 * 86400
+    datum.Time = unix
+    datum.Sys.Sunrise = datum.Sys.Sunrise + days
+    datum.Sys.Sunset = datum.Sys.Sunset + days
+
+    var query url.Values = req.URL.Query()
+    if q := query.Get("q"); q != "" {
+        datum.Name = strings.Split(q, ",")[0]
+    }
+
+    var body interface{}
+    switch {
+        case req.URL.Host == "api.open-meteo.com": body = mockOpenMeteo(datum)
+        case req.URL.Host == "api.weatherbit.io": body = mockWeatherbit(datum)
+        case strings.HasSuffix(req.URL.Path, "/geo/1.0/direct"): body = []provider.Location{{Name: datum.Name, Lat: 40.56, Lon: -74.46, Country: "US"}}
+        case strings.HasSuffix(req.URL.Path, "/find"): body = provider.List{List: []provider.Observation{datum}}
+        case strings.HasSuffix(req.URL.Path, "/weather"): body = datum
+        case strings.HasSuffix(req.URL.Path, "/forecast"): body = mockForecast(datum)
+        case strings.HasSuffix(req.URL.Path, "/history/city"): body = mockHistory(datum, query)
+        default: return mockResponse(req, http.StatusNotFound, map[string]string{"cod": "404", "message": "not mocked"})
+    }
+    return mockResponse(req, http.StatusOK, body)
+}
+
+// Builds an upstream response with a JSON body.
+func mockResponse(req *http.Request, status int, body interface{}) (*http.Response, error) {
+    buf, err := json.Marshal(body)
+    if err != nil {
+        return nil, err
+    }
+    return &http.Response{
+        Status: strconv.Itoa(status) + " " + http.StatusText(status),
+        StatusCode: status,
+        Proto: "HTTP/1.1",
+        ProtoMajor: 1,
+        ProtoMinor: 1,
+        Header: http.Header{"Content-Type": {"application/json"}},
+        Body: ioutil.NopCloser(bytes.NewReader(buf)),
+        ContentLength: int64(len(buf)),
+        Request: req,
+    }, nil
+}
+
+// Builds five days of three-hourly forecasts that warm through each day and
+// cool overnight.
+func mockForecast(datum provider.Observation) provider.Forecast {
+    var forecast provider.Forecast
+    forecast.City.Id = datum.CityId
+    forecast.City.Name = datum.Name
+    forecast.City.Country = datum.Sys.Country
+    forecast.City.Timezone = datum.Timezone
+    for i := 0; i < 8 * maxForecastDays; i = i + 1 {
+        var slot provider.Observation = datum
+        slot.Time = datum.Time + int64(i) * 3 * 3600
+        slot.Main.Temperature = datum.Main.Temperature + float64([]int{-2, -3, -1, 1, 3, 4, 2, 0}[i % 8])
+        forecast.List = append(forecast.List, slot)
+    }
+    return forecast
+}
+
+// Builds hourly or daily history samples for the 'start', 'type' and 'cnt'
+// parameters of a history request. Like the real history API, these are in
+// Kelvin.
+func mockHistory(datum provider.Observation, query url.Values) provider.List {
+    start, _ := strconv.ParseInt(query.Get("start"), 10, 64)
+    count, _ := strconv.Atoi(query.Get("cnt"))
+    var step int64 = 3600
+    if query.Get("type") == "day" {
+        step = 86400
+    }
+    var history provider.List
+    for i := 0; i < count; i = i + 1 {
+        var sample provider.Observation = datum
+        sample.Time = start + int64(i) * step
+        sample.Main.Temperature = datum.Main.Temperature + 273.15 - float64(i % 5) / 2
+        history.List = append(history.List, sample)
+    }
+    return history
+}
+
+// Builds an Open-Meteo current weather response from the fixture, a little
+// warmer so that averaging it in can be seen.
+func mockOpenMeteo(datum provider.Observation) interface{} {
+    return map[string]interface{}{"current": map[string]float64{
+        "temperature_2m": datum.Main.Temperature + 1,
+        "apparent_temperature": datum.Main.FeelsLike + 1,
+        "relative_humidity_2m": datum.Main.Humidity,
+        "pressure_msl": datum.Main.Pressure,
+        "wind_speed_10m": datum.Wind.Speed,
+    }}
+}
+
+// Builds a Weatherbit current weather response from the fixture, a little
+// cooler so that averaging it in can be seen.
+func mockWeatherbit(datum provider.Observation) interface{} {
+    return map[string]interface{}{"count": 1, "data": []map[string]float64{{
+        "temp": datum.Main.Temperature - 1,
+        "app_temp": datum.Main.FeelsLike - 1,
+        "rh": datum.Main.Humidity,
+        "slp": datum.Main.Pressure,
+        "wind_spd": datum.Wind.Speed,
+    }}}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// In mock mode every city has the fixture's weather under its own name, at the
+// current time, and nothing is sent over the network, not even to a proxy.
+func TestMockMode(t *testing.T) {
+    var saved func() time.Time = now
+    now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+    defer func() { now = saved }()
+
+    var sent atomic.Int64
+    var proxy *httptest.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        sent.Add(1)
+        http.Error(w, "no", http.StatusForbidden)
+    }))
+    defer proxy.Close()
+
+    config, err := loadConfig(func(key string) string {
+        return map[string]string{"MOCK_MODE": "1", "OWM_PROXY": proxy.URL, "PROVIDERS": "openweathermap,open-meteo"}[key]
+    })
+    if err != nil {
+        t.Fatalf("mock mode without an API key: %v", err)
+    }
+    s, err := newServer(config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := s.http.Transport.(*mockTransport); !ok {
+        t.Fatalf("upstream requests go through %T, not the mock", s.http.Transport)
+    }
+
+    datum, err := s.lookupWeather("Springfield", lookupOptions{Langs: []string{"en"}, Reference: "hour"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if datum.Name != "Springfield" || datum.Sys.Country != "United States of America" || datum.Main.Humidity != 93 {
+        t.Errorf("got %+v, want the fixture for Springfield", datum.Observation)
+    }
+    if datum.Time != now().Unix() || datum.Stale {
+        t.Errorf("reading is from %d, want now, %d", datum.Time, now().Unix())
+    }
+    if datum.ComparisonDetail == nil {
+        t.Error("no comparison from the mocked history")
+    }
+    if sent.Load() != 0 {
+        t.Errorf("%d requests reached the network", sent.Load())
+    }
+}
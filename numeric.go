@@ -0,0 +1,24 @@
+package main
+
+// Small numeric helpers that the builtin min and max don't cover. Use the
+// builtins for anything they do; don't define helpers that shadow them.
+
+// Returns x limited to the range [low, high].
+func clampInt(x, low, high int) int {
+    if x < low {
+        return low
+    } else if x > high {
+        return high
+    }
+    return x
+}
+
+// Returns x limited to the range [low, high].
+func clampFloat(x, low, high float64) float64 {
+    if x < low {
+        return low
+    } else if x > high {
+        return high
+    }
+    return x
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+    "net/http"
+    "net/url"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// Creates the HTTP client for upstream requests. If a proxy is configured, all
+// requests are sent through it; otherwise the HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY environment variables are honored. In mock mode nothing is sent at
+// all, and canned data is returned instead.
+func newUpstreamClient(config *Config) (*http.Client, error) {
+    var transport *http.Transport = http.DefaultTransport.(*http.Transport).Clone()
+    transport.Proxy = http.ProxyFromEnvironment
+    if config.Proxy != "" {
+        proxyURL, err := url.Parse(config.Proxy)
+        if err != nil {
+            return nil, err
+        }
+        transport.Proxy = http.ProxyURL(proxyURL)
+    }
+
+    var client *http.Client = &http.Client{Transport: transport}
+    if config.MockMode {
+        client.Transport = &mockTransport{}
+    }
+    return client, nil
+}
+
+// Creates the OpenWeatherMap provider, making its requests with 'client'. Its
+// requests are counted in 'metrics' and its health is tracked in 'health', and
+// it reads the time through now so tests can fix the clock.
+func newOpenWeatherMap(config *Config, client *http.Client, health *provider.Health, metrics *Metrics) *provider.OpenWeatherMap {
+    return provider.NewOpenWeatherMap(client, provider.Options{
+        APIKey: config.APIKey,
+        APIVersion: config.APIVersion,
+        GeocodeFirst: config.GeocodeFirst,
+        XML: config.UpstreamFormat == "xml",
+        RateLimits: config.UpstreamRateLimits,
+        Health: health,
+        Observe: func(endpoint string, err error, elapsed time.Duration) {
+            metrics.observeUpstream("openweathermap", endpoint, upstreamResult(err), elapsed)
+        },
+        Now: func() time.Time { return now() },
+    })
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// An http.RoundTripper that answers every request with a function, counting
+// the requests made.
+type stubTransport struct {
+    calls atomic.Int64
+    respond func(req *http.Request) (*http.Response, error)
+}
+
+func (t *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    t.calls.Add(1)
+    return t.respond(req)
+}
+
+// Builds a response with a status and body.
+func stubResponse(req *http.Request, status int, body string) *http.Response {
+    return &http.Response{
+        Status: http.StatusText(status),
+        StatusCode: status,
+        Header: http.Header{"Content-Type": {"application/json"}},
+        Body: ioutil.NopCloser(bytes.NewBufferString(body)),
+        Request: req,
+    }
+}
+
+// Answers every upstream request the server makes with 'respond'.
+func stubUpstream(s *Server, respond func(req *http.Request) (*http.Response, error)) *stubTransport {
+    var transport *stubTransport = &stubTransport{respond: respond}
+    s.http.Transport = transport
+    return transport
+}
+
+const stubLondon = `{"list":[{"name":"London","id":2643743,"dt":1700000000,"main":{"temp":7.14}}]}`
+
+func TestUpstreamErrorStatus(t *testing.T) {
+    var tests = []struct {
+        status int
+        body string
+        want int
+    }{
+        {http.StatusUnauthorized, `{"cod":401,"message":"Invalid API key"}`, http.StatusBadGateway},
+        {http.StatusTooManyRequests, `{"cod":429,"message":"quota exceeded"}`, http.StatusBadGateway},
+        {http.StatusInternalServerError, `oops`, http.StatusBadGateway},
+        {http.StatusNotFound, `{"cod":"404","message":"city not found"}`, http.StatusNotFound},
+    }
+    for _, test := range tests {
+        var s *Server = newTestServer(t, nil)
+        stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+            return stubResponse(req, test.status, test.body), nil
+        })
+        _, err := s.weather.Current(context.Background(), "London", "en")
+        var upstreamErr *provider.UpstreamError
+        if !errors.As(err, &upstreamErr) || upstreamErr.Status != test.status {
+            t.Errorf("status %d: got error %v, want a provider.UpstreamError", test.status, err)
+        } else if got := lookupStatus(err); got != test.want {
+            t.Errorf("status %d: lookupStatus = %d, want %d", test.status, got, test.want)
+        }
+    }
+}
+
+// A response that can't be decoded is the upstream's fault, not a missing
+// city, and a rate-limited endpoint means we're unavailable for now.
+func TestUpstreamFailureStatus(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        return stubResponse(req, http.StatusOK, stubLondon[:40]), nil
+    })
+    _, err := s.weather.Current(context.Background(), "London", "en")
+    var decodeErr *provider.DecodeError
+    if !errors.As(err, &decodeErr) {
+        t.Fatalf("got %v, want a provider.DecodeError", err)
+    } else if got := lookupStatus(err); got != http.StatusBadGateway {
+        t.Errorf("lookupStatus = %d, want 502, not a 404", got)
+    }
+    if got := lookupStatus(provider.ErrRateLimited); got != http.StatusServiceUnavailable {
+        t.Errorf("lookupStatus(ErrRateLimited) = %d, want 503", got)
+    }
+}
+
+// Upstream requests are counted in the metrics by endpoint and result.
+func TestUpstreamMetrics(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        return stubResponse(req, http.StatusOK, stubLondon), nil
+    })
+    s.weather.Current(context.Background(), "London", "en")
+    var w *httptest.ResponseRecorder = serve(s, "GET", "/metrics")
+    if !strings.Contains(w.Body.String(), `endpoint="find"`) {
+        t.Errorf("metrics don't count the find request:\n%s", w.Body.String())
+    }
+}
+
+// With OWM_PROXY set, upstream requests are tunnelled through the proxy
+// rather than sent to OpenWeatherMap directly.
+func TestUpstreamProxy(t *testing.T) {
+    var connects atomic.Int64
+    var target atomic.Value
+    var proxy *httptest.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == http.MethodConnect {
+            connects.Add(1)
+            target.Store(r.Host)
+        }
+        http.Error(w, "no tunnels here", http.StatusForbidden)
+    }))
+    defer proxy.Close()
+
+    config, err := loadConfig(withAPIKey(map[string]string{"OWM_PROXY": proxy.URL}))
+    if err != nil {
+        t.Fatal(err)
+    }
+    s, err := newServer(config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err = s.weather.Current(context.Background(), "London", "en"); err == nil {
+        t.Fatal("got weather through a proxy that refuses tunnels")
+    }
+    if connects.Load() == 0 {
+        t.Fatal("the proxy got no requests")
+    } else if got := target.Load(); got != "api.openweathermap.org:443" {
+        t.Errorf("tunnelled to %v, want api.openweathermap.org:443", got)
+    }
+}
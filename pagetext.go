@@ -0,0 +1,92 @@
+package main
+
+import (
+    _ "embed"
+    "encoding/json"
+    "fmt"
+    "net/http"
+)
+
+// The static text of the not-found and error pages in each language we have
+// translations for. English is always present.
+//go:embed pagetext.json
+var defaultPageText []byte
+var pageTexts map[string]PageText = mustParsePageText(defaultPageText)
+
+/*
+The static text of the not-found and error pages in one language:
+  - NotFoundPage, ErrorPage: The pages' titles
+  - NotFoundTitle, ErrorTitle: The headings shown on the pages
+  - NotFoundDetail, ErrorDetail: The sentences below the headings
+  - Go: The label of the search button
+*/
+type PageText struct {
+    NotFoundPage string `json:"not_found_page"`
+    NotFoundTitle string `json:"not_found_title"`
+    NotFoundDetail string `json:"not_found_detail"`
+    ErrorPage string `json:"error_page"`
+    ErrorTitle string `json:"error_title"`
+    ErrorDetail string `json:"error_detail"`
+    Go string `json:"go"`
+}
+
+// Parses the built-in page text, panicking if it's malformed or has no
+// English since it's built into the binary.
+func mustParsePageText(buf []byte) map[string]PageText {
+    var texts map[string]PageText
+    err := json.Unmarshal(buf, &texts)
+    if err != nil {
+        panic(fmt.Sprintf("invalid pagetext.json: %v", err))
+    } else if _, ok := texts["en"]; !ok {
+        panic("invalid pagetext.json: no English text")
+    }
+    return texts
+}
+
+/*
+The data for the not-found and error pages:
+  - Lang: The language the page is shown in
+  - Text: The page's static text in that language
+  - Status: The HTTP status the page is served with
+  - Message: What was wrong with the request, for client errors; server errors
+    only get the generic text so upstream details don't leak
+*/
+type ErrorPageData struct {
+    Lang string
+    Text PageText
+    Status int
+    Message string
+}
+
+// Picks the language for the not-found and error pages the same way as for
+// weather descriptions, skipping any we have no page text for.
+func (s *Server) getPageLang(r *http.Request) string {
+    for _, lang := range s.getRequestLangs(r) {
+        if _, ok := pageTexts[lang]; ok {
+            return lang
+        }
+    }
+    return "en"
+}
+
+// Renders the localized not-found page with the given status.
+func (s *Server) renderNotFound(w http.ResponseWriter, r *http.Request, status int) {
+    var lang string = s.getPageLang(r)
+    w.Header().Set("Content-Language", lang)
+    s.renderTemplate(w, status, "notfound", ErrorPageData{Lang: lang, Text: pageTexts[lang], Status: status})
+}
+
+// Renders the localized error page for a page handlerFunc's status and error.
+func (s *Server) renderErrorPage(w http.ResponseWriter, r *http.Request, status int, err error) {
+    if status == 0 {
+        status = http.StatusInternalServerError
+    }
+    var lang string = s.getPageLang(r)
+    var data ErrorPageData = ErrorPageData{Lang: lang, Text: pageTexts[lang], Status: status}
+    var message string = errorMessage(r, status, err)
+    if status < 500 {
+        data.Message = message
+    }
+    w.Header().Set("Content-Language", lang)
+    s.renderTemplate(w, status, "error", data)
+}
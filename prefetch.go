@@ -0,0 +1,111 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// How long a city keeps having its comparison prefetched after it was last
+// viewed.
+const prefetchRecent = time.Hour
+
+/*
+The cities whose comparisons were recently looked up, so their history can be
+fetched again in the background before the cached copy expires. Safe for
+concurrent use:
+  - mu: Guards views
+  - views: Maps each history cache key to the latest view
+*/
+type recentViews struct {
+    mu sync.Mutex
+    views map[string]recentView
+}
+
+// A reading whose comparison was looked up, the reference it was compared
+// with, and when.
+type recentView struct {
+    Datum WeatherData
+    Reference string
+    At time.Time
+}
+
+func newRecentViews() *recentViews {
+    return &recentViews{views: make(map[string]recentView)}
+}
+
+// Records that a comparison was looked up.
+func (r *recentViews) add(key string, view recentView) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.views[key] = view
+}
+
+// Returns the views since 'since', forgetting any older ones.
+func (r *recentViews) since(since time.Time) map[string]recentView {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    var views map[string]recentView = make(map[string]recentView, len(r.views))
+    for key, view := range r.views {
+        if view.At.Before(since) {
+            delete(r.views, key)
+        } else {
+            views[key] = view
+        }
+    }
+    return views
+}
+
+// Returns the history cache key for a city's comparison with a reference.
+func historyKey(cityID int32, reference string) string {
+    return fmt.Sprintf("%d|%s", cityID, reference)
+}
+
+// Returns the history to compare a reading with, from the cache if it has been
+// fetched recently or otherwise within 'ctx', and remembers the city so the
+// prefetcher keeps it warm.
+func (s *Server) getComparisonHistory(ctx context.Context, today WeatherData, reference string) (provider.List, error) {
+    var key string = historyKey(today.CityId, reference)
+    s.recent.add(key, recentView{today, reference, now()})
+    if history, ok := s.histories.get(key, now()); ok {
+        return history, nil
+    }
+    return s.fetchComparisonHistory(ctx, key, today, reference)
+}
+
+// Fetches the history to compare a reading with within 'ctx', and caches it.
+func (s *Server) fetchComparisonHistory(ctx context.Context, key string, today WeatherData, reference string) (provider.List, error) {
+    start, count := getReferenceWindow(today, reference, s.config.HistoryType, s.config.HistoryCount)
+    history, err := s.weather.Historical(ctx, today.CityId, time.Unix(start, 0), s.config.HistoryType, count)
+    if err != nil {
+        return provider.List{}, err
+    }
+    s.histories.set(key, history, now())
+    return history, nil
+}
+
+// Refreshes the comparison history of recently viewed cities every
+// 'interval', so that page views find it cached rather than waiting for it.
+// Runs forever, so should be started in its own goroutine.
+func (s *Server) runPrefetcher(interval time.Duration) {
+    for range time.Tick(interval) {
+        s.prefetchComparisons(now())
+    }
+}
+
+// Fetches the comparison history of every city viewed in the last
+// prefetchRecent once, as of 'now'.
+func (s *Server) prefetchComparisons(now time.Time) {
+    for key, view := range s.recent.since(now.Add(-prefetchRecent)) {
+        var today WeatherData = view.Datum
+        today.Time = now.Unix()
+        _, err := s.fetchComparisonHistory(context.Background(), key, today, view.Reference)
+        if err != nil {
+            log.Printf("Couldn't prefetch the comparison for %q: %v", view.Datum.Name, err)
+        }
+    }
+}
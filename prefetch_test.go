@@ -0,0 +1,53 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// Once a viewed city's comparison has been prefetched, the next lookup of it
+// compares from the cache without waiting on a history request, even after
+// the copy fetched inline has expired.
+func TestPrefetchedComparison(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var histories atomic.Int64
+    var mock http.RoundTripper = s.http.Transport
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        if strings.HasSuffix(req.URL.Path, "/history/city") {
+            histories.Add(1)
+        }
+        return mock.RoundTrip(req)
+    })
+
+    serve(s, http.MethodGet, "/api/weather/London")
+    if histories.Load() != 1 {
+        t.Fatalf("the first view made %d history requests, want 1", histories.Load())
+    }
+
+    // Later, once the weather and the history have both expired
+    var later time.Time = now().Add(15 * time.Minute)
+    now = func() time.Time { return later }
+    s.prefetchComparisons(now())
+    if histories.Load() != 2 {
+        t.Fatalf("prefetching made %d history requests, want 1", histories.Load() - 1)
+    }
+
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London")
+    if histories.Load() != 2 {
+        t.Errorf("the view after prefetching made %d history requests, want none", histories.Load() - 2)
+    }
+    if !strings.Contains(w.Body.String(), `"comparison_text":"`) {
+        t.Errorf("the view after prefetching has no comparison: %s", w.Body)
+    }
+
+    // Cities not viewed for prefetchRecent are no longer prefetched
+    later = later.Add(prefetchRecent + time.Minute)
+    s.prefetchComparisons(now())
+    if histories.Load() != 2 {
+        t.Errorf("prefetched a city not viewed for %v", prefetchRecent)
+    }
+}
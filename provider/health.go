@@ -0,0 +1,78 @@
+package provider
+
+import (
+    "errors"
+    "sync"
+    "time"
+)
+
+// The number of consecutive upstream failures after which the circuit breaker
+// opens, and how long it stays open before letting a request through to see
+// whether the upstream has recovered.
+const breakerThreshold = 5
+const breakerCooldown = 30 * time.Second
+
+// Returned instead of making a request while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("upstream unavailable: circuit breaker open")
+
+/*
+Tracks the health of the upstream API, acting as a circuit breaker so that an
+outage fails requests quickly rather than piling up slow ones. The zero value
+is a healthy upstream. Safe for concurrent use:
+  - mu: Guards the other fields
+  - lastSuccess: When a request last succeeded, or zero if none has
+  - failures: The number of consecutive failed requests
+  - openedAt: When the breaker last opened
+*/
+type Health struct {
+    mu sync.Mutex
+    lastSuccess time.Time
+    failures int
+    openedAt time.Time
+}
+
+// Returns the breaker's state: "closed" while requests are flowing, "open"
+// while they're being refused, or "half-open" once the cooldown has passed and
+// the next request will be tried. Along with it, returns when a request last
+// succeeded, or the zero time if none has.
+func (h *Health) State(now time.Time) (string, time.Time) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.state(now), h.lastSuccess
+}
+
+// Returns the breaker's state; h.mu must be held.
+func (h *Health) state(now time.Time) string {
+    if h.failures < breakerThreshold {
+        return "closed"
+    } else if now.Sub(h.openedAt) < breakerCooldown {
+        return "open"
+    }
+    return "half-open"
+}
+
+// Returns ErrCircuitOpen if requests are currently being refused.
+func (h *Health) allow(now time.Time) error {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if h.state(now) == "open" {
+        return ErrCircuitOpen
+    }
+    return nil
+}
+
+// Records the outcome of an upstream request, opening the breaker after too
+// many failures in a row or closing it again after a success.
+func (h *Health) record(err error, now time.Time) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if err == nil {
+        h.lastSuccess = now
+        h.failures = 0
+        return
+    }
+    h.failures = h.failures + 1
+    if h.failures >= breakerThreshold {
+        h.openedAt = now
+    }
+}
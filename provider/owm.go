@@ -0,0 +1,364 @@
+package provider
+
+import (
+    "compress/gzip"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "net/url"
+    "regexp"
+    "strings"
+    "time"
+)
+
+/*
+The settings for an OpenWeatherMap provider:
+  - APIKey: The API key added to every upstream request
+  - APIVersion: The version of the data API to use, 2.5 by default
+  - GeocodeFirst: Whether to resolve city names to coordinates before looking
+    up the weather
+  - XML: Whether to request current weather as XML rather than JSON
+  - RateLimits: The most requests a minute each endpoint may make, keyed by
+    the names ParseRateLimits accepts; endpoints not listed aren't limited
+  - Health: The upstream's health, shared with whoever reports on it; nil
+    gives the provider its own
+  - Observe: Called with the endpoint, outcome and duration of every request,
+    including those refused by a rate limit or the circuit breaker; may be nil
+  - Now: Returns the current time, for rate limits and the circuit breaker;
+    time.Now if nil
+*/
+type Options struct {
+    APIKey string
+    APIVersion string
+    GeocodeFirst bool
+    XML bool
+    RateLimits map[string]int
+    Health *Health
+    Observe func(endpoint string, err error, elapsed time.Duration)
+    Now func() time.Time
+}
+
+/*
+A WeatherProvider backed by the OpenWeatherMap API:
+  - http: The HTTP client used for all upstream requests
+  - options: The provider's settings
+  - health: The upstream's recent health, which also trips the circuit breaker
+  - limits: The rate limit of each upstream endpoint that has one; the map
+    itself never changes
+*/
+type OpenWeatherMap struct {
+    http *http.Client
+    options Options
+    health *Health
+    limits map[string]*tokenBucket
+}
+
+// Creates an OpenWeatherMap provider that makes its requests with 'client',
+// so the caller decides on proxies, timeouts and, in tests, the transport.
+func NewOpenWeatherMap(client *http.Client, options Options) *OpenWeatherMap {
+    if options.APIVersion == "" {
+        options.APIVersion = "2.5"
+    }
+    if options.Now == nil {
+        options.Now = time.Now
+    }
+    var health *Health = options.Health
+    if health == nil {
+        health = &Health{}
+    }
+    return &OpenWeatherMap{
+        http: client,
+        options: options,
+        health: health,
+        limits: newEndpointLimits(options.RateLimits),
+    }
+}
+
+// The largest upstream response body we'll read. Bodies are read up to this
+// limit whether or not they declare a length, as chunked responses don't.
+const MaxResponseBytes = 4 << 20
+
+// The number of times a request is attempted when the upstream response can't
+// be decoded, such as when the connection is reset mid-stream.
+const maxFetchAttempts = 2
+
+// Returned when an upstream response body is truncated or otherwise fails to
+// decode. This is an upstream error, distinct from an empty result.
+type DecodeError struct {
+    Err error
+}
+
+func (e *DecodeError) Error() string {
+    return "unmarshaling failed: " + e.Err.Error()
+}
+
+// Returned when the upstream answers with a status other than 2xx, such as a
+// 401 for a bad API key, a 429 once the subscription's quota is used up, or a
+// 5xx during an outage. Message is the reason given in the body, if any. A 404
+// means the city asked for doesn't exist, so it matches ErrCityNotFound.
+type UpstreamError struct {
+    Status int
+    Message string
+}
+
+func (e *UpstreamError) Error() string {
+    if e.Message == "" {
+        return fmt.Sprintf("upstream returned %d %s", e.Status, http.StatusText(e.Status))
+    }
+    return fmt.Sprintf("upstream returned %d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+}
+
+func (e *UpstreamError) Is(target error) bool {
+    return target == ErrCityNotFound && e.Status == http.StatusNotFound
+}
+
+// Builds the error for an upstream response with a status other than 2xx,
+// taking the message from its body, like {"cod":401,"message":"Invalid API
+// key"}, when there is one.
+func newUpstreamError(status int, body []byte) *UpstreamError {
+    var reply struct {
+        Message string `json:"message"`
+    }
+    json.Unmarshal(body, &reply)
+    return &UpstreamError{status, reply.Message}
+}
+
+// Matches the API key parameter in an upstream URL.
+var appidParam = regexp.MustCompile(`([?&]appid=)[^&\s"]*`)
+
+// Masks the API key in an upstream URL, or in any text containing one, so it
+// can be logged. Upstream URLs must only be logged after passing through this.
+func redactURL(s string) string {
+    return appidParam.ReplaceAllString(s, "${1}***")
+}
+
+// Masks the API key in the URL carried by an error from the HTTP client, which
+// includes the URL it failed to fetch in its message.
+func redactError(err error) error {
+    var urlErr *url.Error
+    if errors.As(err, &urlErr) {
+        urlErr.URL = redactURL(urlErr.URL)
+    }
+    return err
+}
+
+// Returns the full URL for a path and query on the data API, such as
+// "find?q=London", using the configured API version.
+func (p *OpenWeatherMap) dataURL(path string) string {
+    return "https://api.openweathermap.org/data/" + p.options.APIVersion + "/" + path
+}
+
+// Fetches a URL from the OpenWeatherMap API and unmarshals the JSON response
+// into a list of weather data points.
+func (p *OpenWeatherMap) fetchList(ctx context.Context, apiString string) (List, error) {
+    var data List
+    err := p.fetchJSON(ctx, apiString, &data)
+    return data, err
+}
+
+// Fetches a URL from the OpenWeatherMap API and unmarshals the JSON response
+// into 'v'.
+func (p *OpenWeatherMap) fetchJSON(ctx context.Context, apiString string, v interface{}) error {
+    return p.fetchDecoded(ctx, apiString, v, json.Unmarshal)
+}
+
+// Fetches a URL from the OpenWeatherMap API and decodes the response into 'v'
+// with 'unmarshal'. Responses that fail to decode are retried up to
+// maxFetchAttempts times.
+func (p *OpenWeatherMap) fetchDecoded(ctx context.Context, apiString string, v interface{}, unmarshal func([]byte, interface{}) error) error {
+    var err error
+    for attempt := 1; attempt <= maxFetchAttempts; attempt = attempt + 1 {
+        err = p.fetchOnce(ctx, apiString, v, unmarshal)
+        var decodeErr *DecodeError
+        if !errors.As(err, &decodeErr) {
+            break
+        }
+        log.Printf("Upstream returned an undecodable response (attempt %d of %d): %v", attempt, maxFetchAttempts, err)
+    }
+    return err
+}
+
+// Reports a request's outcome to the Observe option, if there is one.
+func (p *OpenWeatherMap) observe(endpoint string, err error, elapsed time.Duration) {
+    if p.options.Observe != nil {
+        p.options.Observe(endpoint, err, elapsed)
+    }
+}
+
+// Makes a single request to the OpenWeatherMap API, unless the endpoint's rate
+// limit has been reached or the circuit breaker is open, and records whether
+// it succeeded and how long it took.
+func (p *OpenWeatherMap) fetchOnce(ctx context.Context, apiString string, v interface{}, unmarshal func([]byte, interface{}) error) error {
+    var endpoint string = upstreamEndpoint(apiString)
+    if limit := p.limits[endpoint]; limit != nil && !limit.allow(p.options.Now()) {
+        p.observe(endpoint, ErrRateLimited, 0)
+        return ErrRateLimited
+    }
+    err := p.health.allow(p.options.Now())
+    if err != nil {
+        p.observe(endpoint, err, 0)
+        return err
+    }
+    var start time.Time = time.Now()
+    err = p.get(ctx, apiString, v, unmarshal)
+    p.observe(endpoint, err, time.Since(start))
+    if ctx.Err() != nil {
+        // Running out of our own time says nothing about the upstream's health
+        return err
+    } else if errors.Is(err, ErrCityNotFound) {
+        // Nor does asking for a city that doesn't exist
+        p.health.record(nil, p.options.Now())
+        return err
+    }
+    p.health.record(err, p.options.Now())
+    return err
+}
+
+// Requests a URL with the API key and decodes the response into 'v' with
+// 'unmarshal'. Returns an UpstreamError if the response isn't a success.
+func (p *OpenWeatherMap) get(ctx context.Context, apiString string, v interface{}, unmarshal func([]byte, interface{}) error) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiString, nil)
+    if err != nil {
+        return fmt.Errorf("querying failed: %v", redactError(err))
+    }
+
+    // The key is only added here, so the URLs passed around don't carry it
+    if p.options.APIKey != "" {
+        var query url.Values = req.URL.Query()
+        query.Set("appid", p.options.APIKey)
+        req.URL.RawQuery = query.Encode()
+    }
+    resp, err := p.http.Do(req)
+    if err != nil {
+        return fmt.Errorf("querying failed: %w", redactError(err))
+    }
+    defer resp.Body.Close()
+
+    // The transport only decompresses responses to its own Accept-Encoding
+    // header, so a gzipped body sent unasked (by a proxy, say) is left to us
+    var body io.Reader = resp.Body
+    if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") && !resp.Uncompressed {
+        gz, err := gzip.NewReader(resp.Body)
+        if err != nil {
+            return &DecodeError{err}
+        }
+        defer gz.Close()
+        body = gz
+    }
+
+    // Read the body, refusing anything too large to be a real response
+    var buf []byte
+    buf, err = ioutil.ReadAll(io.LimitReader(body, MaxResponseBytes + 1))
+    if err != nil {
+        return &DecodeError{err}
+    } else if len(buf) > MaxResponseBytes {
+        return &DecodeError{fmt.Errorf("response is larger than %d bytes", MaxResponseBytes)}
+    }
+
+    // Error bodies would otherwise decode as an empty result, so a bad key or
+    // an outage would look like a city that doesn't exist
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return newUpstreamError(resp.StatusCode, buf)
+    }
+
+    // Unmarshal
+    err = unmarshal(buf, v)
+    if err != nil {
+        return &DecodeError{err}
+    }
+    return nil
+}
+
+// Searches for current weather data for cities matching the given name, with
+// descriptions in the given language.
+func (p *OpenWeatherMap) Current(ctx context.Context, city string, lang string) (List, error) {
+    if p.options.GeocodeFirst {
+        return p.currentGeocoded(ctx, city, lang)
+    }
+    return p.fetchCurrentList(ctx, p.dataURL("find?q=" + url.QueryEscape(city) + "&units=metric&lang=" + lang))
+}
+
+// Fetches the current weather for a city by its OpenWeatherMap ID, as chosen
+// from a list of candidates. The result is wrapped in a list so it can be
+// handled like a search result; an unknown ID yields an empty list.
+func (p *OpenWeatherMap) CurrentByID(ctx context.Context, cityID int32, lang string) (List, error) {
+    datum, err := p.fetchCurrent(ctx, p.dataURL(fmt.Sprintf("weather?id=%d&units=metric&lang=%s", cityID, lang)))
+    if err != nil || datum.CityId == 0 {
+        return List{}, err
+    }
+    return List{[]Observation{datum}}, nil
+}
+
+// Fetches the current weather at the given coordinates. The result is wrapped
+// in a list so it can be handled like a search result.
+func (p *OpenWeatherMap) CurrentAt(ctx context.Context, lat, lon float64, lang string) (List, error) {
+    var apiString = p.dataURL(fmt.Sprintf("weather?lat=%f&lon=%f&units=metric&lang=%s", lat, lon, lang))
+    datum, err := p.fetchCurrent(ctx, apiString)
+    if err != nil {
+        return List{}, err
+    }
+    return List{[]Observation{datum}}, nil
+}
+
+// Finds the city closest to a location that the name search doesn't know,
+// such as a small town, by geocoding the location and searching around its
+// coordinates. An unknown location yields an empty list.
+func (p *OpenWeatherMap) Nearby(ctx context.Context, query string, lang string) (List, error) {
+    locations, err := p.geocode(ctx, query, 1)
+    if err != nil {
+        return List{}, err
+    } else if len(locations) == 0 {
+        return List{}, nil
+    }
+    var apiString = p.dataURL(fmt.Sprintf("find?lat=%f&lon=%f&cnt=1&units=metric&lang=%s", locations[0].Lat, locations[0].Lon, lang))
+    return p.fetchCurrentList(ctx, apiString)
+}
+
+// Searches for a city by geocoding it first, then fetching the weather at the
+// best match's coordinates. This copes better with ambiguous or misspelled
+// names than the 'find' search. An unknown location yields an empty list.
+func (p *OpenWeatherMap) currentGeocoded(ctx context.Context, city string, lang string) (List, error) {
+    locations, err := p.geocode(ctx, city, 1)
+    if err != nil {
+        return List{}, err
+    } else if len(locations) == 0 {
+        return List{}, nil
+    }
+    return p.CurrentAt(ctx, locations[0].Lat, locations[0].Lon, lang)
+}
+
+// Resolves a free-text location to at most 'limit' candidate locations, best
+// match first.
+func (p *OpenWeatherMap) geocode(ctx context.Context, query string, limit int) ([]Location, error) {
+    var locations []Location
+    var apiString = fmt.Sprintf("https://api.openweathermap.org/geo/1.0/direct?q=%s&limit=%d", url.QueryEscape(query), limit)
+    err := p.fetchJSON(ctx, apiString, &locations)
+    return locations, err
+}
+
+// Fetches up to 'count' historical data points for the given city, one an
+// hour or one a day depending on 'granularity', starting at 'start'.
+// Temperatures are in Kelvin.
+func (p *OpenWeatherMap) Historical(ctx context.Context, cityID int32, start time.Time, granularity string, count int) (List, error) {
+    var apiString = p.dataURL(fmt.Sprintf("history/city?id=%d&start=%d&type=%s&cnt=%d", cityID, start.Unix(), granularity, count))
+    return p.fetchList(ctx, apiString)
+}
+
+// Fetches the 5-day forecast for a city, in metric units.
+func (p *OpenWeatherMap) Forecast(ctx context.Context, city string) (Forecast, error) {
+    var data Forecast
+    err := p.fetchJSON(ctx, p.dataURL("forecast?q=" + url.QueryEscape(city) + "&units=metric"), &data)
+    return data, err
+}
+
+// Fetches the 5-day forecast for a city by its ID, in metric units.
+func (p *OpenWeatherMap) ForecastByID(ctx context.Context, cityID int32) (Forecast, error) {
+    var data Forecast
+    err := p.fetchJSON(ctx, p.dataURL(fmt.Sprintf("forecast?id=%d&units=metric", cityID)), &data)
+    return data, err
+}
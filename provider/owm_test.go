@@ -0,0 +1,361 @@
+package provider
+
+import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "errors"
+    "io"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// An http.RoundTripper that answers every request with a function, counting
+// the requests made.
+type stubTransport struct {
+    calls atomic.Int64
+    respond func(req *http.Request) (*http.Response, error)
+}
+
+func (t *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    t.calls.Add(1)
+    return t.respond(req)
+}
+
+// Builds a response with a status and body.
+func stubResponse(req *http.Request, status int, body string) *http.Response {
+    return &http.Response{
+        Status: http.StatusText(status),
+        StatusCode: status,
+        Header: http.Header{"Content-Type": {"application/json"}},
+        Body: ioutil.NopCloser(bytes.NewBufferString(body)),
+        Request: req,
+    }
+}
+
+// Returns a provider whose requests are all answered by 'respond'.
+func newStubProvider(options Options, respond func(req *http.Request) (*http.Response, error)) (*OpenWeatherMap, *stubTransport) {
+    var transport *stubTransport = &stubTransport{respond: respond}
+    options.APIKey = "key"
+    return NewOpenWeatherMap(&http.Client{Transport: transport}, options), transport
+}
+
+const stubLondon = `{"list":[{"name":"London","id":2643743,"dt":1700000000,"main":{"temp":7.14}}]}`
+
+func TestUpstreamErrorStatus(t *testing.T) {
+    for _, status := range []int{http.StatusUnauthorized, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusNotFound} {
+        p, _ := newStubProvider(Options{}, func(req *http.Request) (*http.Response, error) {
+            return stubResponse(req, status, `{"cod":"0","message":"no"}`), nil
+        })
+        _, err := p.Current(context.Background(), "London", "en")
+        var upstreamErr *UpstreamError
+        if !errors.As(err, &upstreamErr) || upstreamErr.Status != status {
+            t.Errorf("status %d: got error %v, want an UpstreamError", status, err)
+        } else if errors.Is(err, ErrCityNotFound) != (status == http.StatusNotFound) {
+            t.Errorf("status %d: errors.Is(ErrCityNotFound) = %v", status, !(status == http.StatusNotFound))
+        }
+    }
+}
+
+func TestUpstreamErrorMessage(t *testing.T) {
+    var err error = newUpstreamError(http.StatusUnauthorized, []byte(`{"cod":401,"message":"Invalid API key"}`))
+    if got, want := err.Error(), "upstream returned 401 Unauthorized: Invalid API key"; got != want {
+        t.Errorf("Error() = %q, want %q", got, want)
+    }
+}
+
+func TestUpstreamErrorsTripBreaker(t *testing.T) {
+    p, transport := newStubProvider(Options{}, func(req *http.Request) (*http.Response, error) {
+        return stubResponse(req, http.StatusServiceUnavailable, `{"cod":503}`), nil
+    })
+    for i := 0; i < breakerThreshold; i = i + 1 {
+        p.Current(context.Background(), "London", "en")
+    }
+    _, err := p.Current(context.Background(), "London", "en")
+    if !errors.Is(err, ErrCircuitOpen) {
+        t.Errorf("after %d failures got %v, want ErrCircuitOpen", breakerThreshold, err)
+    } else if got := transport.calls.Load(); got != breakerThreshold {
+        t.Errorf("made %d requests, want %d", got, breakerThreshold)
+    }
+}
+
+func TestMissingCityDoesNotTripBreaker(t *testing.T) {
+    p, _ := newStubProvider(Options{}, func(req *http.Request) (*http.Response, error) {
+        return stubResponse(req, http.StatusNotFound, `{"cod":"404","message":"city not found"}`), nil
+    })
+    for i := 0; i < breakerThreshold + 1; i = i + 1 {
+        _, err := p.Current(context.Background(), "Nowhere", "en")
+        if !errors.Is(err, ErrCityNotFound) {
+            t.Fatalf("lookup %d: got %v, want ErrCityNotFound", i + 1, err)
+        }
+    }
+}
+
+func TestTruncatedResponseIsRetried(t *testing.T) {
+    p, transport := newStubProvider(Options{}, func(req *http.Request) (*http.Response, error) {
+        return stubResponse(req, http.StatusOK, stubLondon[:40]), nil
+    })
+    _, err := p.Current(context.Background(), "London", "en")
+    var decodeErr *DecodeError
+    if !errors.As(err, &decodeErr) {
+        t.Fatalf("got %v, want a DecodeError", err)
+    }
+    if got := transport.calls.Load(); got != maxFetchAttempts {
+        t.Errorf("made %d requests, want %d", got, maxFetchAttempts)
+    }
+}
+
+func TestTruncatedResponseRecoversOnRetry(t *testing.T) {
+    var attempts atomic.Int64
+    p, _ := newStubProvider(Options{}, func(req *http.Request) (*http.Response, error) {
+        if attempts.Add(1) == 1 {
+            return stubResponse(req, http.StatusOK, stubLondon[:40]), nil
+        }
+        return stubResponse(req, http.StatusOK, stubLondon), nil
+    })
+    data, err := p.Current(context.Background(), "London", "en")
+    if err != nil || len(data.List) != 1 || data.List[0].Name != "London" {
+        t.Errorf("got %+v, %v, want London after a retry", data, err)
+    }
+}
+
+func TestGzipResponse(t *testing.T) {
+    var buf bytes.Buffer
+    var gz *gzip.Writer = gzip.NewWriter(&buf)
+    gz.Write([]byte(stubLondon))
+    gz.Close()
+    p, _ := newStubProvider(Options{}, func(req *http.Request) (*http.Response, error) {
+        var resp *http.Response = stubResponse(req, http.StatusOK, buf.String())
+        resp.Header.Set("Content-Encoding", "gzip")
+        return resp, nil
+    })
+    data, err := p.Current(context.Background(), "London", "en")
+    if err != nil || len(data.List) != 1 || data.List[0].Main.Temperature != 7.14 {
+        t.Errorf("got %+v, %v, want the decompressed reading", data, err)
+    }
+}
+
+func TestRedactURL(t *testing.T) {
+    var tests = []struct {
+        in string
+        want string
+    }{
+        {"https://api.openweathermap.org/data/2.5/find?q=London&appid=secret", "https://api.openweathermap.org/data/2.5/find?q=London&appid=***"},
+        {"https://api.openweathermap.org/data/2.5/find?appid=secret&q=London", "https://api.openweathermap.org/data/2.5/find?appid=***&q=London"},
+        {`Get "https://x/find?appid=secret": EOF`, `Get "https://x/find?appid=***": EOF`},
+        {"https://api.openweathermap.org/data/2.5/find?q=London", "https://api.openweathermap.org/data/2.5/find?q=London"},
+    }
+    for _, test := range tests {
+        if got := redactURL(test.in); got != test.want {
+            t.Errorf("redactURL(%q) = %q, want %q", test.in, got, test.want)
+        }
+    }
+
+    p, _ := newStubProvider(Options{}, func(req *http.Request) (*http.Response, error) {
+        return nil, errors.New("connection refused")
+    })
+    _, err := p.Current(context.Background(), "London", "en")
+    if err == nil || strings.Contains(err.Error(), "appid=key") || !strings.Contains(err.Error(), "appid=***") {
+        t.Errorf("got %v, want an error with the API key masked", err)
+    }
+}
+
+func TestListShapes(t *testing.T) {
+    var tests = []struct {
+        body string
+        want int
+    }{
+        {stubLondon, 1},
+        {`{"name":"London","id":2643743,"main":{"temp":7.14}}`, 1},
+        {`{"list":[]}`, 0},
+    }
+    for _, test := range tests {
+        var data List
+        err := data.UnmarshalJSON([]byte(test.body))
+        if err != nil || len(data.List) != test.want {
+            t.Errorf("%s: got %d items, %v, want %d", test.body, len(data.List), err, test.want)
+        } else if test.want == 1 && data.List[0].Name != "London" {
+            t.Errorf("%s: got %q, want London", test.body, data.List[0].Name)
+        }
+    }
+}
+
+func TestHistoryURL(t *testing.T) {
+    var query url.Values
+    p, _ := newStubProvider(Options{}, func(req *http.Request) (*http.Response, error) {
+        query = req.URL.Query()
+        return stubResponse(req, http.StatusOK, `{"list":[{"dt":1,"main":{"temp":280}},{"dt":2,"main":{"temp":281}},{"dt":3,"main":{"temp":282}}]}`), nil
+    })
+    data, err := p.Historical(context.Background(), 2643743, time.Unix(1700000000, 0), Daily, 3)
+    if err != nil || len(data.List) != 3 {
+        t.Fatalf("got %d samples, %v, want 3", len(data.List), err)
+    }
+    if query.Get("type") != "day" || query.Get("cnt") != "3" || query.Get("id") != "2643743" || query.Get("start") != "1700000000" {
+        t.Errorf("history query = %v, want type=day, cnt=3, the start and the city ID", query)
+    }
+}
+
+func TestCityIsEscaped(t *testing.T) {
+    var rawQuery string
+    p, _ := newStubProvider(Options{}, func(req *http.Request) (*http.Response, error) {
+        rawQuery = req.URL.RawQuery
+        return stubResponse(req, http.StatusOK, stubLondon), nil
+    })
+    p.Current(context.Background(), "San Francisco,US", "en")
+    if !strings.Contains(rawQuery, "q=San+Francisco%2CUS") {
+        t.Errorf("query %q doesn't escape the city", rawQuery)
+    }
+    if q, _ := url.ParseQuery(rawQuery); q.Get("q") != "San Francisco,US" || q.Get("appid") != "key" {
+        t.Errorf("query %q doesn't decode to the city and key", rawQuery)
+    }
+}
+
+// Lookups abandoned because the caller gave up don't count against the
+// upstream's health.
+func TestCancelledLookupsDoNotTripBreaker(t *testing.T) {
+    p, _ := newStubProvider(Options{}, func(req *http.Request) (*http.Response, error) {
+        return nil, req.Context().Err()
+    })
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    for i := 0; i < breakerThreshold + 1; i = i + 1 {
+        _, err := p.Current(ctx, "London", "en")
+        if !errors.Is(err, context.Canceled) {
+            t.Fatalf("lookup %d: got %v, want context.Canceled", i + 1, err)
+        }
+    }
+}
+
+// Every request is reported to Observe with the endpoint it went to.
+func TestObserve(t *testing.T) {
+    var endpoints []string
+    p, _ := newStubProvider(Options{Observe: func(endpoint string, err error, elapsed time.Duration) {
+        endpoints = append(endpoints, endpoint)
+    }}, func(req *http.Request) (*http.Response, error) {
+        return stubResponse(req, http.StatusOK, stubLondon), nil
+    })
+    p.Current(context.Background(), "London", "en")
+    p.Historical(context.Background(), 2643743, time.Unix(1700000000, 0), Hourly, 1)
+    if len(endpoints) != 2 || endpoints[0] != "find" || endpoints[1] != "history" {
+        t.Errorf("observed %v, want [find history]", endpoints)
+    }
+}
+
+// With GeocodeFirst, a name is resolved to coordinates by the geocoding API and
+// the weather fetched at them, instead of searching by name.
+func TestGeocodeFirst(t *testing.T) {
+    var paths []string
+    var query url.Values
+    p, _ := newStubProvider(Options{APIVersion: "2.5", GeocodeFirst: true}, func(req *http.Request) (*http.Response, error) {
+        paths = append(paths, req.URL.Path)
+        switch req.URL.Path {
+            case "/geo/1.0/direct":
+                if req.URL.Query().Get("q") != "londn" {
+                    return stubResponse(req, http.StatusOK, `[]`), nil
+                }
+                return stubResponse(req, http.StatusOK, `[{"name":"London","lat":51.5073,"lon":-0.1276,"country":"GB"}]`), nil
+            case "/data/2.5/weather":
+                query = req.URL.Query()
+                return stubResponse(req, http.StatusOK, `{"name":"London","id":2643743,"dt":1700000000,"main":{"temp":7.14}}`), nil
+        }
+        return stubResponse(req, http.StatusNotFound, `{"cod":"404","message":"not found"}`), nil
+    })
+
+    data, err := p.Current(context.Background(), "londn", "en")
+    if err != nil || len(data.List) != 1 || data.List[0].Name != "London" {
+        t.Fatalf("got %+v, %v, want London", data, err)
+    }
+    if strings.Join(paths, " ") != "/geo/1.0/direct /data/2.5/weather" {
+        t.Errorf("requested %v, want the geocoder then the weather", paths)
+    }
+    if query.Get("lat") != "51.507300" || query.Get("lon") != "-0.127600" || query.Has("q") {
+        t.Errorf("weather query = %v, want the geocoded coordinates", query)
+    }
+
+    paths = nil
+    if data, err = p.Current(context.Background(), "Nowhere", "en"); err != nil || len(data.List) != 0 {
+        t.Errorf("unknown place: got %+v, %v, want an empty list", data, err)
+    } else if len(paths) != 1 {
+        t.Errorf("unknown place: requested %v, want only the geocoder", paths)
+    }
+}
+
+// Every data API request uses the configured version, 2.5 by default.
+func TestAPIVersion(t *testing.T) {
+    var tests = []struct {
+        version string
+        want string
+    }{
+        {"", "/data/2.5/"},
+        {"2.5", "/data/2.5/"},
+        {"3.0", "/data/3.0/"},
+    }
+    for _, test := range tests {
+        var paths []string
+        p, _ := newStubProvider(Options{APIVersion: test.version}, func(req *http.Request) (*http.Response, error) {
+            paths = append(paths, req.URL.Path)
+            return stubResponse(req, http.StatusOK, stubLondon), nil
+        })
+        p.Current(context.Background(), "London", "en")
+        p.CurrentByID(context.Background(), 2643743, "en")
+        p.Historical(context.Background(), 2643743, time.Unix(1700000000, 0), Hourly, 1)
+        p.Forecast(context.Background(), "London")
+        for _, path := range paths {
+            if !strings.HasPrefix(path, test.want) {
+                t.Errorf("version %q: requested %s, want it under %s", test.version, path, test.want)
+            }
+        }
+        if len(paths) != 4 {
+            t.Errorf("version %q: made %d requests, want 4", test.version, len(paths))
+        }
+    }
+}
+
+// Responses streamed in chunks, without a Content-Length, are read whole, and
+// the size cap still applies to them.
+func TestChunkedResponse(t *testing.T) {
+    var size atomic.Int64
+    var server *httptest.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var body string = stubLondon
+        if n := size.Load(); n > 0 {
+            body = `{"list":[` + strings.Repeat(" ", int(n)) + `]}`
+        }
+        for len(body) > 0 {
+            var n int = min(len(body), 16 << 10)
+            io.WriteString(w, body[:n])
+            w.(http.Flusher).Flush()
+            body = body[n:]
+        }
+    }))
+    defer server.Close()
+
+    var chunked bool
+    p, _ := newStubProvider(Options{}, func(req *http.Request) (*http.Response, error) {
+        req.URL.Scheme, req.URL.Host = "http", server.Listener.Addr().String()
+        resp, err := http.DefaultTransport.RoundTrip(req)
+        if err == nil {
+            chunked = resp.ContentLength == -1 && len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+        }
+        return resp, err
+    })
+
+    data, err := p.Current(context.Background(), "London", "en")
+    if err != nil || len(data.List) != 1 || data.List[0].Name != "London" {
+        t.Fatalf("got %+v, %v, want London", data, err)
+    } else if !chunked {
+        t.Fatal("the response wasn't chunked")
+    }
+
+    size.Store(MaxResponseBytes)
+    _, err = p.Current(context.Background(), "London", "en")
+    var decodeErr *DecodeError
+    if !errors.As(err, &decodeErr) || !strings.Contains(err.Error(), "larger than") {
+        t.Errorf("oversized chunked response: got %v, want a DecodeError for its size", err)
+    }
+}
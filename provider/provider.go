@@ -0,0 +1,206 @@
+/*
+Package provider fetches weather data from an upstream service. The server only
+talks to the upstream through the WeatherProvider interface, so that tests and
+other backends can stand in for OpenWeatherMap without touching the handlers.
+*/
+package provider
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "time"
+)
+
+// Returned when no city matches a lookup.
+var ErrCityNotFound = errors.New("city not found")
+
+// The granularity of historical data: one sample an hour or one a day.
+const (
+    Hourly = "hour"
+    Daily = "day"
+)
+
+/*
+A source of weather data. Readings are in metric units, except historical
+temperatures, which are in Kelvin, and descriptions are in the language asked
+for where the upstream has it. Every lookup is abandoned once 'ctx' is done:
+  - Current: Searches for the current weather in cities matching a name
+  - CurrentByID: Fetches the current weather for a city by its ID; an unknown
+    ID yields an empty list
+  - CurrentAt: Fetches the current weather at a latitude and longitude
+  - Nearby: Finds the city nearest a place that the name search doesn't
+    know, such as a small town; an unknown place yields an empty list
+  - Historical: Fetches up to 'count' samples of a city's weather, Hourly or
+    Daily as 'granularity' says, starting at 'start'
+  - Forecast, ForecastByID: Fetch the 5-day forecast for a city, by name or
+    by ID
+*/
+type WeatherProvider interface {
+    Current(ctx context.Context, city string, lang string) (List, error)
+    CurrentByID(ctx context.Context, cityID int32, lang string) (List, error)
+    CurrentAt(ctx context.Context, lat, lon float64, lang string) (List, error)
+    Nearby(ctx context.Context, query string, lang string) (List, error)
+    Historical(ctx context.Context, cityID int32, start time.Time, granularity string, count int) (List, error)
+    Forecast(ctx context.Context, city string) (Forecast, error)
+    ForecastByID(ctx context.Context, cityID int32) (Forecast, error)
+}
+
+/*
+Describes individual weather descriptions:
+  - Id: The ID number of the weather condition
+  - Type: A string containing the official weather type
+  - Description: A longer description of the weather type
+  - Icon: The name of an icon available via the API
+*/
+type WeatherDesc struct {
+    Id int `json:"id" xml:"id"`
+    Type string `json:"main" xml:"main"`
+    Description string `json:"description" xml:"description"`
+    Icon string `json:"icon" xml:"icon"`
+}
+
+/*
+The cloud cover:
+  - All: The percentage of the sky covered by cloud, from 0% to 100%
+*/
+type CloudCover struct {
+    All float64 `json:"all" xml:"all"`
+}
+
+/*
+A volume of precipitation, in millimeters, or inches for imperial. Current
+readings give the volume over the last hour and forecasts give it over three
+hours, so only one window is usually present:
+  - OneHour: The volume over the last hour
+  - ThreeHours: The volume over the last (or next) three hours
+*/
+type Precipitation struct {
+    OneHour *float64 `json:"1h,omitempty" xml:"one_hour,omitempty"`
+    ThreeHours *float64 `json:"3h,omitempty" xml:"three_hours,omitempty"`
+}
+
+/*
+The weather at a place for a given time, as the upstream reports it.
+  - Name: The name of the city
+  - CityID: A unique ID number for the city
+  - Time: The time, expressed as seconds since the epoch
+  - Coord: The city's latitude and longitude
+  - Timezone: The city's offset from UTC, in seconds
+  - Weather: A list of individual WeatherDesc structures detailing the
+    individual weather conditions
+  - Sys: An embedded document containing:
+    + Country: Either the full country name or a two-letter country code
+    + Sunrise: The time of sunrise, expressed as Unix time
+    + Sunset: The time of sunset, expressed as Unix time
+  - Visibility: How far one can see, in meters or, for imperial, miles, if
+    it was reported
+  - Wind: an embedded document containing:
+    + Speed: The wind speed in meters per second, or miles per hour for
+      imperial
+  - Clouds: The cloud cover, if it was reported
+  - Rain, Snow: The precipitation volume, if there was any
+  - Main: an embedded document containing:
+    + Temperature: The temperature in either Celsius or Kelvin
+    + FeelsLike: The apparent temperature, in the same units as Temperature
+    + TempMin, TempMax: The range of temperatures across the area or, for
+      forecasts, across the period
+    + Humidity: The humidity, as a percentage from 0% to 100%
+    + Pressure: The pressure in hPa, or inHg for imperial.
+*/
+type Observation struct {
+    Name string `json:"name" xml:"name"`
+    CityId int32 `json:"id" xml:"id"`
+    Time int64 `json:"dt" xml:"dt"`
+    Coord struct {
+        Lat float64 `json:"lat" xml:"lat"`
+        Lon float64 `json:"lon" xml:"lon"`
+    } `json:"coord" xml:"coord"`
+    Timezone int `json:"timezone" xml:"timezone"`
+    Weather []WeatherDesc `json:"weather" xml:"weather"`
+    Sys struct {
+        Country string `json:"country" xml:"country"`
+        Sunrise int64 `json:"sunrise" xml:"sunrise"`
+        Sunset int64 `json:"sunset" xml:"sunset"`
+    } `json:"sys" xml:"sys"`
+    Visibility *float64 `json:"visibility,omitempty" xml:"visibility,omitempty"`
+    Wind struct {
+        Speed float64 `json:"speed" xml:"speed"`
+    } `json:"wind" xml:"wind"`
+    Clouds *CloudCover `json:"clouds,omitempty" xml:"clouds,omitempty"`
+    Rain *Precipitation `json:"rain,omitempty" xml:"rain,omitempty"`
+    Snow *Precipitation `json:"snow,omitempty" xml:"snow,omitempty"`
+    Main struct {
+        Temperature float64 `json:"temp" xml:"temp"`
+        FeelsLike float64 `json:"feels_like" xml:"feels_like"`
+        TempMin float64 `json:"temp_min" xml:"temp_min"`
+        TempMax float64 `json:"temp_max" xml:"temp_max"`
+        Humidity float64 `json:"humidity" xml:"humidity"`
+        Pressure float64 `json:"pressure" xml:"pressure"`
+    } `json:"main" xml:"main"`
+}
+
+/*
+A list of weather data points.
+*/
+type List struct {
+    List []Observation `json:"list"`
+}
+
+// Decodes a search or history response, which wraps its data points in
+// {"list": [...]}. An endpoint that answers with a single data point at the
+// top level, as 'weather' does, decodes to a list of one rather than silently
+// to an empty list. Anything else, such as an error body, is an empty list.
+func (l *List) UnmarshalJSON(buf []byte) error {
+    var shape struct {
+        List *[]Observation `json:"list"`
+        Main json.RawMessage `json:"main"`
+    }
+    err := json.Unmarshal(buf, &shape)
+    if err != nil {
+        return err
+    }
+
+    l.List = nil
+    if shape.List != nil {
+        l.List = *shape.List
+    } else if shape.Main != nil {
+        var datum Observation
+        err = json.Unmarshal(buf, &datum)
+        if err != nil {
+            return err
+        }
+        l.List = []Observation{datum}
+    }
+    return nil
+}
+
+/*
+A 5-day forecast in 3-hour steps, as returned by the forecast endpoint.
+  - City: An embedded document describing the city
+  - List: The forecast data points, in chronological order
+*/
+type Forecast struct {
+    City struct {
+        Id int32 `json:"id"`
+        Name string `json:"name"`
+        Country string `json:"country"`
+        Timezone int `json:"timezone"`
+    } `json:"city"`
+    List []Observation `json:"list"`
+}
+
+/*
+A location returned by the direct geocoding endpoint:
+  - Name: The name of the location
+  - Lat, Lon: The coordinates of the location
+  - Country: The two-letter country code
+  - State: The state or region, where available
+*/
+type Location struct {
+    Name string `json:"name"`
+    Lat float64 `json:"lat"`
+    Lon float64 `json:"lon"`
+    Country string `json:"country"`
+    State string `json:"state"`
+}
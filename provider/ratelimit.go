@@ -0,0 +1,104 @@
+package provider
+
+import (
+    "errors"
+    "fmt"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Returned instead of making a request to an upstream endpoint that has used up
+// its configured rate.
+var ErrRateLimited = errors.New("upstream request rate limit reached")
+
+// The upstream endpoints that may be rate limited separately, named by their
+// path on the data API, plus "geocode" for the geocoding API.
+var upstreamEndpoints = map[string]bool{"find": true, "weather": true, "forecast": true, "history": true, "geocode": true}
+
+// Returns the name of the upstream endpoint a URL requests, such as "find" or
+// "history", or an empty string if it isn't one we know.
+func upstreamEndpoint(apiString string) string {
+    u, err := url.Parse(apiString)
+    if err != nil {
+        return ""
+    }
+    if strings.HasPrefix(u.Path, "/geo/") {
+        return "geocode"
+    }
+
+    // Data API paths look like /data/2.5/find or /data/2.5/history/city
+    var parts []string = strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+    if len(parts) < 3 || parts[0] != "data" || !upstreamEndpoints[parts[2]] {
+        return ""
+    }
+    return parts[2]
+}
+
+// Parses a semicolon-separated list of endpoints and the most requests a
+// minute each may make, such as "history=10;find=60", for Options.RateLimits.
+func ParseRateLimits(s string) (map[string]int, error) {
+    var limits map[string]int = make(map[string]int)
+    for _, entry := range strings.Split(s, ";") {
+        if entry = strings.TrimSpace(entry); entry == "" {
+            continue
+        }
+        endpoint, rate, ok := strings.Cut(entry, "=")
+        endpoint = strings.TrimSpace(endpoint)
+        if !ok || !upstreamEndpoints[endpoint] {
+            return nil, fmt.Errorf("unknown endpoint in %q: must be find, weather, forecast, history or geocode", entry)
+        }
+        n, err := strconv.Atoi(strings.TrimSpace(rate))
+        if err != nil || n < 1 {
+            return nil, fmt.Errorf("invalid rate in %q: must be a positive number of requests a minute", entry)
+        }
+        limits[endpoint] = n
+    }
+    return limits, nil
+}
+
+/*
+A token bucket allowing a number of requests a minute, in bursts of up to that
+many. Safe for concurrent use:
+  - mu: Guards tokens and updated
+  - perMinute: The number of requests allowed a minute
+  - tokens: The number of requests that may be made right now
+  - updated: When tokens was last topped up
+*/
+type tokenBucket struct {
+    mu sync.Mutex
+    perMinute int
+    tokens float64
+    updated time.Time
+}
+
+func newTokenBucket(perMinute int) *tokenBucket {
+    return &tokenBucket{perMinute: perMinute, tokens: float64(perMinute)}
+}
+
+// Takes a token for a request at 'now', returning false if there are none.
+func (b *tokenBucket) allow(now time.Time) bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if !b.updated.IsZero() {
+        var refill float64 = now.Sub(b.updated).Minutes() * float64(b.perMinute)
+        b.tokens = min(float64(b.perMinute), b.tokens + refill)
+    }
+    b.updated = now
+    if b.tokens < 1 {
+        return false
+    }
+    b.tokens = b.tokens - 1
+    return true
+}
+
+// Creates a token bucket for each rate limited endpoint.
+func newEndpointLimits(rates map[string]int) map[string]*tokenBucket {
+    var limits map[string]*tokenBucket = make(map[string]*tokenBucket, len(rates))
+    for endpoint, rate := range rates {
+        limits[endpoint] = newTokenBucket(rate)
+    }
+    return limits
+}
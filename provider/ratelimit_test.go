@@ -0,0 +1,73 @@
+package provider
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+    limits, err := ParseRateLimits(" history=10; find=60 ;")
+    if err != nil || len(limits) != 2 || limits["history"] != 10 || limits["find"] != 60 {
+        t.Errorf("got %v, %v", limits, err)
+    }
+    for _, bad := range []string{"onecall=5", "history", "history=0", "history=x"} {
+        if _, err := ParseRateLimits(bad); err == nil {
+            t.Errorf("ParseRateLimits(%q) succeeded, want an error", bad)
+        }
+    }
+}
+
+func TestTokenBucket(t *testing.T) {
+    var b *tokenBucket = newTokenBucket(2)
+    var start time.Time = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    if !b.allow(start) || !b.allow(start) {
+        t.Fatal("a full bucket refused a request")
+    }
+    if b.allow(start) {
+        t.Error("an empty bucket allowed a request")
+    }
+    // Half a minute refills one of the two tokens a minute
+    if !b.allow(start.Add(30 * time.Second)) {
+        t.Error("bucket didn't refill")
+    }
+    if b.allow(start.Add(30 * time.Second)) {
+        t.Error("bucket refilled too much")
+    }
+}
+
+func TestEndpointLimitsAreIndependent(t *testing.T) {
+    var options Options = Options{
+        RateLimits: map[string]int{"history": 1, "find": 3},
+        Now: func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) },
+    }
+    p, transport := newStubProvider(options, func(req *http.Request) (*http.Response, error) {
+        return stubResponse(req, http.StatusOK, stubLondon), nil
+    })
+    var ctx context.Context = context.Background()
+
+    // History is limited to one request, which doesn't use up find's limit
+    if _, err := p.Historical(ctx, 1, time.Unix(0, 0), Hourly, 1); err != nil {
+        t.Fatalf("first history request: %v", err)
+    }
+    if _, err := p.Historical(ctx, 1, time.Unix(0, 0), Hourly, 1); !errors.Is(err, ErrRateLimited) {
+        t.Errorf("second history request: got %v, want ErrRateLimited", err)
+    }
+    for i := 0; i < 3; i = i + 1 {
+        if _, err := p.Current(ctx, "London", "en"); err != nil {
+            t.Errorf("find %d: %v", i + 1, err)
+        }
+    }
+    if _, err := p.Current(ctx, "London", "en"); !errors.Is(err, ErrRateLimited) {
+        t.Errorf("fourth find: got %v, want ErrRateLimited", err)
+    }
+    // Forecasts aren't limited at all
+    for i := 0; i < 5; i = i + 1 {
+        p.ForecastByID(ctx, 1)
+    }
+    if got := transport.calls.Load(); got != 1 + 3 + 5 {
+        t.Errorf("made %d requests, want %d", got, 1 + 3 + 5)
+    }
+}
@@ -0,0 +1,148 @@
+package provider
+
+import (
+    "context"
+    "encoding/xml"
+    "time"
+)
+
+// The layout of timestamps in upstream XML, which are in UTC.
+const upstreamXMLTime = "2006-01-02T15:04:05"
+
+/*
+The current weather for a city as returned by the upstream API with
+'mode=xml'. Values are attributes rather than elements, and there is a single
+weather condition rather than a list.
+*/
+type xmlCurrent struct {
+    City struct {
+        Id int32 `xml:"id,attr"`
+        Name string `xml:"name,attr"`
+        Coord struct {
+            Lat float64 `xml:"lat,attr"`
+            Lon float64 `xml:"lon,attr"`
+        } `xml:"coord"`
+        Country string `xml:"country"`
+        Timezone int `xml:"timezone"`
+        Sun struct {
+            Rise string `xml:"rise,attr"`
+            Set string `xml:"set,attr"`
+        } `xml:"sun"`
+    } `xml:"city"`
+    Temperature struct {
+        Value float64 `xml:"value,attr"`
+        Min float64 `xml:"min,attr"`
+        Max float64 `xml:"max,attr"`
+    } `xml:"temperature"`
+    FeelsLike xmlValue `xml:"feels_like"`
+    Humidity xmlValue `xml:"humidity"`
+    Pressure xmlValue `xml:"pressure"`
+    Visibility *xmlValue `xml:"visibility"`
+    Clouds *xmlValue `xml:"clouds"`
+    Wind struct {
+        Speed xmlValue `xml:"speed"`
+    } `xml:"wind"`
+    Precipitation struct {
+        Value float64 `xml:"value,attr"`
+        Mode string `xml:"mode,attr"`
+    } `xml:"precipitation"`
+    Weather struct {
+        Number int `xml:"number,attr"`
+        Value string `xml:"value,attr"`
+        Icon string `xml:"icon,attr"`
+    } `xml:"weather"`
+    LastUpdate struct {
+        Value string `xml:"value,attr"`
+    } `xml:"lastupdate"`
+}
+
+// An upstream XML element holding its reading in a 'value' attribute.
+type xmlValue struct {
+    Value float64 `xml:"value,attr"`
+}
+
+// The result of an upstream search with 'mode=xml'.
+type xmlCities struct {
+    List []xmlCurrent `xml:"list>item"`
+}
+
+// Parses an upstream XML timestamp into Unix time, or 0 if it's missing.
+func parseUpstreamXMLTime(s string) int64 {
+    t, err := time.Parse(upstreamXMLTime, s)
+    if err != nil {
+        return 0
+    }
+    return t.Unix()
+}
+
+// Converts an XML reading into the same Observation the JSON API gives.
+func (x xmlCurrent) toObservation() Observation {
+    var datum Observation
+    datum.Name = x.City.Name
+    datum.CityId = x.City.Id
+    datum.Time = parseUpstreamXMLTime(x.LastUpdate.Value)
+    datum.Coord.Lat = x.City.Coord.Lat
+    datum.Coord.Lon = x.City.Coord.Lon
+    datum.Timezone = x.City.Timezone
+    datum.Sys.Country = x.City.Country
+    datum.Sys.Sunrise = parseUpstreamXMLTime(x.City.Sun.Rise)
+    datum.Sys.Sunset = parseUpstreamXMLTime(x.City.Sun.Set)
+    datum.Wind.Speed = x.Wind.Speed.Value
+    datum.Main.Temperature = x.Temperature.Value
+    datum.Main.FeelsLike = x.FeelsLike.Value
+    datum.Main.TempMin = x.Temperature.Min
+    datum.Main.TempMax = x.Temperature.Max
+    datum.Main.Humidity = x.Humidity.Value
+    datum.Main.Pressure = x.Pressure.Value
+    if x.Visibility != nil {
+        datum.Visibility = &x.Visibility.Value
+    }
+    if x.Clouds != nil {
+        datum.Clouds = &CloudCover{x.Clouds.Value}
+    }
+    if x.Weather.Number != 0 {
+        datum.Weather = []WeatherDesc{{Id: x.Weather.Number, Description: x.Weather.Value, Icon: x.Weather.Icon}}
+    }
+
+    // The XML gives one precipitation volume, over the last hour
+    if x.Precipitation.Mode == "rain" || x.Precipitation.Mode == "snow" {
+        var volume float64 = x.Precipitation.Value
+        var p *Precipitation = &Precipitation{OneHour: &volume}
+        if x.Precipitation.Mode == "rain" {
+            datum.Rain = p
+        } else {
+            datum.Snow = p
+        }
+    }
+    return datum
+}
+
+// Fetches the current weather for a single place, as JSON or, if the client
+// is in XML mode, as XML.
+func (p *OpenWeatherMap) fetchCurrent(ctx context.Context, apiString string) (Observation, error) {
+    if !p.options.XML {
+        var datum Observation
+        err := p.fetchJSON(ctx, apiString, &datum)
+        return datum, err
+    }
+
+    var current xmlCurrent
+    err := p.fetchDecoded(ctx, apiString + "&mode=xml", &current, xml.Unmarshal)
+    return current.toObservation(), err
+}
+
+// Fetches the current weather for the places matching a search, as JSON or, if
+// the client is in XML mode, as XML.
+func (p *OpenWeatherMap) fetchCurrentList(ctx context.Context, apiString string) (List, error) {
+    if !p.options.XML {
+        return p.fetchList(ctx, apiString)
+    }
+
+    var cities xmlCities
+    err := p.fetchDecoded(ctx, apiString + "&mode=xml", &cities, xml.Unmarshal)
+    var data List
+    for _, city := range cities.List {
+        data.List = append(data.List, city.toObservation())
+    }
+    return data, err
+}
@@ -0,0 +1,73 @@
+package provider
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+// The same reading as the upstream gives it in XML and in JSON.
+const xmlLondon = `<city id="2643743" name="London"><coord lon="-0.1257" lat="51.5085"></coord>` +
+    `<country>GB</country><timezone>3600</timezone><sun rise="2024-05-01T04:32:10" set="2024-05-01T19:21:40"></sun></city>` +
+    `<temperature value="14.2" min="12.1" max="16" unit="metric"></temperature><feels_like value="13.5" unit="metric"></feels_like>` +
+    `<humidity value="72" unit="%"></humidity><pressure value="1012" unit="hPa"></pressure>` +
+    `<wind><speed value="4.1" unit="m/s" name="Gentle Breeze"></speed></wind><clouds value="75" name="broken clouds"></clouds>` +
+    `<visibility value="10000"></visibility><precipitation value="0.42" mode="rain" unit="1h"></precipitation>` +
+    `<weather number="500" value="light rain" icon="10d"></weather><lastupdate value="2024-05-01T12:00:00"></lastupdate>`
+
+var jsonLondon string = fmt.Sprintf(`{"name":"London","id":2643743,"dt":%d,"coord":{"lat":51.5085,"lon":-0.1257},"timezone":3600,` +
+    `"sys":{"country":"GB","sunrise":%d,"sunset":%d},"main":{"temp":14.2,"feels_like":13.5,"temp_min":12.1,"temp_max":16,"humidity":72,"pressure":1012},` +
+    `"wind":{"speed":4.1},"clouds":{"all":75},"visibility":10000,"rain":{"1h":0.42},"weather":[{"id":500,"description":"light rain","icon":"10d"}]}`,
+    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).Unix(), time.Date(2024, 5, 1, 4, 32, 10, 0, time.UTC).Unix(), time.Date(2024, 5, 1, 19, 21, 40, 0, time.UTC).Unix())
+
+// Readings requested as XML decode to the same observations as the JSON ones,
+// by city ID and by search.
+func TestXMLMatchesJSON(t *testing.T) {
+    var modes []string
+    var respond = func(req *http.Request) (*http.Response, error) {
+        var xmlMode bool = req.URL.Query().Get("mode") == "xml"
+        modes = append(modes, req.URL.Query().Get("mode"))
+        var resp *http.Response
+        switch {
+            case strings.HasSuffix(req.URL.Path, "/weather") && xmlMode:
+                resp = stubResponse(req, http.StatusOK, `<current>` + xmlLondon + `</current>`)
+            case strings.HasSuffix(req.URL.Path, "/weather"):
+                resp = stubResponse(req, http.StatusOK, jsonLondon)
+            case xmlMode:
+                resp = stubResponse(req, http.StatusOK, `<cities><list><item>` + xmlLondon + `</item></list></cities>`)
+            default:
+                resp = stubResponse(req, http.StatusOK, `{"list":[` + jsonLondon + `]}`)
+        }
+        if xmlMode {
+            resp.Header.Set("Content-Type", "application/xml")
+        }
+        return resp, nil
+    }
+    jsonProvider, _ := newStubProvider(Options{APIVersion: "2.5"}, respond)
+    xmlProvider, _ := newStubProvider(Options{APIVersion: "2.5", XML: true}, respond)
+
+    for _, lookup := range []func(p *OpenWeatherMap) (List, error){
+        func(p *OpenWeatherMap) (List, error) { return p.CurrentByID(context.Background(), 2643743, "en") },
+        func(p *OpenWeatherMap) (List, error) { return p.Current(context.Background(), "London", "en") },
+    } {
+        modes = nil
+        fromJSON, err := lookup(jsonProvider)
+        if err != nil || len(fromJSON.List) != 1 {
+            t.Fatalf("JSON: got %+v, %v", fromJSON, err)
+        }
+        fromXML, err := lookup(xmlProvider)
+        if err != nil {
+            t.Fatalf("XML: %v", err)
+        }
+        if strings.Join(modes, ",") != ",xml" {
+            t.Errorf("requested modes %q, want JSON then XML", modes)
+        }
+        if !reflect.DeepEqual(fromXML, fromJSON) {
+            t.Errorf("XML decodes to\n%+v\nwant the JSON's\n%+v", fromXML, fromJSON)
+        }
+    }
+}
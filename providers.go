@@ -0,0 +1,261 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// The weather providers that may be listed in PROVIDERS, keyed by the name
+// they're listed under, with the name they're credited under on the pages.
+var providerNames = map[string]string{"openweathermap": "OpenWeatherMap", "open-meteo": "Open-Meteo", "weatherbit": "Weatherbit"}
+
+// Parses PROVIDERS, a comma-separated list of weather providers. OpenWeatherMap
+// is always included and comes first, as the conditions, comparisons and
+// forecasts come from it alone.
+func parseProviders(s string) ([]string, error) {
+    var providers []string = []string{"openweathermap"}
+    var seen map[string]bool = map[string]bool{"openweathermap": true}
+    for _, name := range strings.Split(s, ",") {
+        name = strings.ToLower(strings.TrimSpace(name))
+        if name == "" || seen[name] {
+            continue
+        } else if _, ok := providerNames[name]; !ok {
+            return nil, fmt.Errorf("unknown provider %q: must be openweathermap, open-meteo or weatherbit", name)
+        }
+        seen[name] = true
+        providers = append(providers, name)
+    }
+    return providers, nil
+}
+
+/*
+A provider's current readings at a place, in metric units:
+  - Temperature: The temperature in Celsius
+  - FeelsLike: The apparent temperature in Celsius
+  - Humidity: The humidity, as a percentage from 0% to 100%
+  - Pressure: The pressure at sea level in hPa
+  - WindSpeed: The wind speed in meters per second
+*/
+type Reading struct {
+    Temperature float64
+    FeelsLike float64
+    Humidity float64
+    Pressure float64
+    WindSpeed float64
+}
+
+// A weather provider whose current readings may be averaged: OpenWeatherMap,
+// Open-Meteo or Weatherbit.
+type ReadingProvider interface {
+    name() string
+    current(ctx context.Context, lat, lon float64) (Reading, error)
+}
+
+// Creates the providers listed in the configuration, in order, so
+// OpenWeatherMap, as 'weather', comes first. The others make their requests
+// with 'client', the weather provider's, so they go through the same proxy and
+// are answered with canned data in mock mode.
+func newReadingProviders(config *Config, weather provider.WeatherProvider, client *http.Client) []ReadingProvider {
+    var providers []ReadingProvider
+    for _, name := range config.Providers {
+        switch name {
+            case "openweathermap": providers = append(providers, &owmReadings{weather})
+            case "open-meteo": providers = append(providers, &openMeteo{client})
+            case "weatherbit": providers = append(providers, &weatherbit{client, config.WeatherbitAPIKey})
+        }
+    }
+    return providers
+}
+
+// Returns the current readings in a city's weather.
+func getReading(datum WeatherData) Reading {
+    return Reading{datum.Main.Temperature, datum.Main.FeelsLike, datum.Main.Humidity, datum.Main.Pressure, datum.Wind.Speed}
+}
+
+// Fetches a JSON document from a provider into 'v'.
+func getProviderJSON(ctx context.Context, client *http.Client, apiString string, v interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiString, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("returned %s", resp.Status)
+    }
+    return json.NewDecoder(io.LimitReader(resp.Body, provider.MaxResponseBytes)).Decode(v)
+}
+
+// Reads the current weather from the weather provider, which is
+// OpenWeatherMap.
+type owmReadings struct {
+    weather provider.WeatherProvider
+}
+
+func (p *owmReadings) name() string {
+    return "openweathermap"
+}
+
+func (p *owmReadings) current(ctx context.Context, lat, lon float64) (Reading, error) {
+    data, err := p.weather.CurrentAt(ctx, lat, lon, "en")
+    if err != nil {
+        return Reading{}, err
+    } else if len(data.List) == 0 {
+        return Reading{}, errors.New("no current readings")
+    }
+    return getReading(WeatherData{Observation: data.List[0]}), nil
+}
+
+// Formats a coordinate for a provider's query string.
+func formatCoordinate(f float64) string {
+    return strconv.FormatFloat(f, 'f', 4, 64)
+}
+
+// Reads the current weather from Open-Meteo, which needs no API key.
+type openMeteo struct {
+    http *http.Client
+}
+
+func (p *openMeteo) name() string {
+    return "open-meteo"
+}
+
+func (p *openMeteo) current(ctx context.Context, lat, lon float64) (Reading, error) {
+    var query url.Values = url.Values{}
+    query.Set("latitude", formatCoordinate(lat))
+    query.Set("longitude", formatCoordinate(lon))
+    query.Set("current", "temperature_2m,apparent_temperature,relative_humidity_2m,pressure_msl,wind_speed_10m")
+    query.Set("wind_speed_unit", "ms")
+
+    var data struct {
+        Current *struct {
+            Temperature *float64 `json:"temperature_2m"`
+            FeelsLike float64 `json:"apparent_temperature"`
+            Humidity float64 `json:"relative_humidity_2m"`
+            Pressure float64 `json:"pressure_msl"`
+            WindSpeed float64 `json:"wind_speed_10m"`
+        } `json:"current"`
+    }
+    err := getProviderJSON(ctx, p.http, "https://api.open-meteo.com/v1/forecast?" + query.Encode(), &data)
+    if err != nil {
+        return Reading{}, err
+    } else if data.Current == nil || data.Current.Temperature == nil {
+        return Reading{}, errors.New("no current readings")
+    }
+    return Reading{*data.Current.Temperature, data.Current.FeelsLike, data.Current.Humidity, data.Current.Pressure, data.Current.WindSpeed}, nil
+}
+
+/*
+Reads the current weather from Weatherbit:
+  - http: The client used for requests
+  - apiKey: The Weatherbit API key sent with every request
+*/
+type weatherbit struct {
+    http *http.Client
+    apiKey string
+}
+
+func (p *weatherbit) name() string {
+    return "weatherbit"
+}
+
+func (p *weatherbit) current(ctx context.Context, lat, lon float64) (Reading, error) {
+    var query url.Values = url.Values{}
+    query.Set("lat", formatCoordinate(lat))
+    query.Set("lon", formatCoordinate(lon))
+    query.Set("units", "M")
+    query.Set("key", p.apiKey)
+
+    var data struct {
+        Data []struct {
+            Temperature *float64 `json:"temp"`
+            FeelsLike float64 `json:"app_temp"`
+            Humidity float64 `json:"rh"`
+            Pressure float64 `json:"slp"`
+            WindSpeed float64 `json:"wind_spd"`
+        } `json:"data"`
+    }
+    err := getProviderJSON(ctx, p.http, "https://api.weatherbit.io/v2.0/current?" + query.Encode(), &data)
+    if err != nil {
+        return Reading{}, err
+    } else if len(data.Data) == 0 || data.Data[0].Temperature == nil {
+        return Reading{}, errors.New("no current readings")
+    }
+    d := data.Data[0]
+    return Reading{*d.Temperature, d.FeelsLike, d.Humidity, d.Pressure, d.WindSpeed}, nil
+}
+
+// Averages the readings of every provider into a city's weather, which was
+// looked up from 'primary'. The primary provider's readings are taken from
+// the weather rather than asked for again; the rest are asked concurrently,
+// each within PROVIDER_TIMEOUT. Providers that fail or are too slow are
+// logged and left out. Humidity and pressure are rounded to whole numbers, as
+// OpenWeatherMap reports them. Records which providers contributed in
+// datum.Providers.
+func (s *Server) mergeReadings(ctx context.Context, primary string, datum *WeatherData) {
+    if ctx == nil {
+        ctx = context.Background()
+    }
+
+    var readings []Reading = make([]Reading, len(s.providers))
+    var ok []bool = make([]bool, len(s.providers))
+    var wg sync.WaitGroup
+    for i, provider := range s.providers {
+        if provider.name() == primary {
+            readings[i], ok[i] = getReading(*datum), true
+            continue
+        }
+        wg.Add(1)
+        go func(i int, provider ReadingProvider) {
+            defer wg.Done()
+            pctx, cancel := context.WithTimeout(ctx, s.config.ProviderTimeout)
+            defer cancel()
+            var start time.Time = time.Now()
+            reading, err := provider.current(pctx, datum.Coord.Lat, datum.Coord.Lon)
+            s.metrics.observeUpstream(provider.name(), "current", upstreamResult(err), time.Since(start))
+            if err != nil {
+                log.Printf("Couldn't get readings for %q from %s: %v", datum.Name, provider.name(), err)
+                return
+            }
+            readings[i], ok[i] = reading, true
+        }(i, provider)
+    }
+    wg.Wait()
+
+    var sum Reading
+    var n float64 = 0
+    datum.Providers = nil
+    for i, provider := range s.providers {
+        if !ok[i] {
+            continue
+        }
+        sum.Temperature = sum.Temperature + readings[i].Temperature
+        sum.FeelsLike = sum.FeelsLike + readings[i].FeelsLike
+        sum.Humidity = sum.Humidity + readings[i].Humidity
+        sum.Pressure = sum.Pressure + readings[i].Pressure
+        sum.WindSpeed = sum.WindSpeed + readings[i].WindSpeed
+        n = n + 1
+        datum.Providers = append(datum.Providers, providerNames[provider.name()])
+    }
+    datum.Main.Temperature = sum.Temperature / n
+    datum.Main.FeelsLike = sum.FeelsLike / n
+    datum.Main.Humidity = math.Round(sum.Humidity / n)
+    datum.Main.Pressure = math.Round(sum.Pressure / n)
+    datum.Wind.Speed = sum.WindSpeed / n
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "reflect"
+    "testing"
+)
+
+// A ReadingProvider that always answers with the same reading or error.
+type fixedProvider struct {
+    provider string
+    reading Reading
+    err error
+}
+
+func (p *fixedProvider) name() string {
+    return p.provider
+}
+
+func (p *fixedProvider) current(ctx context.Context, lat, lon float64) (Reading, error) {
+    return p.reading, p.err
+}
+
+func TestParseProviders(t *testing.T) {
+    var tests = []struct {
+        in string
+        want []string
+    }{
+        {"", []string{"openweathermap"}},
+        {"open-meteo", []string{"openweathermap", "open-meteo"}},
+        {"Weatherbit, openweathermap, weatherbit", []string{"openweathermap", "weatherbit"}},
+    }
+    for _, test := range tests {
+        got, err := parseProviders(test.in)
+        if err != nil || !reflect.DeepEqual(got, test.want) {
+            t.Errorf("parseProviders(%q) = %v, %v, want %v", test.in, got, err, test.want)
+        }
+    }
+    if _, err := parseProviders("accuweather"); err == nil {
+        t.Error("parseProviders accepted an unknown provider")
+    }
+}
+
+func TestMergeReadings(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    s.providers = []ReadingProvider{
+        s.providers[0],
+        &fixedProvider{"open-meteo", Reading{12, 10, 60, 1010, 4}, nil},
+        &fixedProvider{"weatherbit", Reading{}, errors.New("down")},
+    }
+
+    var datum WeatherData
+    datum.Main.Temperature = 10
+    datum.Main.FeelsLike = 8
+    datum.Main.Humidity = 51
+    datum.Main.Pressure = 1000
+    datum.Wind.Speed = 2
+    s.mergeReadings(context.Background(), "openweathermap", &datum)
+
+    // The primary's readings come from the weather, without a request
+    var want Reading = Reading{11, 9, 56, 1005, 3}
+    if got := getReading(datum); got != want {
+        t.Errorf("merged readings = %+v, want %+v", got, want)
+    }
+    if want := []string{"OpenWeatherMap", "Open-Meteo"}; !reflect.DeepEqual(datum.Providers, want) {
+        t.Errorf("providers = %v, want %v", datum.Providers, want)
+    }
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/ecdh"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "hash"
+    "io/ioutil"
+    "log"
+    "math"
+    "math/big"
+    "net/http"
+    "net/url"
+    "regexp"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+/*
+A browser's Web Push subscription, as produced by PushSubscription.toJSON():
+  - Endpoint: The push service URL to send notifications to
+  - Keys: An embedded document containing:
+    + P256dh: The browser's public key, base64url-encoded
+    + Auth: The browser's authentication secret, base64url-encoded
+*/
+type PushSubscription struct {
+    Endpoint string `json:"endpoint"`
+    Keys struct {
+        P256dh string `json:"p256dh"`
+        Auth string `json:"auth"`
+    } `json:"keys"`
+}
+
+/*
+A subscription to notifications about a city's weather:
+  - subscription: The browser's subscription
+  - city: The city to watch
+*/
+type pushEntry struct {
+    subscription PushSubscription
+    city string
+}
+
+/*
+The last reading seen for a city, used to detect significant changes:
+  - temperature: The temperature, in Celsius
+  - severity: The severity of the most significant condition
+*/
+type pushReading struct {
+    temperature float64
+    severity int
+}
+
+/*
+An in-memory store of push subscriptions and the last reading seen for each
+subscribed city. It's safe for concurrent use:
+  - max: The most subscriptions kept; more are refused
+*/
+type PushStore struct {
+    mu sync.Mutex
+    entries map[string]pushEntry
+    readings map[string]pushReading
+    max int
+}
+
+// A change in temperature of at least this many degrees Celsius between
+// checks is worth a notification.
+const pushTemperatureChange = 5.0
+
+// Conditions at least this severe (rain and worse) are worth a notification
+// when they start.
+const pushSeverity = 4
+
+var validPushCity = regexp.MustCompile("^[a-zA-Z0-9 ,]+$")
+
+// The push services that browsers subscribe through: Chrome's, Firefox's,
+// Edge's and Safari's. Subscription endpoints must be on one of these hosts or
+// their subdomains, so that the server can't be made to send requests to
+// arbitrary, possibly internal, addresses.
+var defaultPushHosts = []string{"fcm.googleapis.com", "updates.push.services.mozilla.com", "notify.windows.com", "push.apple.com"}
+
+var errTooManySubscriptions = errors.New("too many push subscriptions")
+
+func newPushStore(max int) *PushStore {
+    return &PushStore{entries: make(map[string]pushEntry), readings: make(map[string]pushReading), max: max}
+}
+
+// Adds or replaces the subscription for a browser, keyed by its endpoint.
+// Returns errTooManySubscriptions if the store is full and this is a new
+// endpoint.
+func (p *PushStore) add(subscription PushSubscription, city string) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if _, ok := p.entries[subscription.Endpoint]; !ok && len(p.entries) >= p.max {
+        return errTooManySubscriptions
+    }
+    p.entries[subscription.Endpoint] = pushEntry{subscription, city}
+    return nil
+}
+
+// Reports whether a subscription endpoint may be sent to: an https URL on the
+// default port of one of 'hosts' or their subdomains, with no credentials.
+func isAllowedPushEndpoint(endpoint *url.URL, hosts []string) bool {
+    if endpoint.Scheme != "https" || endpoint.User != nil || (endpoint.Port() != "" && endpoint.Port() != "443") {
+        return false
+    }
+    var host string = strings.ToLower(endpoint.Hostname())
+    for _, allowed := range hosts {
+        if host == allowed || strings.HasSuffix(host, "." + allowed) {
+            return true
+        }
+    }
+    return false
+}
+
+// Removes the subscription for an endpoint, such as when it has expired.
+func (p *PushStore) remove(endpoint string) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    delete(p.entries, endpoint)
+}
+
+// Returns the distinct cities with at least one subscription.
+func (p *PushStore) cities() []string {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    var seen map[string]bool = make(map[string]bool)
+    var cities []string
+    for _, entry := range p.entries {
+        if !seen[entry.city] {
+            seen[entry.city] = true
+            cities = append(cities, entry.city)
+        }
+    }
+    return cities
+}
+
+// Returns the subscriptions for a city.
+func (p *PushStore) subscribers(city string) []PushSubscription {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    var subscriptions []PushSubscription
+    for _, entry := range p.entries {
+        if entry.city == city {
+            subscriptions = append(subscriptions, entry.subscription)
+        }
+    }
+    return subscriptions
+}
+
+// Records the latest reading for a city and returns a notification message if
+// it differs significantly from the previous one, or an empty string if not.
+func (p *PushStore) update(city string, datum provider.Observation, labels UnitFormat) string {
+    var primary provider.WeatherDesc = getPrimaryCondition(datum.Weather)
+    var reading pushReading = pushReading{datum.Main.Temperature, getSeverity(primary)}
+
+    p.mu.Lock()
+    last, seen := p.readings[city]
+    p.readings[city] = reading
+    p.mu.Unlock()
+
+    if !seen {
+        return ""
+    } else if reading.severity >= pushSeverity && last.severity < pushSeverity {
+        return fmt.Sprintf("Expect %s in %s.", getWeatherDescription(primary, "en"), datum.Name)
+    } else if diff := reading.temperature - last.temperature; math.Abs(diff) >= pushTemperatureChange {
+        var direction string = "warmer"
+        if diff < 0 {
+            direction = "colder"
+        }
+        return fmt.Sprintf("It's getting %s in %s: now %s.", direction, datum.Name, labels.temperature(reading.temperature, "metric"))
+    }
+    return ""
+}
+
+// Serves the VAPID public key that browsers need in order to subscribe.
+func (s *Server) handlePushKey(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain")
+    w.Write([]byte(s.vapidPublicKey()))
+}
+
+// Stores a browser's push subscription for the city given by the 'city' query
+// parameter. The body is the subscription as JSON.
+func (s *Server) handlePushSubscribe(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var city string = r.URL.Query().Get("city")
+    if !validPushCity.MatchString(city) {
+        http.Error(w, "A valid city is required", http.StatusBadRequest)
+        return
+    }
+
+    var subscription PushSubscription
+    err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&subscription)
+    if err != nil {
+        http.Error(w, "Invalid subscription", http.StatusBadRequest)
+        return
+    }
+    endpoint, err := url.Parse(subscription.Endpoint)
+    if err != nil || !isAllowedPushEndpoint(endpoint, s.config.PushHosts) {
+        http.Error(w, "Invalid subscription endpoint", http.StatusBadRequest)
+        return
+    }
+    if _, _, err = decodeSubscriptionKeys(subscription); err != nil {
+        http.Error(w, "Invalid subscription keys", http.StatusBadRequest)
+        return
+    }
+
+    if err = s.pushes.add(subscription, s.resolveAlias(city)); err != nil {
+        log.Printf("Refused a push subscription: %v", err)
+        http.Error(w, "Too many subscriptions", http.StatusServiceUnavailable)
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+}
+
+// Checks the weather in every subscribed city every 'interval', notifying
+// subscribers of significant changes. Never returns.
+func (s *Server) runPushChecker(interval time.Duration) {
+    for range time.Tick(interval) {
+        s.checkPushes()
+    }
+}
+
+// Checks the weather in every subscribed city once, notifying subscribers of
+// significant changes.
+func (s *Server) checkPushes() {
+    for _, city := range s.pushes.cities() {
+        data, err := s.weather.Current(context.Background(), city, "en")
+        if err != nil {
+            log.Printf("Couldn't check the weather in %q for push: %v", city, err)
+            continue
+        } else if len(data.List) == 0 {
+            continue
+        }
+
+        var message string = s.pushes.update(city, data.List[0], s.format)
+        if message == "" {
+            continue
+        }
+        payload, _ := json.Marshal(map[string]string{"title": data.List[0].Name, "body": message})
+        for _, subscription := range s.pushes.subscribers(city) {
+            gone, err := s.sendPush(subscription, payload)
+            if gone {
+                s.pushes.remove(subscription.Endpoint)
+            } else if err != nil {
+                log.Printf("Couldn't send push notification: %v", err)
+            }
+        }
+    }
+}
+
+// Sends an encrypted push message to a subscription. Returns true if the push
+// service reports that the subscription no longer exists. Redirects aren't
+// followed, as they could lead anywhere.
+func (s *Server) sendPush(subscription PushSubscription, payload []byte) (bool, error) {
+    body, err := encryptPush(subscription, payload)
+    if err != nil {
+        return false, err
+    }
+    authorization, err := s.vapidAuthorization(subscription.Endpoint)
+    if err != nil {
+        return false, err
+    }
+
+    req, err := http.NewRequest(http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+    if err != nil {
+        return false, err
+    }
+    req.Header.Set("Content-Encoding", "aes128gcm")
+    req.Header.Set("Content-Type", "application/octet-stream")
+    req.Header.Set("TTL", "3600")
+    req.Header.Set("Authorization", authorization)
+
+    var client *http.Client = &http.Client{
+        Transport: s.http.Transport,
+        Timeout: s.http.Timeout,
+        CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return false, err
+    }
+    defer resp.Body.Close()
+    ioutil.ReadAll(resp.Body)
+
+    if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+        return true, nil
+    } else if resp.StatusCode >= 300 {
+        return false, fmt.Errorf("push service returned %s", resp.Status)
+    }
+    return false, nil
+}
+
+// Decodes a subscription's public key and authentication secret.
+func decodeSubscriptionKeys(subscription PushSubscription) (*ecdh.PublicKey, []byte, error) {
+    rawKey, err := base64.RawURLEncoding.DecodeString(subscription.Keys.P256dh)
+    if err != nil {
+        return nil, nil, err
+    }
+    publicKey, err := ecdh.P256().NewPublicKey(rawKey)
+    if err != nil {
+        return nil, nil, err
+    }
+    auth, err := base64.RawURLEncoding.DecodeString(subscription.Keys.Auth)
+    if err != nil {
+        return nil, nil, err
+    } else if len(auth) != 16 {
+        return nil, nil, fmt.Errorf("auth secret is %d bytes, not 16", len(auth))
+    }
+    return publicKey, auth, nil
+}
+
+// Encrypts a push message for a subscription with the aes128gcm content
+// coding of RFC 8291, returning the request body.
+func encryptPush(subscription PushSubscription, payload []byte) ([]byte, error) {
+    uaPublic, auth, err := decodeSubscriptionKeys(subscription)
+    if err != nil {
+        return nil, err
+    }
+
+    // Agree on a shared secret using a fresh key pair
+    asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    secret, err := asPrivate.ECDH(uaPublic)
+    if err != nil {
+        return nil, err
+    }
+    var asPublic []byte = asPrivate.PublicKey().Bytes()
+
+    // Derive the content encryption key and nonce
+    var keyInfo []byte = append([]byte("WebPush: info\x00"), uaPublic.Bytes()...)
+    keyInfo = append(keyInfo, asPublic...)
+    var ikm []byte = hkdfSHA256(secret, auth, string(keyInfo), 32)
+    var salt []byte = make([]byte, 16)
+    if _, err = rand.Read(salt); err != nil {
+        return nil, err
+    }
+    var cek []byte = hkdfSHA256(ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+    var nonce []byte = hkdfSHA256(ikm, salt, "Content-Encoding: nonce\x00", 12)
+
+    // Encrypt the payload as a single, final record
+    block, err := aes.NewCipher(cek)
+    if err != nil {
+        return nil, err
+    }
+    gcm, err := cipher.NewGCM(block)
+    if err != nil {
+        return nil, err
+    }
+    var ciphertext []byte = gcm.Seal(nil, nonce, append(payload, 0x02), nil)
+
+    // Header: salt, record size, key ID length and key ID
+    var body bytes.Buffer
+    body.Write(salt)
+    binary.Write(&body, binary.BigEndian, uint32(4096))
+    body.WriteByte(byte(len(asPublic)))
+    body.Write(asPublic)
+    body.Write(ciphertext)
+    return body.Bytes(), nil
+}
+
+// Derives a 'length'-byte key with HKDF-SHA256 (RFC 5869). Web Push never
+// asks for more than one block, so there's a single expand step.
+func hkdfSHA256(secret, salt []byte, info string, length int) []byte {
+    var extract hash.Hash = hmac.New(sha256.New, salt)
+    extract.Write(secret)
+    var expand hash.Hash = hmac.New(sha256.New, extract.Sum(nil))
+    expand.Write([]byte(info))
+    expand.Write([]byte{1})
+    return expand.Sum(nil)[:length]
+}
+
+// Returns the VAPID public key, base64url-encoded, or an empty string if push
+// notifications aren't configured.
+func (s *Server) vapidPublicKey() string {
+    if s.vapidKey == nil {
+        return ""
+    }
+    key, err := s.vapidKey.PublicKey.ECDH()
+    if err != nil {
+        return ""
+    }
+    return base64.RawURLEncoding.EncodeToString(key.Bytes())
+}
+
+// Returns the VAPID Authorization header (RFC 8292) for a push endpoint.
+func (s *Server) vapidAuthorization(endpoint string) (string, error) {
+    u, err := url.Parse(endpoint)
+    if err != nil {
+        return "", err
+    }
+
+    header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+    claims, _ := json.Marshal(map[string]interface{}{
+        "aud": u.Scheme + "://" + u.Host,
+        "exp": now().Add(12 * time.Hour).Unix(),
+        "sub": s.config.VAPIDSubject,
+    })
+    var unsigned string = base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+    var digest [32]byte = sha256.Sum256([]byte(unsigned))
+    r, sig, err := ecdsa.Sign(rand.Reader, s.vapidKey, digest[:])
+    if err != nil {
+        return "", err
+    }
+    var signature []byte = make([]byte, 64)
+    r.FillBytes(signature[:32])
+    sig.FillBytes(signature[32:])
+
+    var token string = unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+    return "vapid t=" + token + ", k=" + s.vapidPublicKey(), nil
+}
+
+// Parses a VAPID private key given as a base64url-encoded P-256 scalar.
+func parseVAPIDKey(encoded string) (*ecdsa.PrivateKey, error) {
+    raw, err := base64.RawURLEncoding.DecodeString(encoded)
+    if err != nil {
+        return nil, err
+    }
+    key, err := ecdh.P256().NewPrivateKey(raw)
+    if err != nil {
+        return nil, err
+    }
+
+    // The uncompressed public key is 0x04, then X and Y
+    var public []byte = key.PublicKey().Bytes()
+    return &ecdsa.PrivateKey{
+        PublicKey: ecdsa.PublicKey{
+            Curve: elliptic.P256(),
+            X: new(big.Int).SetBytes(public[1:33]),
+            Y: new(big.Int).SetBytes(public[33:]),
+        },
+        D: new(big.Int).SetBytes(raw),
+    }, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+    "errors"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+var errQuotaExceeded = errors.New("daily request limit reached")
+
+/*
+Counts each client IP's requests for the current day, so that one client can't
+use up the shared upstream quota. Safe for concurrent use:
+  - mu: Guards the other fields
+  - day: The UTC day being counted, such as "2024-05-01"
+  - counts: Maps each IP to its number of requests today
+*/
+type QuotaStore struct {
+    mu sync.Mutex
+    day string
+    counts map[string]int
+}
+
+func newQuotaStore() *QuotaStore {
+    return &QuotaStore{counts: make(map[string]int)}
+}
+
+// Counts a request from an IP, returning whether it's within the daily limit.
+// Counts start again at midnight UTC.
+func (q *QuotaStore) allow(ip string, limit int, now time.Time) bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    var day string = now.UTC().Format("2006-01-02")
+    if day != q.day {
+        q.day = day
+        q.counts = make(map[string]int)
+    }
+    if q.counts[ip] >= limit {
+        return false
+    }
+    q.counts[ip] = q.counts[ip] + 1
+    return true
+}
+
+// Returns the IP a request came from, without its port.
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// Wraps a handler so that each IP may make at most DAILY_QUOTA requests a day,
+// after which it's answered with 429 until midnight UTC. Health and status
+// checks and static files don't count.
+func (s *Server) withQuota(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if s.config.DailyQuota == 0 || r.URL.Path == "/healthz" || r.URL.Path == "/status" || r.URL.Path == "/metrics" || strings.HasPrefix(r.URL.Path, "/include/") {
+            h.ServeHTTP(w, r)
+            return
+        }
+
+        var at time.Time = now()
+        if !s.quotas.allow(clientIP(r), s.config.DailyQuota, at) {
+            var midnight time.Time = at.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+            w.Header().Set("Retry-After", strconv.Itoa(int(midnight.Sub(at).Seconds()) + 1))
+            if strings.HasPrefix(r.URL.Path, "/api/") {
+                writeAPIError(w, r, http.StatusTooManyRequests, errQuotaExceeded)
+            } else {
+                http.Error(w, errQuotaExceeded.Error(), http.StatusTooManyRequests)
+            }
+            return
+        }
+        h.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+// Serves a request from a client IP.
+func serveFrom(s *Server, ip, path string) *httptest.ResponseRecorder {
+    var w *httptest.ResponseRecorder = httptest.NewRecorder()
+    var r *http.Request = httptest.NewRequest(http.MethodGet, path, nil)
+    r.RemoteAddr = ip + ":1234"
+    s.routes().ServeHTTP(w, r)
+    return w
+}
+
+// An IP over DAILY_QUOTA gets 429s until midnight UTC, without affecting other
+// IPs, and health checks don't count.
+func TestDailyQuota(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"DAILY_QUOTA": "3"})
+    for i := 0; i < 3; i = i + 1 {
+        if w := serveFrom(s, "192.0.2.1", "/api/weather/London"); w.Code != http.StatusOK {
+            t.Fatalf("request %d: status %d, want 200", i + 1, w.Code)
+        }
+    }
+    var w *httptest.ResponseRecorder = serveFrom(s, "192.0.2.1", "/weather/London")
+    if w.Code != http.StatusTooManyRequests {
+        t.Errorf("fourth request: status %d, want 429", w.Code)
+    } else if got := w.Header().Get("Retry-After"); got != "43201" {
+        t.Errorf("Retry-After = %s, want the 12 hours to midnight", got)
+    }
+    if w = serveFrom(s, "192.0.2.1", "/api/weather/London"); w.Code != http.StatusTooManyRequests {
+        t.Errorf("API request over quota: status %d, want 429", w.Code)
+    }
+    if w = serveFrom(s, "192.0.2.1", "/healthz"); w.Code != http.StatusOK {
+        t.Errorf("/healthz over quota: status %d, want 200", w.Code)
+    }
+    if w = serveFrom(s, "198.51.100.7", "/api/weather/London"); w.Code != http.StatusOK {
+        t.Errorf("another IP: status %d, want 200", w.Code)
+    }
+
+    var saved func() time.Time = now
+    defer func() { now = saved }()
+    now = func() time.Time { return time.Date(2024, 5, 2, 0, 0, 1, 0, time.UTC) }
+    if w = serveFrom(s, "192.0.2.1", "/api/weather/London"); w.Code != http.StatusOK {
+        t.Errorf("after midnight: status %d, want 200", w.Code)
+    }
+}
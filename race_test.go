@@ -0,0 +1,102 @@
+package main
+
+import (
+    "crypto/ecdh"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "encoding/base64"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// Returns a base64url-encoded VAPID private key for tests.
+func newTestVAPIDKey(t *testing.T) string {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return base64.RawURLEncoding.EncodeToString(key.D.FillBytes(make([]byte, 32)))
+}
+
+// Returns the JSON for a browser's push subscription to 'endpoint', with a
+// fresh key pair.
+func newTestSubscription(t *testing.T, endpoint string) string {
+    t.Helper()
+    key, err := ecdh.P256().GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var auth []byte = make([]byte, 16)
+    rand.Read(auth)
+    return fmt.Sprintf(`{"endpoint":%q,"keys":{"p256dh":%q,"auth":%q}}`, endpoint,
+        base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()), base64.RawURLEncoding.EncodeToString(auth))
+}
+
+// Hammers the endpoints that share state across requests (the weather and
+// history caches, the alias table, push subscriptions, recent views, the
+// metrics and the circuit breaker) from many goroutines at once. Run with
+// -race to catch unsynchronized access, which would otherwise show up as a
+// "concurrent map writes" panic under load.
+func TestConcurrentRequests(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{
+        "VAPID_PRIVATE_KEY": newTestVAPIDKey(t),
+        "VAPID_SUBJECT": "mailto:test@example.com",
+        "PREFETCH_INTERVAL": "1m",
+    })
+    var handler http.Handler = s.routes()
+    var paths []string = []string{
+        "/weather/London",
+        "/weather/NYC",
+        "/weather/London?units=imperial",
+        "/api/weather/London",
+        "/api/weather/London?refresh=true",
+        "/api/weather/Paris?units=both",
+        "/api/weather/London/trend",
+        "/api/weather/London/forecast",
+        "/forecast/London",
+        "/metrics",
+        "/status",
+    }
+
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i = i + 1 {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            for j := 0; j < 10; j = j + 1 {
+                for _, path := range paths {
+                    var w *httptest.ResponseRecorder = httptest.NewRecorder()
+                    handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+                    if w.Code >= 500 {
+                        t.Errorf("%s: status %d", path, w.Code)
+                    }
+                }
+
+                var body string = newTestSubscription(t, fmt.Sprintf("https://fcm.googleapis.com/fcm/send/%d-%d", i, j))
+                var w *httptest.ResponseRecorder = httptest.NewRecorder()
+                handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/push/subscribe?city=NYC", strings.NewReader(body)))
+                if w.Code != http.StatusCreated {
+                    t.Errorf("subscribing: status %d: %s", w.Code, w.Body.String())
+                }
+            }
+        }(i)
+    }
+
+    // Meanwhile check the subscriptions and prefetch in the background, as
+    // the server does
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for j := 0; j < 10; j = j + 1 {
+            s.checkPushes()
+            s.prefetchComparisons(now())
+        }
+    }()
+    wg.Wait()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+/*
+The weather last fetched from upstream for each city, so that no city is
+fetched more often than MIN_REFRESH however its lookups vary. Lookups that
+differ only in comparison miss the cache separately, so the cache alone
+doesn't bound this. The readings are kept without a comparison, which each
+lookup adds for itself. Safe for concurrent use:
+  - mu: Guards fetches
+  - fetches: Maps each city's refreshKey to its last fetch
+*/
+type RefreshTracker struct {
+    mu sync.Mutex
+    fetches map[string]lastFetch
+}
+
+// A city's last fetched weather and when it was fetched.
+type lastFetch struct {
+    at time.Time
+    datum WeatherData
+}
+
+func newRefreshTracker() *RefreshTracker {
+    return &RefreshTracker{fetches: make(map[string]lastFetch)}
+}
+
+// Returns the key identifying a city for the refresh interval. Only the
+// options that change the upstream request are included: which city is looked
+// up, and the languages its descriptions are asked for in. The comparison
+// options are left out, as the comparison is added to the reading afterwards.
+func refreshKey(city string, opts lookupOptions) string {
+    var key string = strings.ToLower(city) + "|" + strings.Join(opts.Langs, ",")
+    if opts.Disambiguate {
+        key = key + "|disambiguate"
+    }
+    if opts.CityID != 0 {
+        key = key + "|" + strconv.Itoa(int(opts.CityID))
+    }
+    return key
+}
+
+// Returns the weather last fetched for a city if that was less than
+// 'interval' before 'now'.
+func (t *RefreshTracker) recent(key string, interval time.Duration, now time.Time) (WeatherData, bool) {
+    if interval <= 0 {
+        return WeatherData{}, false
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    fetch, ok := t.fetches[key]
+    if !ok || now.Sub(fetch.at) >= interval {
+        return WeatherData{}, false
+    }
+    return fetch.datum, true
+}
+
+// Records the weather just fetched for a city, forgetting any cities whose
+// interval has passed.
+func (t *RefreshTracker) record(key string, datum WeatherData, interval time.Duration, now time.Time) {
+    if interval <= 0 {
+        return
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for k, fetch := range t.fetches {
+        if now.Sub(fetch.at) >= interval {
+            delete(t.fetches, k)
+        }
+    }
+    t.fetches[key] = lastFetch{now, datum}
+}
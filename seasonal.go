@@ -0,0 +1,77 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "math"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// The number of hourly samples in the calendar week a seasonal normal is
+// averaged over.
+const seasonalWindowHours = 7 * 24
+
+// Returns the average temperature in Celsius of a set of historical samples,
+// which are in Kelvin, and whether there were any samples to average.
+func getSeasonalNormal(years []provider.List) (float64, bool) {
+    var sum float64
+    var count int
+    for _, history := range years {
+        for _, datum := range history.List {
+            sum = sum + datum.Main.Temperature - 273.15
+            count = count + 1
+        }
+    }
+    if count == 0 {
+        return 0, false
+    }
+    return sum / float64(count), true
+}
+
+// Phrases the departure of a temperature from the seasonal normal, both in the
+// given unit system, such as "It's 3°C above normal for this time of year."
+// Departures within 'similarBand', in degrees Celsius, are about normal.
+func getSeasonalNote(temperature, normal, similarBand float64, units string, labels UnitFormat) string {
+    var diff float64 = temperature - normal
+    if units == "imperial" {
+        similarBand = similarBand * 9 / 5
+    }
+    if math.Abs(diff) < similarBand {
+        return "It's about normal for this time of year."
+    }
+    var direction string = "above"
+    if diff < 0 {
+        direction = "below"
+    }
+    return fmt.Sprintf("It's %s %s normal for this time of year.", labels.temperature(math.Abs(diff), units), direction)
+}
+
+// Fetches the calendar week centred on this date in each of the last 'years'
+// years within 'ctx', skipping years the history doesn't reach back to.
+func (s *Server) getSeasonalHistory(ctx context.Context, today WeatherData, years int) []provider.List {
+    var history []provider.List
+    var now time.Time = time.Unix(today.Time, 0).UTC()
+    for year := 1; year <= years; year = year + 1 {
+        var start time.Time = now.AddDate(-year, 0, 0).Add(-seasonalWindowHours / 2 * time.Hour)
+        data, err := s.weather.Historical(ctx, today.CityId, start, provider.Hourly, seasonalWindowHours)
+        if err != nil {
+            log.Printf("Couldn't get history from %d years ago for %q: %v", year, today.Name, err)
+            continue
+        }
+        history = append(history, data)
+    }
+    return history
+}
+
+// Returns the seasonal normal for a reading in Celsius, or nil if there's no
+// history to compute it from.
+func (s *Server) getSeasonalComparison(ctx context.Context, today WeatherData) *float64 {
+    normal, ok := getSeasonalNormal(s.getSeasonalHistory(ctx, today, s.config.SeasonalYears))
+    if !ok {
+        return nil
+    }
+    return &normal
+}
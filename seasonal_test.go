@@ -0,0 +1,87 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// Builds a year of history with a sample, in Kelvin, for each temperature in
+// Celsius.
+func seasonalYear(celsius ...float64) provider.List {
+    var history provider.List
+    for _, temperature := range celsius {
+        var sample provider.Observation
+        sample.Main.Temperature = temperature + 273.15
+        history.List = append(history.List, sample)
+    }
+    return history
+}
+
+// The normal is the average of every sample across the years, not of each
+// year's average, and there's none without samples.
+func TestSeasonalNormal(t *testing.T) {
+    var tests = []struct {
+        years []provider.List
+        want float64
+        ok bool
+    }{
+        {nil, 0, false},
+        {[]provider.List{seasonalYear(), seasonalYear()}, 0, false},
+        {[]provider.List{seasonalYear(10, 12)}, 11, true},
+        {[]provider.List{seasonalYear(10, 12), seasonalYear(14, 16)}, 13, true},
+        {[]provider.List{seasonalYear(10), seasonalYear(), seasonalYear(16, 16)}, 14, true},
+    }
+    for i, test := range tests {
+        normal, ok := getSeasonalNormal(test.years)
+        if ok != test.ok || math.Abs(normal - test.want) > 1e-9 {
+            t.Errorf("test %d: normal = %v, %v, want %v, %v", i, normal, ok, test.want, test.ok)
+        }
+    }
+}
+
+// With SEASONAL_YEARS set, the same week is fetched from each past year the
+// history reaches, and the reading is phrased against their normal.
+func TestSeasonalComparison(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"SEASONAL_YEARS": "3"})
+    var starts []int
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        switch {
+            case strings.HasSuffix(req.URL.Path, "/find"):
+                return stubResponse(req, http.StatusOK, stubLondon), nil
+            case strings.HasSuffix(req.URL.Path, "/history/city") && req.URL.Query().Get("cnt") == strconv.Itoa(seasonalWindowHours):
+                start, _ := strconv.ParseInt(req.URL.Query().Get("start"), 10, 64)
+                var year int = time.Unix(start, 0).UTC().Year()
+                starts = append(starts, year)
+                switch year {
+                    case 2022: return stubResponse(req, http.StatusOK, `{"list":[{"main":{"temp":283.15}},{"main":{"temp":285.15}}]}`), nil
+                    case 2021: return stubResponse(req, http.StatusOK, `{"list":[{"main":{"temp":287.15}},{"main":{"temp":289.15}}]}`), nil
+                }
+                return stubResponse(req, http.StatusNotFound, `{"cod":"404","message":"no data"}`), nil
+        }
+        return stubResponse(req, http.StatusOK, `{"list":[]}`), nil
+    })
+
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London")
+    var datum WeatherData
+    if err := json.Unmarshal(w.Body.Bytes(), &datum); err != nil {
+        t.Fatalf("status %d: %v", w.Code, err)
+    }
+    if fmt.Sprint(starts) != "[2022 2021 2020]" {
+        t.Errorf("fetched the week from %v, want 2022, 2021 and 2020", starts)
+    }
+    if datum.SeasonalNormal == nil || *datum.SeasonalNormal != 13 {
+        t.Fatalf("seasonal normal = %v, want 13 from the two years with history", datum.SeasonalNormal)
+    }
+    if want := "It's 6°C below normal for this time of year."; datum.SeasonalNote != want {
+        t.Errorf("seasonal note = %q, want %q", datum.SeasonalNote, want)
+    }
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// Checks connectivity to the upstream API, and that it accepts our requests,
+// by looking up a city that is known to exist. Returns an error describing
+// what is misconfigured if the lookup fails.
+func selfTest(weather provider.WeatherProvider, city string) error {
+    data, err := weather.Current(context.Background(), city, "en")
+    var upstreamErr *provider.UpstreamError
+    if errors.As(err, &upstreamErr) && upstreamErr.Status == http.StatusUnauthorized {
+        return fmt.Errorf("OpenWeatherMap rejected the request (401): the API key is missing or invalid")
+    } else if errors.As(err, &upstreamErr) {
+        return fmt.Errorf("OpenWeatherMap returned an error: %v", err)
+    } else if err != nil {
+        return fmt.Errorf("couldn't look up %q: %v", city, err)
+    } else if len(data.List) == 0 {
+        return fmt.Errorf("no results for %q", city)
+    }
+    return nil
+}
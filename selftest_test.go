@@ -0,0 +1,35 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "testing"
+)
+
+func TestSelfTest(t *testing.T) {
+    var tests = []struct {
+        status int
+        body string
+        want string
+    }{
+        {http.StatusOK, stubLondon, ""},
+        {http.StatusUnauthorized, `{"cod":401,"message":"Invalid API key"}`, "the API key is missing or invalid"},
+        {http.StatusInternalServerError, `oops`, "OpenWeatherMap returned an error"},
+        {http.StatusOK, `{"list":[]}`, `no results for "London"`},
+    }
+    for _, test := range tests {
+        var s *Server = newTestServer(t, nil)
+        var transport *stubTransport = stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+            return stubResponse(req, test.status, test.body), nil
+        })
+        var err error = selfTest(s.weather, "London")
+        if test.want == "" && err != nil {
+            t.Errorf("status %d: %v, want no error", test.status, err)
+        } else if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+            t.Errorf("status %d: got %v, want an error containing %q", test.status, err, test.want)
+        }
+        if transport.calls.Load() == 0 {
+            t.Errorf("status %d: the self-test didn't go upstream", test.status)
+        }
+    }
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "regexp"
+    "strings"
+)
+
+// Matches file names carrying a content hash, such as "styles.3f2a9c1b.css",
+// which can be cached for good since a new version gets a new name.
+var fingerprinted = regexp.MustCompile(`\.[0-9a-f]{8,}\.[a-z0-9]+$`)
+
+// Serves the static files under 'dir'. Fingerprinted files are cached by
+// browsers for a year and others for an hour. Missing files and directories
+// get a plain 404 rather than a listing or a redirect.
+func staticFiles(dir string) http.Handler {
+    var files http.Handler = http.FileServer(http.Dir(dir))
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var name string = path.Clean("/" + r.URL.Path)
+        info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+        if err != nil || info.IsDir() || strings.HasSuffix(r.URL.Path, "/") {
+            http.NotFound(w, r)
+            return
+        }
+
+        if fingerprinted.MatchString(name) {
+            w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+        } else {
+            w.Header().Set("Cache-Control", "public, max-age=3600")
+        }
+        files.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+)
+
+/*
+The server's status as reported by /status:
+  - Upstream.LastSuccess: When an upstream request last succeeded, if ever
+  - Upstream.Breaker: The circuit breaker's state
+  - Cache.Hits, Cache.Misses: The number of lookups served from the cache and
+    fetched upstream since startup
+  - Cache.HitRatio: The fraction of lookups served from the cache
+*/
+type Status struct {
+    Upstream struct {
+        LastSuccess *time.Time `json:"last_success"`
+        Breaker string `json:"breaker"`
+    } `json:"upstream"`
+    Cache struct {
+        Hits int64 `json:"hits"`
+        Misses int64 `json:"misses"`
+        HitRatio float64 `json:"hit_ratio"`
+    } `json:"cache"`
+}
+
+// Gathers the server's current status.
+func (s *Server) getStatus(now time.Time) Status {
+    var status Status
+    breaker, lastSuccess := s.health.State(now)
+    status.Upstream.Breaker = breaker
+    if !lastSuccess.IsZero() {
+        status.Upstream.LastSuccess = &lastSuccess
+    }
+
+    status.Cache.Hits = s.cache.hits.Load()
+    status.Cache.Misses = s.cache.misses.Load()
+    if total := status.Cache.Hits + status.Cache.Misses; total > 0 {
+        status.Cache.HitRatio = float64(status.Cache.Hits) / float64(total)
+    }
+    return status
+}
+
+// Reports upstream reachability and cache effectiveness as JSON.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(s.getStatus(now()))
+}
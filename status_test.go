@@ -0,0 +1,49 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "testing"
+)
+
+// Decodes the server's /status report.
+func getStatusReport(t *testing.T, s *Server) Status {
+    t.Helper()
+    var status Status
+    if err := json.Unmarshal(serve(s, http.MethodGet, "/status").Body.Bytes(), &status); err != nil {
+        t.Fatal(err)
+    }
+    return status
+}
+
+// /status reports when upstream last answered, the breaker's state and how
+// well the cache is doing.
+func TestStatus(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var status Status = getStatusReport(t, s)
+    if status.Upstream.LastSuccess != nil || status.Upstream.Breaker != "closed" || status.Cache.Hits + status.Cache.Misses != 0 {
+        t.Errorf("at startup: %+v, want no success, a closed breaker and no lookups", status)
+    }
+
+    for i := 0; i < 3; i = i + 1 {
+        serve(s, http.MethodGet, "/api/weather/London")
+    }
+    status = getStatusReport(t, s)
+    if status.Upstream.LastSuccess == nil || !status.Upstream.LastSuccess.Equal(now()) {
+        t.Errorf("last success = %v, want %v", status.Upstream.LastSuccess, now())
+    }
+    if status.Cache.Misses != 1 || status.Cache.Hits != 2 || status.Cache.HitRatio < 0.66 || status.Cache.HitRatio > 0.67 {
+        t.Errorf("cache = %+v after three lookups of one city, want 1 miss and 2 hits", status.Cache)
+    }
+
+    // Failing lookups, which aren't cached, open the breaker
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        return stubResponse(req, http.StatusInternalServerError, `oops`), nil
+    })
+    for i := 0; i < 10; i = i + 1 {
+        serve(s, http.MethodGet, "/api/weather/Paris")
+    }
+    if status = getStatusReport(t, s); status.Upstream.Breaker != "open" || status.Upstream.LastSuccess == nil {
+        t.Errorf("after failures: %+v, want an open breaker and the last success kept", status.Upstream)
+    }
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "flag"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// Rewrites the golden files with the current output instead of comparing,
+// after an intended change to a template: go test *.go -run Golden -update
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Returns a server in mock mode configured from 'env', with the clock fixed so
+// that its output doesn't change from run to run.
+func newTestServer(t *testing.T, env map[string]string) *Server {
+    t.Helper()
+    var saved func() time.Time = now
+    now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+    t.Cleanup(func() { now = saved })
+
+    config, err := loadConfig(func(key string) string {
+        if key == "MOCK_MODE" {
+            return "1"
+        }
+        return env[key]
+    })
+    if err != nil {
+        t.Fatalf("loadConfig: %v", err)
+    }
+    s, err := newServer(config)
+    if err != nil {
+        t.Fatalf("newServer: %v", err)
+    }
+    return s
+}
+
+// Requests a path from the server, returning the response.
+func serve(s *Server, method, path string) *httptest.ResponseRecorder {
+    var w *httptest.ResponseRecorder = httptest.NewRecorder()
+    var r *http.Request = httptest.NewRequest(method, path, nil)
+    r.RemoteAddr = "192.0.2.1:1234"
+    s.routes().ServeHTTP(w, r)
+    return w
+}
+
+func TestGoldenPages(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"FEATURED_CITIES": "London;Paris"})
+    var tests = []struct {
+        golden string
+        path string
+        status int
+    }{
+        {"index.golden", "/", http.StatusOK},
+        {"weather.golden", "/weather/London", http.StatusOK},
+        {"weather-imperial.golden", "/weather/London?units=imperial", http.StatusOK},
+        {"notfound.golden", "/notfound/", http.StatusOK},
+    }
+    for _, test := range tests {
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, test.path)
+        if w.Code != test.status {
+            t.Errorf("%s: status %d, want %d", test.path, w.Code, test.status)
+            continue
+        }
+
+        var path string = filepath.Join("testdata", test.golden)
+        if *update {
+            err := ioutil.WriteFile(path, w.Body.Bytes(), 0644)
+            if err != nil {
+                t.Fatal(err)
+            }
+            continue
+        }
+        want, err := ioutil.ReadFile(path)
+        if err != nil {
+            t.Fatalf("%s: %v (run with -update to create it)", test.path, err)
+        }
+        if got := w.Body.String(); got != string(want) {
+            t.Errorf("%s: output differs from %s (run with -update if the change is intended):\n%s", test.path, path, got)
+        }
+    }
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "context"
+    "log"
+    "net/http"
+    "time"
+)
+
+// The context key under which a request's Timings are kept.
+type timingsKey struct{}
+
+/*
+Where the time went while handling a request, logged once it's answered to
+show which stage is slow:
+  - Cache: Looking up the cache
+  - Upstream: Fetching the weather, forecast and anything else from upstream
+    other than the comparison
+  - Comparison: Fetching and comparing with the history
+  - Render: Executing the template or encoding the response
+*/
+type Timings struct {
+    Cache time.Duration
+    Upstream time.Duration
+    Comparison time.Duration
+    Render time.Duration
+}
+
+// Returns a copy of the request that carries new Timings, along with them.
+func withTimings(r *http.Request) (*http.Request, *Timings) {
+    var t *Timings = &Timings{}
+    return r.WithContext(context.WithValue(r.Context(), timingsKey{}, t)), t
+}
+
+// Returns the Timings carried by a request, or nil if it has none.
+func getTimings(r *http.Request) *Timings {
+    t, _ := r.Context().Value(timingsKey{}).(*Timings)
+    return t
+}
+
+// Logs the timings as key=value fields.
+func (t *Timings) log(r *http.Request) {
+    log.Printf("Timings path=%s cache=%v upstream=%v comparison=%v render=%v",
+        r.URL.Path, t.Cache, t.Upstream, t.Comparison, t.Render)
+}
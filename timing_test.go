@@ -0,0 +1,44 @@
+package main
+
+import (
+    "bytes"
+    "log"
+    "net/http"
+    "os"
+    "regexp"
+    "testing"
+    "time"
+)
+
+var timingsLine = regexp.MustCompile(`Timings path=(\S+) cache=(\S+) upstream=(\S+) comparison=(\S+) render=(\S+)`)
+
+// A weather request logs how long each stage took, as durations that are
+// never negative, for both the page and the API.
+func TestTimingsLogged(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var logs bytes.Buffer
+    log.SetOutput(&logs)
+    defer log.SetOutput(os.Stderr)
+
+    for _, path := range []string{"/weather/London", "/api/weather/London"} {
+        logs.Reset()
+        if w := serve(s, http.MethodGet, path); w.Code != http.StatusOK {
+            t.Fatalf("%s: status %d: %s", path, w.Code, w.Body)
+        }
+        var m []string = timingsLine.FindStringSubmatch(logs.String())
+        if m == nil {
+            t.Fatalf("%s: no timings in the log:\n%s", path, logs.String())
+        }
+        if m[1] != path {
+            t.Errorf("%s: timings logged for path %s", path, m[1])
+        }
+        for i, field := range []string{"cache", "upstream", "comparison", "render"} {
+            d, err := time.ParseDuration(m[i + 2])
+            if err != nil {
+                t.Errorf("%s: %s=%s isn't a duration", path, field, m[i + 2])
+            } else if d < 0 {
+                t.Errorf("%s: %s=%v is negative", path, field, d)
+            }
+        }
+    }
+}
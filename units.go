@@ -0,0 +1,337 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "math"
+    "net/url"
+    "sort"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+// Maps each unit to the label printed after values in it.
+type UnitLabels map[string]string
+
+// The default unit labels. These may be overridden for localization or style
+// with a JSON file named by UNIT_LABELS_FILE.
+var defaultUnitLabels = UnitLabels{
+    "celsius": "°C",
+    "fahrenheit": "°F",
+    "kelvin": "K",
+    "meters_per_second": "m/s",
+    "kilometers_per_hour": "km/h",
+    "miles_per_hour": "mph",
+    "hectopascals": "hPa",
+    "inches_of_mercury": "inHg",
+    "kilometers": "km",
+    "miles": "mi",
+    "millimeters": "mm",
+    "inches": "in",
+}
+
+/*
+The unit each kind of reading is shown in by a unit system. Readings are only
+converted and labelled through this table, so choosing a system switches them
+all together and no page or response mixes units:
+  - Temperature: Used for the temperature, feels-like and range
+  - Speed: Used for the wind speed
+  - Pressure: Used for the air pressure
+  - Distance: Used for visibility
+  - Volume: Used for rain and snow
+*/
+type UnitSystem struct {
+    Temperature string
+    Speed string
+    Pressure string
+    Distance string
+    Volume string
+}
+
+// The unit systems that readings may be given in, by name.
+var unitSystems = map[string]UnitSystem{
+    "metric": {"celsius", "meters_per_second", "hectopascals", "kilometers", "millimeters"},
+    "imperial": {"fahrenheit", "miles_per_hour", "inches_of_mercury", "miles", "inches"},
+    "standard": {"kelvin", "meters_per_second", "hectopascals", "kilometers", "millimeters"},
+}
+
+// Reads the unit system for a page from its 'units' query parameter, which is
+// "metric", "imperial" or "standard", or 'fallback' if it isn't given.
+func parseUnits(query url.Values, fallback string) (string, error) {
+    var units string = query.Get("units")
+    if units == "" {
+        return fallback, nil
+    } else if _, ok := unitSystems[units]; !ok {
+        return "", errors.New("units must be metric, imperial or standard")
+    }
+    return units, nil
+}
+
+// The number of miles per hour in one meter per second, of inches of mercury
+// in one hectopascal, of miles in one meter and of inches in one millimeter.
+const mphPerMetersPerSecond = 2.23694
+const inHgPerHectopascal = 0.02953
+const milesPerMeter = 0.000621371
+const inchesPerMillimeter = 0.0393701
+
+/*
+The Beaufort scale, as the upper bound in meters per second of each force and
+its description. Anything at or above the last bound is hurricane force.
+*/
+var beaufortScale = []struct {
+    Below float64
+    Description string
+}{
+    {0.5, "calm"},
+    {1.6, "light air"},
+    {3.4, "light breeze"},
+    {5.5, "gentle breeze"},
+    {8.0, "moderate breeze"},
+    {10.8, "fresh breeze"},
+    {13.9, "strong breeze"},
+    {17.2, "near gale"},
+    {20.8, "gale"},
+    {24.5, "strong gale"},
+    {28.5, "storm"},
+    {32.7, "violent storm"},
+}
+
+// Describes a wind speed in the given unit system on the Beaufort scale, such
+// as "gentle breeze". Imperial speeds are converted first, so the same wind is
+// described the same way whatever the units.
+func getWindDescription(speed float64, units string) string {
+    if units == "imperial" {
+        speed = speed / mphPerMetersPerSecond
+    }
+    for _, force := range beaufortScale {
+        if speed < force.Below {
+            return force.Description
+        }
+    }
+    return "hurricane-force winds"
+}
+
+// Loads unit label overrides from a JSON file, returning the default labels
+// with the overrides applied. Every overridden unit must be known, and no
+// label may be left empty.
+func loadUnitLabels(path string) (UnitLabels, error) {
+    buf, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var overrides map[string]string
+    err = json.Unmarshal(buf, &overrides)
+    if err != nil {
+        return nil, err
+    }
+
+    var labels UnitLabels = make(UnitLabels, len(defaultUnitLabels))
+    for unit, label := range defaultUnitLabels {
+        labels[unit] = label
+    }
+    for unit, label := range overrides {
+        if _, ok := labels[unit]; !ok {
+            return nil, fmt.Errorf("unknown unit %q", unit)
+        }
+        labels[unit] = label
+    }
+    return labels, labels.validate()
+}
+
+// Checks that every unit has a label.
+func (labels UnitLabels) validate() error {
+    var missing []string
+    for unit, label := range labels {
+        if label == "" {
+            missing = append(missing, unit)
+        }
+    }
+    if len(missing) > 0 {
+        sort.Strings(missing)
+        return fmt.Errorf("no label for %v", missing)
+    }
+    return nil
+}
+
+/*
+The unit labels along with how temperatures are rounded for display:
+  - UnitLabels: The labels printed after values in each unit
+  - Rounding: "half-up" or "half-even"; see roundWhole
+*/
+type UnitFormat struct {
+    UnitLabels
+    Rounding string
+}
+
+// Rounds a value to a whole number. Halves round up by default, which biases
+// averages slightly upwards; with "half-even" they round to the nearest even
+// number instead, as in banker's rounding.
+func roundWhole(v float64, rounding string) float64 {
+    if rounding == "half-even" {
+        return math.RoundToEven(v)
+    }
+    return math.Floor(v + 0.5)
+}
+
+// Formats a temperature in the given unit system, rounded to a whole degree.
+func (format UnitFormat) temperature(value float64, units string) string {
+    return fmt.Sprintf("%.0f%s", roundWhole(value, format.Rounding), format.UnitLabels[unitSystems[units].Temperature])
+}
+
+// Formats a temperature in the given unit system, rounded to the nearest five
+// degrees for minimalist displays.
+func (format UnitFormat) coarseTemperature(value float64, units string) string {
+    return format.temperature(roundWhole(value / 5, format.Rounding) * 5, units)
+}
+
+// Formats a wind speed in the given unit system.
+func (labels UnitLabels) speed(value float64, units string) string {
+    return fmt.Sprintf("%v %s", value, labels[unitSystems[units].Speed])
+}
+
+// Formats a pressure in the given unit system.
+func (labels UnitLabels) pressure(value float64, units string) string {
+    return fmt.Sprintf("%v %s", value, labels[unitSystems[units].Pressure])
+}
+
+// Formats a visibility in the given unit system. Metric visibility is reported
+// in meters, so it's shown in kilometers; imperial is already in miles.
+func (labels UnitLabels) visibility(value float64, units string) string {
+    if units != "imperial" {
+        value = value / 1000
+    }
+    return fmt.Sprintf("%v %s", value, labels[unitSystems[units].Distance])
+}
+
+// Formats a volume of precipitation in the given unit system along with the
+// window it fell over, such as "1.5 mm in the last hour", or returns an empty
+// string if there was none.
+func (labels UnitLabels) precipitation(p *provider.Precipitation, units string) string {
+    volume, window, ok := getPrecipitationWindow(p)
+    if !ok {
+        return ""
+    }
+    return fmt.Sprintf("%v %s %s", volume, labels[unitSystems[units].Volume], window)
+}
+
+// Returns the volume for the shortest window available along with a label
+// for the window, or false if there is no volume at all.
+func getPrecipitationWindow(p *provider.Precipitation) (float64, string, bool) {
+    if p == nil {
+        return 0, "", false
+    } else if p.OneHour != nil {
+        return *p.OneHour, "in the last hour", true
+    } else if p.ThreeHours != nil {
+        return *p.ThreeHours, "over 3 hours", true
+    }
+    return 0, "", false
+}
+
+// Returns a copy of the volumes multiplied by 'factor', for converting units,
+// or nil if there's no precipitation.
+func scalePrecipitation(p *provider.Precipitation, factor float64) *provider.Precipitation {
+    if p == nil {
+        return nil
+    }
+    var scale = func(v *float64) *float64 {
+        if v == nil {
+            return nil
+        }
+        var scaled float64 = roundHundredths(*v * factor)
+        return &scaled
+    }
+    return &provider.Precipitation{OneHour: scale(p.OneHour), ThreeHours: scale(p.ThreeHours)}
+}
+
+// Converts metric readings to another unit system, following unitSystems.
+// Humidity is a percentage in every system.
+func convertUnits(datum WeatherData, units string) WeatherData {
+    if _, ok := unitSystems[units]; !ok || datum.Units != "metric" || units == "metric" {
+        return datum
+    }
+    datum.Main.Temperature = convertTemperature(datum.Main.Temperature, units)
+    datum.Main.FeelsLike = convertTemperature(datum.Main.FeelsLike, units)
+    datum.Main.TempMin = convertTemperature(datum.Main.TempMin, units)
+    datum.Main.TempMax = convertTemperature(datum.Main.TempMax, units)
+    if datum.SeasonalNormal != nil {
+        var normal float64 = convertTemperature(*datum.SeasonalNormal, units)
+        datum.SeasonalNormal = &normal
+    }
+    if datum.NarrativeDetail != nil {
+        var narrative Narrative = *datum.NarrativeDetail
+        narrative.High = convertTemperature(narrative.High, units)
+        datum.NarrativeDetail = &narrative
+    }
+    if units == "imperial" {
+        datum.Wind.Speed = roundHundredths(datum.Wind.Speed * mphPerMetersPerSecond)
+        datum.Main.Pressure = roundHundredths(datum.Main.Pressure * inHgPerHectopascal)
+        if datum.Visibility != nil {
+            var miles float64 = roundHundredths(*datum.Visibility * milesPerMeter)
+            datum.Visibility = &miles
+        }
+        datum.Rain = scalePrecipitation(datum.Rain, inchesPerMillimeter)
+        datum.Snow = scalePrecipitation(datum.Snow, inchesPerMillimeter)
+    }
+    datum.Units = units
+    return datum
+}
+
+// Converts a temperature in degrees Celsius to the given unit system, rounded
+// to two decimal places.
+func convertTemperature(celsius float64, units string) float64 {
+    switch units {
+        case "imperial": return roundHundredths(celsius * 9 / 5 + 32)
+        case "standard": return roundHundredths(celsius + 273.15)
+        default: return celsius
+    }
+}
+
+// Converts a change in temperature in degrees Celsius to the given unit system,
+// rounded to two decimal places. Unlike a temperature, a change has no offset.
+func convertTemperatureChange(celsius float64, units string) float64 {
+    if units == "imperial" {
+        return roundHundredths(celsius * 9 / 5)
+    }
+    return celsius
+}
+
+// Rounds a converted value to two decimal places, hiding floating-point noise.
+func roundHundredths(v float64) float64 {
+    return math.Round(v * 100) / 100
+}
+
+/*
+The unit-dependent readings of a WeatherData in one unit system, for clients
+that show more than one:
+  - Temperature, FeelsLike, TempMin, TempMax: In °C, °F or K
+  - WindSpeed: In m/s or mph
+  - Pressure: In hPa or inHg
+  - Visibility: In meters or miles, if it was reported
+*/
+type UnitReadings struct {
+    Temperature float64 `json:"temp" xml:"temp"`
+    FeelsLike float64 `json:"feels_like" xml:"feels_like"`
+    TempMin float64 `json:"temp_min" xml:"temp_min"`
+    TempMax float64 `json:"temp_max" xml:"temp_max"`
+    WindSpeed float64 `json:"wind_speed" xml:"wind_speed"`
+    Pressure float64 `json:"pressure" xml:"pressure"`
+    Visibility *float64 `json:"visibility,omitempty" xml:"visibility,omitempty"`
+}
+
+// Returns a metric reading's unit-dependent values in the given unit system.
+func getUnitReadings(datum WeatherData, units string) UnitReadings {
+    datum = convertUnits(datum, units)
+    var readings UnitReadings = UnitReadings{
+        Temperature: datum.Main.Temperature,
+        FeelsLike: datum.Main.FeelsLike,
+        TempMin: datum.Main.TempMin,
+        TempMax: datum.Main.TempMax,
+        WindSpeed: datum.Wind.Speed,
+        Pressure: datum.Main.Pressure,
+        Visibility: datum.Visibility,
+    }
+    return readings
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+func TestConvertTemperature(t *testing.T) {
+    var tests = []struct {
+        celsius float64
+        units string
+        want float64
+    }{
+        {0, "imperial", 32},
+        {100, "imperial", 212},
+        {-40, "imperial", -40},
+        {7.14, "imperial", 44.85},
+        {0, "standard", 273.15},
+        {7.14, "metric", 7.14},
+    }
+    for _, test := range tests {
+        if got := convertTemperature(test.celsius, test.units); got != test.want {
+            t.Errorf("convertTemperature(%v, %q) = %v, want %v", test.celsius, test.units, got, test.want)
+        }
+    }
+    if got := convertTemperatureChange(5, "imperial"); got != 9 {
+        t.Errorf("convertTemperatureChange(5, imperial) = %v, want 9", got)
+    }
+}
+
+func TestConvertUnits(t *testing.T) {
+    var datum WeatherData
+    datum.Units = "metric"
+    datum.Main.Temperature = 20
+    datum.Main.FeelsLike = 18
+    datum.Main.Pressure = 1013
+    datum.Main.Humidity = 50
+    datum.Wind.Speed = 10
+    var visibility float64 = 10000
+    datum.Visibility = &visibility
+
+    var imperial WeatherData = convertUnits(datum, "imperial")
+    if imperial.Units != "imperial" || imperial.Main.Temperature != 68 || imperial.Main.FeelsLike != 64.4 {
+        t.Errorf("imperial temperatures = %v, %v in %q", imperial.Main.Temperature, imperial.Main.FeelsLike, imperial.Units)
+    }
+    if imperial.Wind.Speed != 22.37 || imperial.Main.Pressure != 29.91 || *imperial.Visibility != 6.21 {
+        t.Errorf("imperial wind, pressure, visibility = %v, %v, %v", imperial.Wind.Speed, imperial.Main.Pressure, *imperial.Visibility)
+    }
+    if imperial.Main.Humidity != 50 {
+        t.Errorf("humidity changed to %v", imperial.Main.Humidity)
+    }
+    if *datum.Visibility != 10000 {
+        t.Error("converting changed the original's visibility")
+    }
+
+    // Only metric readings are converted, and only once
+    if again := convertUnits(imperial, "imperial"); again.Main.Temperature != 68 {
+        t.Errorf("converted twice: %v", again.Main.Temperature)
+    }
+    var standard WeatherData = convertUnits(datum, "standard")
+    if standard.Main.Temperature != 293.15 || standard.Wind.Speed != 10 || standard.Main.Pressure != 1013 {
+        t.Errorf("standard readings = %+v", standard.Main)
+    }
+}
+
+func TestParseUnits(t *testing.T) {
+    var tests = []struct {
+        query string
+        fallback string
+        want string
+        ok bool
+    }{
+        {"", "metric", "metric", true},
+        {"", "imperial", "imperial", true},
+        {"units=standard", "metric", "standard", true},
+        {"units=both", "metric", "", false},
+        {"units=furlongs", "metric", "", false},
+    }
+    for _, test := range tests {
+        query, _ := url.ParseQuery(test.query)
+        got, err := parseUnits(query, test.fallback)
+        if got != test.want || (err == nil) != test.ok {
+            t.Errorf("parseUnits(%q) = %q, %v", test.query, got, err)
+        }
+    }
+    query, _ := url.ParseQuery("units=both")
+    if got, err := parseAPIUnits(query, "metric"); got != "both" || err != nil {
+        t.Errorf("parseAPIUnits(units=both) = %q, %v", got, err)
+    }
+}
+
+func TestWindDescriptionBoundaries(t *testing.T) {
+    var tests = []struct {
+        speed float64
+        units string
+        want string
+    }{
+        {0, "metric", "calm"},
+        {0.49, "metric", "calm"},
+        {0.5, "metric", "light air"},
+        {3.39, "metric", "light breeze"},
+        {3.4, "metric", "gentle breeze"},
+        {10.8, "metric", "strong breeze"},
+        {17.2, "metric", "gale"},
+        {20.8, "metric", "strong gale"},
+        {32.69, "metric", "violent storm"},
+        {32.7, "metric", "hurricane-force winds"},
+        {3.4 * mphPerMetersPerSecond, "imperial", "gentle breeze"},
+        {3.39 * mphPerMetersPerSecond, "imperial", "light breeze"},
+    }
+    for _, test := range tests {
+        if got := getWindDescription(test.speed, test.units); got != test.want {
+            t.Errorf("getWindDescription(%v, %q) = %q, want %q", test.speed, test.units, got, test.want)
+        }
+    }
+}
+
+func TestRoundWhole(t *testing.T) {
+    var tests = []struct {
+        v float64
+        rounding string
+        want float64
+    }{
+        {2.5, "half-up", 3},
+        {-2.5, "half-up", -2},
+        {2.5, "half-even", 2},
+        {3.5, "half-even", 4},
+        {2.49, "half-up", 2},
+    }
+    for _, test := range tests {
+        if got := roundWhole(test.v, test.rounding); got != test.want {
+            t.Errorf("roundWhole(%v, %q) = %v, want %v", test.v, test.rounding, got, test.want)
+        }
+    }
+}
+
+// Temperatures are cached unrounded and only rounded after conversion: the
+// mock 6.64°C is 43.95°F, which the API returns as it is and the page shows as
+// 44°F, where rounding first would give 7°C and then 45°F.
+func TestRoundingAfterConversion(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var tests = []struct {
+        units string
+        want float64
+    }{
+        {"metric", 6.64},
+        {"imperial", 43.95},
+        {"metric", 6.64},
+    }
+    for _, test := range tests {
+        var data WeatherData
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London?units=" + test.units)
+        if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+            t.Fatalf("units=%s: %v", test.units, err)
+        } else if data.Main.Temperature != test.want {
+            t.Errorf("units=%s: temp = %v, want %v", test.units, data.Main.Temperature, test.want)
+        }
+    }
+
+    var both BothUnitsData
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London?units=both")
+    if err := json.Unmarshal(w.Body.Bytes(), &both); err != nil {
+        t.Fatal(err)
+    } else if both.Metric.Temperature != 6.64 || both.Imperial.Temperature != 43.95 {
+        t.Errorf("units=both: temps = %v and %v, want 6.64 and 43.95", both.Metric.Temperature, both.Imperial.Temperature)
+    }
+
+    if w = serve(s, http.MethodGet, "/weather/London?units=imperial"); !strings.Contains(w.Body.String(), "44°F") {
+        t.Errorf("imperial page doesn't show 44°F:\n%s", w.Body)
+    }
+}
+
+// A single units=imperial request shows every reading, and every sentence, in
+// imperial units and none in metric.
+func TestImperialPageHasNoMetricUnits(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/weather/London?units=imperial")
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d", w.Code)
+    }
+    var body string = w.Body.String()
+    for _, label := range []string{"°F", "mph", "inHg", " mi"} {
+        if !strings.Contains(body, label) {
+            t.Errorf("imperial page has no %q", label)
+        }
+    }
+    for _, label := range []string{"°C", "m/s", "hPa", " km"} {
+        if strings.Contains(body, label) {
+            t.Errorf("imperial page has %q", label)
+        }
+    }
+}
+
+// The sentences that give temperatures are reworded in the unit system the
+// weather is shown in.
+func TestSentencesAreConverted(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var datum WeatherData
+    var normal float64 = 10
+    datum.Units = "metric"
+    datum.Main.Temperature = 13
+    datum.SeasonalNormal = &normal
+    datum.NarrativeDetail = &Narrative{"light rain this afternoon", 18}
+    datum.SeasonalNote = getSeasonalNote(13, normal, s.config.SimilarBand, "metric", s.format)
+    datum.Narrative = getNarrativeSentence(*datum.NarrativeDetail, "metric", s.format)
+
+    var tests = []struct {
+        units string
+        seasonal string
+        narrative string
+    }{
+        {"metric", "It's 3°C above normal for this time of year.", "Light rain this afternoon, high of 18°C."},
+        {"imperial", "It's 5°F above normal for this time of year.", "Light rain this afternoon, high of 64°F."},
+        {"standard", "It's 3K above normal for this time of year.", "Light rain this afternoon, high of 291K."},
+    }
+    for _, test := range tests {
+        var converted WeatherData = s.convertForDisplay(datum, test.units)
+        if converted.SeasonalNote != test.seasonal {
+            t.Errorf("%s: seasonal note = %q, want %q", test.units, converted.SeasonalNote, test.seasonal)
+        }
+        if converted.Narrative != test.narrative {
+            t.Errorf("%s: narrative = %q, want %q", test.units, converted.Narrative, test.narrative)
+        }
+    }
+    if datum.NarrativeDetail.High != 18 || *datum.SeasonalNormal != 10 {
+        t.Error("converting changed the original's narrative or seasonal normal")
+    }
+}
+
+// The similar band is in Celsius, so it's widened for Fahrenheit.
+func TestSeasonalNoteBand(t *testing.T) {
+    var format UnitFormat = UnitFormat{defaultUnitLabels, "half-up"}
+    if got := getSeasonalNote(51.5, 50, 1, "imperial", format); got != "It's about normal for this time of year." {
+        t.Errorf("1.5°F above normal: %q", got)
+    }
+    if got := getSeasonalNote(52, 50, 1, "imperial", format); got != "It's 2°F above normal for this time of year." {
+        t.Errorf("2°F above normal: %q", got)
+    }
+}
+
+// With COARSE_TEMPERATURE the page shows temperatures to the nearest five
+// degrees, while the API keeps the exact reading.
+func TestCoarseTemperature(t *testing.T) {
+    var tests = []struct {
+        temperature string
+        shown string
+        exact float64
+    }{
+        {"23", "25°C", 23},
+        {"21", "20°C", 21},
+    }
+    for _, test := range tests {
+        var s *Server = newTestServer(t, map[string]string{"COARSE_TEMPERATURE": "1"})
+        stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+            if strings.HasSuffix(req.URL.Path, "/find") {
+                return stubResponse(req, http.StatusOK, `{"list":[{"name":"London","id":2643743,"dt":1714564800,"main":{"temp":` + test.temperature + `,"feels_like":` + test.temperature + `}}]}`), nil
+            }
+            return stubResponse(req, http.StatusOK, `{"list":[]}`), nil
+        })
+
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/weather/London")
+        if !strings.Contains(w.Body.String(), test.shown) || strings.Contains(w.Body.String(), test.temperature + "°C") {
+            t.Errorf("%s°C: page doesn't show %s instead:\n%s", test.temperature, test.shown, w.Body)
+        }
+        var data WeatherData
+        w = serve(s, http.MethodGet, "/api/weather/London")
+        if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+            t.Fatalf("%s°C: %v", test.temperature, err)
+        } else if data.Main.Temperature != test.exact {
+            t.Errorf("%s°C: API temp = %v, want %v", test.temperature, data.Main.Temperature, test.exact)
+        }
+    }
+}
+
+// UNIT_LABELS_FILE overrides labels on the rendered page, and a file naming an
+// unknown unit or leaving a label empty is refused at startup.
+func TestUnitLabelsFile(t *testing.T) {
+    var dir string = t.TempDir()
+    var write = func(name, contents string) string {
+        var path string = filepath.Join(dir, name)
+        if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+            t.Fatal(err)
+        }
+        return path
+    }
+
+    var s *Server = newTestServer(t, map[string]string{"UNIT_LABELS_FILE": write("labels.json", `{"celsius": " degrees"}`)})
+    var body string = serve(s, http.MethodGet, "/weather/London").Body.String()
+    if !strings.Contains(body, "7 degrees") || strings.Contains(body, "°C") {
+        t.Errorf("page doesn't label Celsius as \" degrees\":\n%s", body)
+    }
+    if got := s.format.temperature(50, "imperial"); got != "50°F" {
+        t.Errorf("Fahrenheit is labelled %q, want the default", got)
+    }
+
+    for _, contents := range []string{`{"rankine": "°R"}`, `{"celsius": ""}`, `not json`} {
+        config, err := loadConfig(withAPIKey(map[string]string{"MOCK_MODE": "1", "UNIT_LABELS_FILE": write("bad.json", contents)}))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err = newServer(config); err == nil || !strings.Contains(err.Error(), "invalid unit labels") {
+            t.Errorf("%s: got %v, want invalid unit labels", contents, err)
+        }
+    }
+}
+
+// Current readings give precipitation over the last hour and forecast slots
+// over three hours; either decodes and is labelled with its window.
+func TestPrecipitationWindow(t *testing.T) {
+    var current provider.Observation
+    if err := json.Unmarshal([]byte(`{"rain":{"1h":0.42},"snow":{}}`), &current); err != nil {
+        t.Fatal(err)
+    }
+    var forecast provider.Forecast
+    if err := json.Unmarshal([]byte(`{"list":[{"rain":{"3h":1.5}},{"snow":{"1h":0.2,"3h":0.9}},{}]}`), &forecast); err != nil {
+        t.Fatal(err)
+    }
+    var tests = []struct {
+        name string
+        p *provider.Precipitation
+        want string
+    }{
+        {"current rain", current.Rain, "0.42 mm in the last hour"},
+        {"current snow", current.Snow, ""},
+        {"forecast rain", forecast.List[0].Rain, "1.5 mm over 3 hours"},
+        {"forecast snow", forecast.List[1].Snow, "0.2 mm in the last hour"},
+        {"no rain", forecast.List[2].Rain, ""},
+    }
+    for _, test := range tests {
+        if got := defaultUnitLabels.precipitation(test.p, "metric"); got != test.want {
+            t.Errorf("%s: %q, want %q", test.name, got, test.want)
+        }
+    }
+}
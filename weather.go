@@ -5,333 +5,1401 @@ a REST interface.
 package main
 
 import (
+    "bytes"
+    "context"
+    "crypto/ecdsa"
+    _ "embed"
     "encoding/json"
+    "encoding/xml"
     "errors"
+    "flag"
     "fmt"
     "html/template"
     "io/ioutil"
     "log"
     "math"
+    "net"
     "net/http"
+    "net/url"
+    "os"
+    "os/signal"
+    "path/filepath"
     "regexp"
+    "sort"
+    "strconv"
     "strings"
+    "syscall"
     "time"
+
+    "github.com/ksuarz/weather/provider"
 )
 
 /*
-Describes individual weather descriptions:
-  - Id: The ID number of the weather condition
-  - Type: A string containing the official weather type
-  - Description: A longer description of the weather type
-  - Icon: The name of an icon available via the API
+The weather for a given time, as the upstream reported it in Observation,
+with everything the pages and API add to it:
+  - Units: The unit system of the readings: "metric", "imperial" or
+    "standard"
 */
-type WeatherDesc struct {
-    Id int `json:"id"`
-    Type string `json:"main"`
-    Description string `json:"description"`
-    Icon string `json:"icon"`
+type WeatherData struct {
+    XMLName xml.Name `json:"-" xml:"current"`
+    provider.Observation
+    Units string `json:"units" xml:"units"`
+    MainIcon string `json:"main_icon" xml:"main_icon"`
+    ConditionIds []int `json:"condition_ids" xml:"condition_id"`
+    Comparison string `json:"comparison_text" xml:"comparison_text"`
+    ComparisonDetail *Comparison `json:"comparison,omitempty" xml:"comparison,omitempty"`
+    SeasonalNote string `json:"seasonal_note,omitempty" xml:"seasonal_note,omitempty"`
+    SeasonalNormal *float64 `json:"seasonal_normal,omitempty" xml:"seasonal_normal,omitempty"`
+    DayAverageNote string `json:"day_average_note,omitempty" xml:"day_average_note,omitempty"`
+    FullDescription string `json:"full_description" xml:"full_description"`
+    WindDescription string `json:"wind_description" xml:"wind_description"`
+    RecordHigh bool `json:"record_high" xml:"record_high"`
+    RecordLow bool `json:"record_low" xml:"record_low"`
+    FeelsLikeNote string `json:"feels_like_note,omitempty" xml:"feels_like_note,omitempty"`
+    Substitution string `json:"substitution,omitempty" xml:"substitution,omitempty"`
+    Narrative string `json:"narrative,omitempty" xml:"narrative,omitempty"`
+    NarrativeDetail *Narrative `json:"narrative_detail,omitempty" xml:"narrative_detail,omitempty"`
+    Hourly []TrendPoint `json:"hourly,omitempty" xml:"hourly>point,omitempty"`
+    PressureImplausible bool `json:"pressure_implausible,omitempty" xml:"pressure_implausible,omitempty"`
+    Stale bool `json:"stale,omitempty" xml:"stale,omitempty"`
+    Partial bool `json:"partial,omitempty" xml:"partial,omitempty"`
+    Providers []string `json:"providers,omitempty" xml:"providers>provider,omitempty"`
+    Clock string `json:"-" xml:"-"`
 }
 
 /*
-A complete data structure describing the weather for a given time.
-  - Name: The name of the city
-  - CityID: A unique ID number for the city
-  - Time: The time, expressed as seconds since the epoch
-  - Weather: A list of individual WeatherDesc structures detailing the
-    individual weather conditions
-  - Sys: An embedded document containing:
-    + Country: Either the full country name or a two-letter country code
-    + Sunrise: The time of sunrise, expressed as Unix time
-    + Sunset: The time of sunset, expressed as Unix time
-  - Wind: an embedded document containing:
-    + Speed: The wind speed in meters per second
-  - Main: an embedded document containing:
-    + Temperature: The temperature in either Celsius or Kelvin
-    + Humidity: The humidity, as a percentage from 0% to 100$
-    + Pressure: The pressure in hPa.
+A single sample of a trend series:
+  - Time: The time of the sample, expressed as seconds since the epoch
+  - Temperature: The temperature in Celsius
+  - Humidity: The humidity, as a percentage
+  - Pressure: The pressure in hPa
 */
-type WeatherData struct {
+type TrendPoint struct {
+    Time int64 `json:"time"`
+    Temperature float64 `json:"temp"`
+    Humidity float64 `json:"humidity"`
+    Pressure float64 `json:"pressure"`
+}
+
+/*
+A short time series of temperature, humidity and pressure for a city, suitable
+for sparklines.
+*/
+type Trend struct {
     Name string `json:"name"`
     CityId int32 `json:"id"`
-    Time int64 `json:"dt"`
-    Weather []WeatherDesc
-    Sys struct {
-        Country string `json:"country"`
-        Sunrise int64 `json:"sunrise"`
-        Sunset int64 `json:"sunset"`
-    } `json:"sys"`
-    Wind struct {
-        Speed float64 `json:"speed"`
-    } `json:"wind"`
-    Main struct {
-        Temperature float64 `json:"temp"`
-        Humidity float64 `json:"humidity"`
-        Pressure float64 `json:"pressure"`
-    } `json:"main"`
-    MainIcon string
-    Comparison string
-    FullDescription string
+    Points []TrendPoint `json:"points"`
 }
 
+// How far, in degrees Celsius, the feels-like temperature must be from the
+// actual temperature before it's worth mentioning.
+const feelsLikeThreshold = 3.0
+
+// The range of sea-level pressures, in hPa, that we consider plausible. The
+// recorded extremes are roughly 870 and 1084 hPa.
+const minPressure = 850.0
+const maxPressure = 1100.0
+
+// The default and maximum number of hourly points returned by the trend API.
+const defaultTrendPoints = 24
+const maxTrendPoints = 72
+
+// The number of hourly points shown on the weather page's graph.
+const hourlyGraphPoints = 24
+
+// Returns the current time. Everything that depends on the time, such as cache
+// expiry or whether readings are stale, reads it through this so that tests
+// can fix the clock. Measuring how long something took uses the real clock.
+var now func() time.Time = time.Now
+
+// The default city-name aliases, overridable with the ALIASES_FILE variable.
+//go:embed aliases.json
+var defaultAliases []byte
+
 /*
-A list of weather data points.
+The weather server, holding its configuration and everything loaded from it:
+  - config: The configuration the server was created with
+  - weather: Where the weather is looked up
+  - http: The HTTP client for upstream requests, which the weather provider
+    and the other providers share
+  - health: The weather provider's recent health, reported by /status
+  - templates: The parsed page templates
+  - aliases: Maps lowercased city names to the query to use instead
+  - format: The unit labels and rounding used to display readings
+  - geoip: Locates clients for /weather/here, or nil if that's disabled
+  - vapidKey: The key used to sign push notifications, if they're enabled
+  - pushes: The push notification subscriptions
+  - cache: Recently looked-up weather
+  - histories: Recently fetched history for comparisons
+  - refreshes: The weather last fetched for each city, for MIN_REFRESH
+  - recent: The cities whose comparisons are kept warm in histories
+  - quotas: Each client's request count for the day
+
+None of these change once the server is created, so handlers may read them
+concurrently without locking. Any state that handlers write to, such as the
+push subscriptions or the caches, must be guarded by its own mutex.
 */
-type WeatherList struct {
-    List []WeatherData `json:"list"`
+type Server struct {
+    config *Config
+    weather provider.WeatherProvider
+    http *http.Client
+    health *provider.Health
+    templates *template.Template
+    aliases map[string]string
+    format UnitFormat
+    geoip GeoIPResolver
+    vapidKey *ecdsa.PrivateKey
+    pushes *PushStore
+    cache *Cache[WeatherData]
+    histories *Cache[provider.List]
+    refreshes *RefreshTracker
+    recent *recentViews
+    quotas *QuotaStore
+    providers []ReadingProvider
+    metrics *Metrics
 }
 
-var templates = template.Must(template.ParseFiles("index.html", "weather.html", "notfound.html"))
+// The names of the page templates, parsed from the configured directory (the
+// working directory by default) at startup.
+var templateNames = []string{"index.html", "weather.html", "notfound.html", "error.html", "maintenance.html", "digest.html", "compare.html", "choose.html", "widget.html", "forecast.html"}
+
 var validPath = regexp.MustCompile("^/(weather)/([a-zA-Z0-9 ,]+)$")
 
+// API paths may be versioned as /api/v1/weather/; the unversioned paths are
+// the same version and stay for existing clients.
+var validTrendPath = regexp.MustCompile("^/api(?:/v1)?/weather/([a-zA-Z0-9 ,]+)/trend$")
+var validAPIPath = regexp.MustCompile("^/api(?:/v1)?/weather/([a-zA-Z0-9 ,]+)$")
+var validForecastPath = regexp.MustCompile("^/api(?:/v1)?/weather/([a-zA-Z0-9 ,]+)/forecast$")
+var validCompareDatePath = regexp.MustCompile("^/api(?:/v1)?/weather/([a-zA-Z0-9 ,]+)/compare$")
+
+// Returned by lookupWeather when no city matches the query. It's the weather
+// provider's error, so an upstream 404 matches it too.
+var errCityNotFound = provider.ErrCityNotFound
+var errInvalidPage = errors.New("Invalid Page")
+
 // Given a URL, returns the city portion of it and an error if it occurs.
-func getCity(w http.ResponseWriter, r *http.Request) (string, error) {
+func getCity(r *http.Request) (string, error) {
     m := validPath.FindStringSubmatch(r.URL.Path)
     if m == nil {
-        return "", errors.New("Invalid Page")
+        return "", errInvalidPage
     }
 
     // First subexpression is "weather"; city is second
     return m[2], nil
 }
 
+// Parses a JSON object of aliases into a map keyed by lowercased alias.
+func parseAliases(buf []byte) (map[string]string, error) {
+    var raw map[string]string
+    err := json.Unmarshal(buf, &raw)
+    if err != nil {
+        return nil, err
+    }
+
+    var parsed map[string]string = make(map[string]string, len(raw))
+    for alias, query := range raw {
+        parsed[strings.ToLower(strings.TrimSpace(alias))] = query
+    }
+    return parsed, nil
+}
+
+// Loads the alias table from the given file, or from the embedded defaults if
+// no file is given.
+func loadAliases(path string) (map[string]string, error) {
+    var buf []byte = defaultAliases
+    if path != "" {
+        var err error
+        buf, err = ioutil.ReadFile(path)
+        if err != nil {
+            return nil, err
+        }
+    }
+    return parseAliases(buf)
+}
+
+// Returns the query to use for a city, substituting an alias if one exists.
+func (s *Server) resolveAlias(city string) string {
+    if query, ok := s.aliases[strings.ToLower(strings.TrimSpace(city))]; ok {
+        return query
+    }
+    return city
+}
+
 // Returns a human-readable string that will be grammatically correct for the
-// sentences we are constructing.
-func getWeatherDescription(weather WeatherDesc) string {
-    switch weather.Id {
-        case 200, 230: return "thunderstorms with light rain"
-        case 201, 231: return "thunderstorms with rain"
-        case 202, 232: return "thunderstorms with heavy rain"
-        case 210: return "light thunderstorms"
-        case 211: return "thunderstorms"
-        case 212: return "heavy thunderstorms"
-        case 221: return "ragged thunderstorms"
-        case 300, 310: return "light drizzle"
-        case 301, 311: return "drizzling rain"
-        case 302, 312: return "heavy drizzle"
-        case 313, 321: return "showers"
-        case 502, 314, 521: return "heavy rain"
-        case 520, 522: return "light showers"
-        case 531: return "ragged showers"
-        case 620: return "light rain and snow"
-        case 621: return "rain and snow"
-        case 622: return "heavy rain and snow"
-        case 731: return "sand and dust whirls"
-        case 781: return "tornadoes"
-        case 800: return "clear skies"
-        case 801: return "a few clouds"
-        case 803: return "some broken clouds"
-        case 804: return "overcast skies"
-        case 900: return "tornadoes"
-        case 901: return "tropical storms"
-        case 902, 962: return "hurricane conditions"
-        case 903: return "extreme cold"
-        case 904: return "extreme heat"
-        case 905: return "extreme winds"
-        case 906: return "extreme hail"
-        case 951: return "calm weather"
-        case 952: return "light breezes"
-        case 953: return "gentle breezes"
-        case 954: return "moderate breezes"
-        case 955: return "fresh breezes"
-        case 956: return "strong breezes"
-        case 958: return "windy, gale-like conditions"
-        case 959: return "severe gales"
-        case 960: return "storms"
-        case 961: return "violent storms"
-        default: return weather.Description
+// sentences we are constructing, from the curated phrases for each condition
+// ID. Our phrasing is English only, so for other languages, or conditions
+// without a phrase, the upstream description is used as-is.
+func getWeatherDescription(weather provider.WeatherDesc, lang string) string {
+    if lang != "en" {
+        return weather.Description
+    }
+    if phrase, ok := conditionPhrases.get(weather.Id); ok {
+        return phrase
+    }
+    return weather.Description
+}
+
+// Names a place the upstream returned without a name, as happens for some
+// coordinate lookups, by its coordinates such as "40.56°N, 74.46°W", or by the
+// query if those are missing too.
+func getFallbackName(datum WeatherData, query string) string {
+    if datum.Coord.Lat == 0 && datum.Coord.Lon == 0 {
+        return query
+    }
+    var ns, ew string = "N", "E"
+    if datum.Coord.Lat < 0 {
+        ns = "S"
+    }
+    if datum.Coord.Lon < 0 {
+        ew = "W"
+    }
+    return fmt.Sprintf("%.2f°%s, %.2f°%s", math.Abs(datum.Coord.Lat), ns, math.Abs(datum.Coord.Lon), ew)
+}
+
+// Returns whether a reading taken at 'dt' (seconds since the epoch) is older
+// than 'staleAfter' as of 'now'.
+func isStale(dt int64, now time.Time, staleAfter time.Duration) bool {
+    return now.Sub(time.Unix(dt, 0)) > staleAfter
+}
+
+// Clamps the humidity to 0-100% and flags implausible pressures, logging a
+// warning for any reading that was out of range.
+func sanitizeReadings(datum *WeatherData) {
+    if datum.Main.Humidity < 0 || datum.Main.Humidity > 100 {
+        log.Printf("Warning: humidity of %v%% for %s is out of range, clamping", datum.Main.Humidity, datum.Name)
+        datum.Main.Humidity = clampFloat(datum.Main.Humidity, 0, 100)
+    }
+    if datum.Main.Pressure < minPressure || datum.Main.Pressure > maxPressure {
+        log.Printf("Warning: pressure of %v hPa for %s is implausible", datum.Main.Pressure, datum.Name)
+        datum.PressureImplausible = true
+    }
+}
+
+// Returns a sentence noting that it feels colder or warmer than it is, or an
+// empty string if the difference is below feelsLikeThreshold. The
+// temperatures are in the given unit system.
+func getFeelsLikeNote(temperature, feelsLike float64, units string, labels UnitFormat) string {
+    var diff, threshold float64 = feelsLike - temperature, feelsLikeThreshold
+    if units == "imperial" {
+        threshold = threshold * 9 / 5
+    }
+    if math.Abs(diff) < threshold {
+        return ""
+    }
+
+    var reason string = "due to the wind"
+    if diff > 0 {
+        reason = "due to the humidity"
+    }
+    return fmt.Sprintf("It's %s but feels like %s %s.",
+        labels.temperature(temperature, units), labels.temperature(feelsLike, units), reason)
+}
+
+// Converts looked-up weather, which is in metric, to the unit system it's to be
+// shown in, rewording the sentences that give temperatures to match.
+func (s *Server) convertForDisplay(datum WeatherData, units string) WeatherData {
+    if units == "metric" {
+        return datum
+    }
+    datum = convertUnits(datum, units)
+    datum.FeelsLikeNote = getFeelsLikeNote(datum.Main.Temperature, datum.Main.FeelsLike, datum.Units, s.format)
+    if datum.ComparisonDetail != nil {
+        datum.Comparison = getComparisonSentence(*datum.ComparisonDetail, datum.Units, s.format)
+    }
+    if datum.SeasonalNormal != nil {
+        datum.SeasonalNote = getSeasonalNote(datum.Main.Temperature, *datum.SeasonalNormal, s.config.SimilarBand, datum.Units, s.format)
+    }
+    if datum.NarrativeDetail != nil {
+        datum.Narrative = getNarrativeSentence(*datum.NarrativeDetail, datum.Units, s.format)
+    }
+    return datum
+}
+
+// Ranks a weather condition by how significant it is, from 0 for clear skies
+// up to extreme weather, based on its condition group.
+func getSeverity(weather provider.WeatherDesc) int {
+    switch {
+        case weather.Id == 781, weather.Id >= 900 && weather.Id <= 906: return 8
+        case weather.Id >= 957 && weather.Id <= 962: return 7
+        case weather.Id >= 200 && weather.Id < 300: return 6
+        case weather.Id >= 600 && weather.Id < 700: return 5
+        case weather.Id >= 500 && weather.Id < 600: return 4
+        case weather.Id >= 300 && weather.Id < 400: return 3
+        case weather.Id >= 700 && weather.Id < 800: return 2
+        case weather.Id > 800 && weather.Id < 900: return 1
+        default: return 0
+    }
+}
+
+// Returns the most significant of a list of weather conditions, which should
+// drive the icon. Ties go to the condition listed first.
+func getPrimaryCondition(weather []provider.WeatherDesc) provider.WeatherDesc {
+    var primary provider.WeatherDesc
+    for i, desc := range weather {
+        if i == 0 || getSeverity(desc) > getSeverity(primary) {
+            primary = desc
+        }
+    }
+    return primary
+}
+
+// Returns whether it was daytime when a reading was taken: between sunrise and
+// sunset if those are known, or between 06:00 and 18:00 local time if not.
+func isDaytime(datum WeatherData) bool {
+    if polar := getPolarState(datum); polar != "" {
+        return polar == "day"
+    } else if datum.Sys.Sunrise != 0 && datum.Sys.Sunset != 0 {
+        return datum.Time >= datum.Sys.Sunrise && datum.Time < datum.Sys.Sunset
+    }
+    var hour int = cityTime(datum.Time, datum.Timezone).Hour()
+    return hour >= 6 && hour < 18
+}
+
+// Returns "day" if the sun doesn't set today, "night" if it doesn't rise, or
+// an empty string otherwise. Near the poles the upstream reports a sunset a day
+// or more after sunrise during polar day, and equal or missing times when the
+// sun doesn't rise or set at all; the day/night suffix of the upstream icon
+// tells those apart.
+func getPolarState(datum WeatherData) string {
+    var sunrise, sunset int64 = datum.Sys.Sunrise, datum.Sys.Sunset
+    if sunset - sunrise >= 24 * 60 * 60 {
+        return "day"
+    } else if sunrise != sunset && sunrise != 0 && sunset != 0 {
+        return ""
+    }
+
+    for _, weather := range datum.Weather {
+        if strings.HasSuffix(weather.Icon, "d") {
+            return "day"
+        } else if strings.HasSuffix(weather.Icon, "n") {
+            return "night"
+        }
+    }
+    return ""
+}
+
+// Formats a time of day on a "12h" clock, such as "6:30 AM", or otherwise on a
+// 24-hour clock, such as "06:30".
+func formatClock(t time.Time, clock string) string {
+    if clock == "12h" {
+        return t.Format("3:04 PM")
+    }
+    return t.Format("15:04")
+}
+
+// Formats the times of sunrise and sunset in the city's local time on the
+// reading's clock, such as "06:12 – 19:48", or describes polar day or night
+// when the sun doesn't rise or set today. Returns an empty string if the times
+// are unknown.
+func formatSunTimes(datum WeatherData) string {
+    switch getPolarState(datum) {
+        case "day": return "sun does not set today"
+        case "night": return "polar night"
+    }
+    if datum.Sys.Sunrise == 0 || datum.Sys.Sunset == 0 {
+        return ""
+    }
+    return formatClock(cityTime(datum.Sys.Sunrise, datum.Timezone), datum.Clock) + " – " +
+        formatClock(cityTime(datum.Sys.Sunset, datum.Timezone), datum.Clock)
+}
+
+// Returns the code of the OpenWeatherMap icon for a condition, such as "10d"
+// for rain during the day.
+func getIconCode(weather provider.WeatherDesc, daytime bool) string {
+    var code string
+    switch {
+        case weather.Id >= 200 && weather.Id < 300: code = "11"
+        case weather.Id >= 300 && weather.Id < 400: code = "09"
+        case weather.Id == 511, weather.Id >= 600 && weather.Id < 700: code = "13"
+        case weather.Id >= 520 && weather.Id < 600: code = "09"
+        case weather.Id >= 500 && weather.Id < 600: code = "10"
+        case weather.Id >= 700 && weather.Id < 800: code = "50"
+        case weather.Id == 801: code = "02"
+        case weather.Id == 802: code = "03"
+        case weather.Id == 803, weather.Id == 804: code = "04"
+        default: code = "01"
+    }
+    if daytime {
+        return code + "d"
+    }
+    return code + "n"
+}
+
+// Returns the icon for the most significant condition, deriving it from the
+// condition and the time of day if the upstream didn't supply one. Readings
+// without any conditions have no icon, rather than a misleading clear sky.
+func getMainIcon(datum WeatherData) string {
+    if len(datum.Weather) == 0 {
+        return ""
+    }
+    var primary provider.WeatherDesc = getPrimaryCondition(datum.Weather)
+    if primary.Icon != "" {
+        return primary.Icon
+    }
+    return getIconCode(primary, isDaytime(datum))
+}
+
+// Returns the URL of the OpenWeatherMap image for an icon code, such as "10d".
+func getIconURL(code string) string {
+    return "https://openweathermap.org/img/wn/" + url.PathEscape(code) + "@2x.png"
+}
+
+// Derives a condition for a reading that came without any, so the page isn't
+// left blank: snow or rain if any fell, or otherwise the cloud cover, using the
+// upstream's own IDs and thresholds. Returns false if there's nothing to go on.
+func getFallbackCondition(datum WeatherData) (provider.WeatherDesc, bool) {
+    if _, _, ok := getPrecipitationWindow(datum.Snow); ok {
+        return provider.WeatherDesc{Id: 600, Type: "Snow", Description: "light snow"}, true
+    } else if _, _, ok := getPrecipitationWindow(datum.Rain); ok {
+        return provider.WeatherDesc{Id: 500, Type: "Rain", Description: "light rain"}, true
+    } else if datum.Clouds == nil {
+        return provider.WeatherDesc{}, false
+    }
+    switch {
+        case datum.Clouds.All > 84: return provider.WeatherDesc{Id: 804, Type: "Clouds", Description: "overcast clouds"}, true
+        case datum.Clouds.All > 50: return provider.WeatherDesc{Id: 803, Type: "Clouds", Description: "broken clouds"}, true
+        case datum.Clouds.All > 24: return provider.WeatherDesc{Id: 802, Type: "Clouds", Description: "scattered clouds"}, true
+        case datum.Clouds.All > 10: return provider.WeatherDesc{Id: 801, Type: "Clouds", Description: "few clouds"}, true
+        default: return provider.WeatherDesc{Id: 800, Type: "Clear", Description: "clear sky"}, true
     }
 }
 
+// Returns the numeric IDs of a list of weather conditions, in order.
+func getConditionIds(weather []provider.WeatherDesc) []int {
+    var ids []int = make([]int, len(weather))
+    for i, desc := range weather {
+        ids[i] = desc.Id
+    }
+    return ids
+}
+
+// The full description of a reading that came without any conditions.
+const noConditions = "no data available"
+
 // Given a list of weather descriptions, return their combination in a
-// properly-punctuated fashion.
-func getFullWeatherDescription(weather []WeatherDesc) string {
+// properly-punctuated fashion, or noConditions if there are none.
+func getFullWeatherDescription(weather []provider.WeatherDesc, lang string) string {
     var descs []string = make([]string, len(weather))
     for i := 0; i < len(weather); i = i + 1 {
-        descs[i] = getWeatherDescription(weather[i])
+        descs[i] = getWeatherDescription(weather[i], lang)
     }
-    if len(descs) == 1 {
+    if len(descs) == 0 {
+        return noConditions
+    } else if len(descs) == 1 {
         return descs[0]
     } else {
         return strings.Join(descs[:len(descs)-1], ", ") + " and " + descs[len(descs)-1]
     }
 }
 
-// Renders the template found at 'templates/${tmpl}.html'.
-func renderTemplate(w http.ResponseWriter, tmpl string, data interface{}) {
-    var err error = templates.ExecuteTemplate(w, tmpl+".html", data)
+// Parses all of the page templates found in the given directory, formatting
+// values with the given unit format. With 'coarse', temperatures are shown to
+// the nearest five degrees.
+func loadTemplates(dir string, format UnitFormat, coarse bool) (*template.Template, error) {
+    var paths []string = make([]string, len(templateNames))
+    for i, name := range templateNames {
+        paths[i] = filepath.Join(dir, name)
+    }
+    var temperature func(float64, string) string = format.temperature
+    if coarse {
+        temperature = format.coarseTemperature
+    }
+    return template.New("").Funcs(template.FuncMap{
+        "temperature": temperature,
+        "speed": format.speed,
+        "pressure": format.pressure,
+        "visibility": format.visibility,
+        "precipitation": format.precipitation,
+        "sparkline": sparkline,
+        "sunTimes": formatSunTimes,
+        "iconURL": getIconURL,
+    }).ParseFiles(paths...)
+}
+
+// Renders the template found at '${TEMPLATE_DIR}/${tmpl}.html' with the given
+// status. The page is rendered in full before anything is written, so that if
+// the template fails the visitor gets a clean 500 rather than half a page.
+func (s *Server) renderTemplate(w http.ResponseWriter, status int, tmpl string, data interface{}) {
+    var buf bytes.Buffer
+    var err error = s.templates.ExecuteTemplate(&buf, tmpl+".html", data)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        log.Fatal(err)
+        log.Printf("Error rendering %s: %v", tmpl, err)
+        http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+        return
     }
+    w.WriteHeader(status)
+    buf.WriteTo(w)
 }
 
-func handleIndex(w http.ResponseWriter, r *http.Request) {
-    renderTemplate(w, "index", nil)
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+    s.renderTemplate(w, http.StatusOK, "index", s.getFeaturedCities(now()))
 }
 
-func handleNotFound(w http.ResponseWriter, r *http.Request) {
-    renderTemplate(w, "notfound", nil)
+func (s *Server) handleNotFound(w http.ResponseWriter, r *http.Request) {
+    s.renderNotFound(w, r, http.StatusOK)
 }
 
-func handleWeather(w http.ResponseWriter, r *http.Request) {
-    var city string
-    var data WeatherList
-    var resp *http.Response
-    var err error
+// Redirects to a target within this site. Targets with a scheme or host, or
+// that browsers would treat as one ("//evil.com", "/\evil.com"), are
+// replaced with the index page so that redirects can't be used to send users
+// elsewhere.
+func safeRedirect(w http.ResponseWriter, r *http.Request, target string, code int) {
+    http.Redirect(w, r, sanitizeRedirect(target), code)
+}
+
+// Returns the target if it's a path on this site, or "/" if it isn't.
+func sanitizeRedirect(target string) string {
+    u, err := url.Parse(target)
+    if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+        return "/"
+    } else if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+        return "/"
+    }
+    return target
+}
+
+// Redirects a search with no city to the home city's page if one is
+// configured, or to the index otherwise.
+func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
+    var target string = "/"
+    if s.config.HomeCity != "" {
+        target = "/weather/" + url.PathEscape(s.config.HomeCity)
+    }
+    safeRedirect(w, r, target, http.StatusFound)
+}
+
+// Reports that the server is up.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain")
+    w.Write([]byte("ok\n"))
+}
+
+// Wraps a handler so that, in maintenance mode, every page other than the
+// health and status checks and static files is replaced with the maintenance
+// page.
+func (s *Server) withMaintenance(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !s.config.Maintenance || r.URL.Path == "/healthz" || r.URL.Path == "/status" || r.URL.Path == "/metrics" || strings.HasPrefix(r.URL.Path, "/include/") {
+            h.ServeHTTP(w, r)
+            return
+        }
+        w.Header().Set("Retry-After", "600")
+        if strings.HasPrefix(r.URL.Path, "/api/") {
+            writeAPIError(w, r, http.StatusServiceUnavailable, errors.New("down for maintenance"))
+            return
+        }
+        s.renderTemplate(w, http.StatusServiceUnavailable, "maintenance", nil)
+    })
+}
+
+// Returns the clock to show times on: the request's 'clock' parameter, "12h"
+// or "24h", or the configured default.
+func (s *Server) getClock(r *http.Request) string {
+    if clock := r.URL.Query().Get("clock"); clock == "12h" || clock == "24h" {
+        return clock
+    }
+    return s.config.Clock
+}
+
+// Looks up the weather for the city in the path, for the weather page. The
+// readings are shown in the unit system given by 'units', or DEFAULT_UNITS.
+func (s *Server) handleWeather(r *http.Request) (interface{}, int, error) {
+    // Coordinates share the weather page's path, which the mux can't tell
+    // apart from a widget's
+    if m := validCoordsPath.FindStringSubmatch(r.URL.Path); m != nil {
+        return s.handleCoords(r, m)
+    }
 
     // Validate the city name
-    city, err = getCity(w, r)
+    city, err := getCity(r)
     if err != nil {
-        http.Redirect(w, r, "/notfound.html", http.StatusNotFound)
-        return
+        return nil, http.StatusNotFound, err
     }
 
-    // Query the OpenWeatherMap endpoint
-    resp, err = http.Get("http://api.openweathermap.org/data/2.5/find?q=" + city + "&units=metric")
+    units, err := parseUnits(r.URL.Query(), s.config.DefaultUnits)
     if err != nil {
-        log.Fatal(err)
-        return
+        return nil, http.StatusBadRequest, err
+    }
+
+    var opts lookupOptions = s.getLookupOptions(r)
+    opts.Disambiguate = true
+    datum, err := s.lookupWeather(city, opts)
+    var ambiguous *AmbiguousError
+    if errors.As(err, &ambiguous) {
+        return getDisambiguation(city, ambiguous.Matches, s.config.MaxCandidates), http.StatusOK, nil
+    } else if err != nil {
+        return nil, lookupStatus(err), err
+    }
+
+    // Readings are looked up and compared in metric, and only converted for
+    // display, so the comparison means the same whatever the units
+    datum = s.convertForDisplay(datum, units)
+    datum.Clock = s.getClock(r)
+    return datum, http.StatusOK, nil
+}
+
+/*
+Per-request options for lookupWeather:
+  - Langs: The description languages to try, in order
+  - SkipComparison: Don't compare with yesterday, which saves an upstream
+    request for latency-sensitive clients
+  - Reference: What in yesterday's weather to compare with, one of
+    comparisonReferences
+  - Disambiguate: Return an AmbiguousError rather than picking the best match
+    when a search matches several cities
+  - CityID: Look up the city with this ID rather than searching by name
+  - Timings: Where the time spent on the lookup is added, if anywhere
+  - Context: Carries the request's time budget, if it has one, which upstream
+    requests are cut off at
+  - Refresh: Skip the cache and fetch again, though still no more often than
+    MIN_REFRESH
+*/
+type lookupOptions struct {
+    Langs []string
+    SkipComparison bool
+    Reference string
+    Disambiguate bool
+    CityID int32
+    Timings *Timings
+    Context context.Context
+    Refresh bool
+}
+
+// Reads the lookup options from a request: 'lang', or else the
+// Accept-Language header, for the description language, 'comparison=0' to
+// skip the comparison, 'reference' for what to compare with, 'id' for a city
+// chosen from a list of candidates and 'refresh=true' to skip the cache.
+func (s *Server) getLookupOptions(r *http.Request) lookupOptions {
+    var query url.Values = r.URL.Query()
+    var opts lookupOptions = lookupOptions{
+        Langs: s.getRequestLangs(r),
+        SkipComparison: query.Get("comparison") == "0",
+        Reference: "hour",
+        Timings: getTimings(r),
+        Context: r.Context(),
+        Refresh: query.Get("refresh") == "true",
+    }
+    if reference := query.Get("reference"); comparisonReferences[reference] {
+        opts.Reference = reference
     }
-    defer resp.Body.Close()
+    if id, err := strconv.ParseInt(query.Get("id"), 10, 32); err == nil && id > 0 {
+        opts.CityID = int32(id)
+    }
+    return opts
+}
 
-    // Read in the JSON response
-    var buf []byte
-    buf, err = ioutil.ReadAll(resp.Body)
+// Looks up the current weather for a city, resolving aliases and trying each
+// of the given languages, and fills in the fields derived for display. Recent
+// lookups are served from the cache, and a city fetched within MIN_REFRESH
+// isn't fetched again.
+func (s *Server) lookupWeather(city string, opts lookupOptions) (WeatherData, error) {
+    if opts.Timings == nil {
+        opts.Timings = &Timings{}
+    }
+    city = s.resolveAlias(city)
+    var key string = cacheKey(city, opts)
+    if opts.Refresh {
+        log.Printf("Cache bypassed for %q", key)
+    } else {
+        var start time.Time = time.Now()
+        datum, ok := s.cache.get(key, now())
+        opts.Timings.Cache = opts.Timings.Cache + time.Since(start)
+        if ok {
+            log.Printf("Cache hit for %q", key)
+            return datum, nil
+        }
+        log.Printf("Cache miss for %q", key)
+    }
+    // The comparison is timed separately inside, so it's taken out again here
+    var start time.Time = time.Now()
+    var comparison time.Duration = opts.Timings.Comparison
+    datum, err := s.fetchWeather(city, opts)
+    opts.Timings.Upstream = opts.Timings.Upstream + time.Since(start) - (opts.Timings.Comparison - comparison)
     if err != nil {
-        log.Fatal(err)
-        return
+        return WeatherData{}, err
+    } else if datum.Partial {
+        // Don't keep serving the cut-down reading once there's time for more
+        return datum, nil
+    }
+    s.cache.set(key, datum, now())
+    return datum, nil
+}
+
+// Searches for a city in each language of the chain in turn, moving on to the
+// next if the first result's descriptions come back empty. Returns the data
+// along with the language it's in.
+func (s *Server) findCityInLanguage(ctx context.Context, city string, langs []string) (provider.List, string, error) {
+    var data provider.List
+    var lang string
+    var err error
+    for _, lang = range langs {
+        data, err = s.weather.Current(ctx, city, lang)
+        if err != nil || len(data.List) == 0 || hasDescriptions(data.List[0]) {
+            break
+        }
+        log.Printf("No %q descriptions for %q, falling back", lang, city)
+    }
+    return data, lang, err
+}
+
+// Returns whether every weather condition has a non-empty description.
+func hasDescriptions(datum provider.Observation) bool {
+    for _, weather := range datum.Weather {
+        if strings.TrimSpace(weather.Description) == "" {
+            return false
+        }
+    }
+    return true
+}
+
+// Fetches the current weather for an already-resolved city and compares it as
+// 'opts' asks. The reading itself is fetched from upstream at most once every
+// MIN_REFRESH for each city and language, while the comparison, which differs
+// between lookups that share a reading, is added to each lookup afresh.
+func (s *Server) fetchWeather(city string, opts lookupOptions) (WeatherData, error) {
+    var ctx context.Context = opts.Context
+    if ctx == nil {
+        ctx = context.Background()
+    }
+    var refresh string = refreshKey(city, opts)
+    datum, ok := s.refreshes.recent(refresh, s.config.MinRefresh, now())
+    if !ok {
+        var err error
+        datum, err = s.fetchReading(ctx, city, opts)
+        if err != nil {
+            return WeatherData{}, err
+        } else if !datum.Partial {
+            s.refreshes.record(refresh, datum, s.config.MinRefresh, now())
+        }
     }
 
-    // Unmarshaling
-    err = json.Unmarshal(buf, &data)
+    if opts.SkipComparison || datum.Partial {
+        return datum, nil
+    } else if !s.hasBudgetLeft(opts.Context) {
+        log.Printf("Time budget nearly spent for %q, leaving out the comparison", city)
+        datum.Partial = true
+        return datum, nil
+    }
+    var start time.Time = time.Now()
+    datum.ComparisonDetail, datum.RecordHigh, datum.RecordLow = s.getComparison(ctx, datum, opts.Reference)
+    if datum.ComparisonDetail != nil {
+        datum.Comparison = getComparisonSentence(*datum.ComparisonDetail, "metric", s.format)
+    }
+    if s.config.SeasonalYears > 0 {
+        datum.SeasonalNormal = s.getSeasonalComparison(ctx, datum)
+        if datum.SeasonalNormal != nil {
+            datum.SeasonalNote = getSeasonalNote(datum.Main.Temperature, *datum.SeasonalNormal, s.config.SimilarBand, "metric", s.format)
+        }
+    }
+    if s.config.DayAverage {
+        datum.DayAverageNote = s.getDayAverageComparison(ctx, datum)
+    }
+    opts.Timings.Comparison = opts.Timings.Comparison + time.Since(start)
+    return datum, nil
+}
+
+// Fetches the current weather for an already-resolved city from upstream,
+// along with everything shown with it that doesn't depend on the comparison.
+func (s *Server) fetchReading(ctx context.Context, city string, opts lookupOptions) (WeatherData, error) {
+    // Query the weather provider
+    var data provider.List
+    var lang string
+    var err error
+    if opts.CityID != 0 {
+        lang = opts.Langs[0]
+        data, err = s.weather.CurrentByID(ctx, opts.CityID, lang)
+    } else {
+        data, lang, err = s.findCityInLanguage(ctx, city, opts.Langs)
+    }
     if err != nil {
-        log.Fatal(err)
-        return
+        return WeatherData{}, err
+    } else if opts.Disambiguate && len(data.List) > 1 {
+        return WeatherData{}, &AmbiguousError{data.List}
     }
 
-    // If no data, then city not found
+    // If no data, then try somewhere nearby or give up
+    var substitution string
+    if len(data.List) == 0 && s.config.NearbyFallback {
+        data, err = s.weather.Nearby(ctx, city, lang)
+        if err != nil {
+            return WeatherData{}, err
+        } else if len(data.List) > 0 {
+            substitution = fmt.Sprintf("Showing weather for nearby %s.", data.List[0].Name)
+        }
+    }
     if len(data.List) == 0 {
-        http.Redirect(w, r, "/notfound.html", http.StatusNotFound)
-        return
+        return WeatherData{}, errCityNotFound
     }
 
     // Data sanitization and adjustments for the HTML template
-    var datum WeatherData = data.List[0]
-    datum.Comparison = getComparison(datum)
-    datum.FullDescription = getFullWeatherDescription(datum.Weather)
-    datum.Main.Temperature = math.Floor(datum.Main.Temperature + 0.5)
-    datum.MainIcon = datum.Weather[0].Icon
+    var datum WeatherData = WeatherData{Observation: data.List[0]}
+    if strings.TrimSpace(datum.Name) == "" {
+        datum.Name = getFallbackName(datum, city)
+    }
+    datum.Substitution = substitution
+    datum.Units = "metric"
+    sanitizeReadings(&datum)
+    if len(datum.Weather) == 0 && s.config.ConditionFallback {
+        if condition, ok := getFallbackCondition(datum); ok {
+            datum.Weather = []provider.WeatherDesc{condition}
+        }
+    }
+
+    // The rest is optional, so it's left out rather than risk the whole page
+    // once most of the time budget is spent
+    var enrich bool = s.hasBudgetLeft(opts.Context)
+    if !enrich {
+        log.Printf("Time budget nearly spent for %q, leaving out optional data", city)
+        datum.Partial = true
+    }
+    if len(s.providers) > 1 && enrich {
+        var start time.Time = time.Now()
+        s.mergeReadings(opts.Context, "openweathermap", &datum)
+        opts.Timings.Upstream = opts.Timings.Upstream + time.Since(start)
+    }
+    datum.FullDescription = getFullWeatherDescription(datum.Weather, lang)
+    datum.WindDescription = getWindDescription(datum.Wind.Speed, "metric")
+    datum.FeelsLikeNote = getFeelsLikeNote(datum.Main.Temperature, datum.Main.FeelsLike, "metric", s.format)
+    datum.MainIcon = getMainIcon(datum)
+    datum.ConditionIds = getConditionIds(datum.Weather)
+    datum.Stale = isStale(datum.Time, now(), s.config.StaleAfter)
+
+    // Fetch the last day's temperatures for the graph
+    if s.config.HourlyGraph && enrich {
+        history, err := s.weather.Historical(ctx, datum.CityId, time.Unix(datum.Time - hourlyGraphPoints * 3600, 0), provider.Hourly, hourlyGraphPoints)
+        if err != nil {
+            log.Printf("Couldn't get hourly data for %q: %v", city, err)
+        } else {
+            datum.Hourly = getTrend(history, hourlyGraphPoints)
+        }
+    }
+
+    // Describe the rest of the day from the forecast, if we can
+    if enrich {
+        forecast, err := s.weather.ForecastByID(ctx, datum.CityId)
+        if err != nil {
+            log.Printf("Couldn't get the forecast for %q: %v", city, err)
+        } else {
+            datum.NarrativeDetail = getNarrative(forecast.List, forecast.City.Timezone)
+            if datum.NarrativeDetail != nil {
+                datum.Narrative = getNarrativeSentence(*datum.NarrativeDetail, "metric", s.format)
+            }
+        }
+    }
+    return datum, nil
+}
 
-    // Render a template
-    renderTemplate(w, "weather", datum)
+// Converts a Unix timestamp to a time in a city's local zone, given the city's
+// offset from UTC in seconds. Timestamps stay in UTC everywhere else and are
+// only converted with this for display, so the server's own zone never leaks
+// into the output.
+func cityTime(unix int64, offset int) time.Time {
+    return time.Unix(unix, 0).In(time.FixedZone("", offset))
 }
 
-// Takes today's weather and returns a comparison string determining whether or
-// not it is warmer or cooler than yesterday.
-func getComparison(todayData WeatherData) string {
-    var resp *http.Response
+/*
+A structured comparison of the current temperature with yesterday's:
+  - Diff: The current temperature minus yesterday's, in degrees Celsius
+  - Direction: One of "warmer", "cooler" or "similar"
+  - Magnitude: One of "none", "slight", "moderate" or "large"
+  - Today, Yesterday: What to call now and the reading compared with, such as
+    "This evening" and "last night", for phrasing the comparison
+*/
+type Comparison struct {
+    Diff float64 `json:"diff" xml:"diff"`
+    Direction string `json:"direction" xml:"direction"`
+    Magnitude string `json:"magnitude" xml:"magnitude"`
+    Today string `json:"-" xml:"-"`
+    Yesterday string `json:"-" xml:"-"`
+}
+
+// Takes today's weather and compares it with yesterday's, fetched within
+// 'ctx', returning nil if yesterday's data is unavailable or the city is on
+// the comparison denylist. The reference chooses what to compare against:
+// "hour" for the same hour yesterday, "high" for yesterday's high or "morning"
+// for yesterday morning. Also returns whether today is a record high or low
+// for the historical window.
+func (s *Server) getComparison(ctx context.Context, todayData WeatherData, reference string) (*Comparison, bool, bool) {
     var err error
-    var data WeatherList
-
-    // Query the historical data endpoint
-    // Grab data for this city ID exactly 24 hr (86400 sec) ago
-    var cityID int32 = todayData.CityId
-    var yesterdayTime int64 = todayData.Time - 86400
-    var apiString = fmt.Sprintf("http://api.openweathermap.org/data/2.5/history/city?id=%d&start=%d&type=hour&cnt=3", cityID, yesterdayTime)
-    resp, err = http.Get(apiString)
-    if err != nil {
-        log.Printf("Couldn't get yesterday's data - querying failed.")
-        log.Printf("%v", err)
-        return ""
-    }
-    defer resp.Body.Close()
+    var data provider.List
 
-    // Read JSON
-    var buf []byte
-    buf, err = ioutil.ReadAll(resp.Body)
-    if err != nil {
-        log.Printf("Couldn't get yesterday's data - reading JSON failed.")
-        log.Printf("%v", err)
-        return ""
+    // Some cities have no usable history, so don't keep asking
+    if s.config.ComparisonDenylist[strconv.Itoa(int(todayData.CityId))] || s.config.ComparisonDenylist[strings.ToLower(todayData.Name)] {
+        return nil, false, false
     }
 
-    // Unmarshal
-    err = json.Unmarshal(buf, &data)
+    // Query the historical data endpoint for the reference's window
+    data, err = s.getComparisonHistory(ctx, todayData, reference)
     if err != nil {
-        log.Printf("Couldn't get yesterday's data - unmarshaling failed.")
+        log.Printf("Couldn't get yesterday's data.")
         log.Printf("%v", err)
-        return ""
+        return nil, false, false
     } else if len(data.List) == 0 {
         log.Printf("API response found no data for yesterday :(")
-        return ""
+        return nil, false, false
     }
 
-    // Select only the first entry
-    var datum WeatherData = data.List[0]
-
-    // Figure out whether it's daytime or nighttime
-    var today, yesterday string
-    var hour = time.Unix(todayData.Time, 0).Hour()
-    if hour >= 22 || hour < 5 {
-        // 22:00 - 04:59
-        today = "Tonight"
-        yesterday = "last night"
-    } else if hour >= 5 && hour < 12 {
-        // 05:00 - 11:59
-        today = "Today"
-        yesterday = "yesterday"
-    } else if hour >= 12 && hour < 18 {
-        // 12:00 - 17:59
-        today = "This afternoon"
-        yesterday = "yesterday"
-    } else {
-        // 18:00 - 21:59
-        today = "This evening"
-        yesterday = "last night"
+    var datum provider.Observation = getReferenceSample(data, reference, s.config.HistoryType)
+
+    // Figure out whether it's daytime or nighttime where the city is
+    today, yesterday := getComparisonDayPart(cityTime(todayData.Time, todayData.Timezone))
+    switch reference {
+        case "high": yesterday = "yesterday's high"
+        case "morning": yesterday = "yesterday morning"
+    }
+
+    // Check for records over the whole HISTORY_COUNT window, which a
+    // reference such as the morning only fetches part of with hourly history
+    var window provider.List = data
+    if reference != "hour" && s.config.HistoryType == "hour" {
+        window, err = s.getComparisonHistory(ctx, todayData, "hour")
+        if err != nil {
+            log.Printf("Couldn't get the history window for records: %v", err)
+        }
     }
+    var recordHigh, recordLow bool = getRecord(todayData.Main.Temperature, window)
 
     // Get yesterday's temperature, converting from K to C
     var diff float64 = todayData.Main.Temperature - datum.Main.Temperature + 273.15
     log.Printf("Detected temperature difference from yesterday: %f", diff)
-    if diff < -5 {
+    var comparison Comparison = compareTemperatures(diff, s.config.SimilarBand)
+    comparison.Today, comparison.Yesterday = today, yesterday
+    return &comparison, recordHigh, recordLow
+}
+
+// Names the part of the day a time falls in for a comparison, such as "This
+// afternoon", along with the same part of the day before, such as
+// "yesterday". The time should already be in the city's zone; see cityTime.
+func getComparisonDayPart(local time.Time) (string, string) {
+    switch getDayPart(local.Hour()) {
+        case "morning": return "Today", "yesterday"
+        case "afternoon": return "This afternoon", "yesterday"
+        case "evening": return "This evening", "last night"
+        default: return "Tonight", "last night"
+    }
+}
+
+// The points in yesterday's weather that today's may be compared against.
+var comparisonReferences = map[string]bool{"hour": true, "high": true, "morning": true}
+
+// Returns the window of history to fetch for a comparison reference, as a
+// start time and a number of samples. With hourly history that's 'count' hours
+// from this time yesterday, the whole of yesterday in the city's time zone for
+// its high, or 09:00 yesterday for the morning. With daily history it's the
+// 'count' days up to and including yesterday, whatever the reference.
+func getReferenceWindow(today WeatherData, reference, historyType string, count int) (int64, int) {
+    var local time.Time = cityTime(today.Time, today.Timezone)
+    if historyType == "day" {
+        return time.Date(local.Year(), local.Month(), local.Day()-count, 0, 0, 0, 0, local.Location()).Unix(), count
+    }
+    switch reference {
+        case "high": return time.Date(local.Year(), local.Month(), local.Day()-1, 0, 0, 0, 0, local.Location()).Unix(), 24
+        case "morning": return time.Date(local.Year(), local.Month(), local.Day()-1, 9, 0, 0, 0, local.Location()).Unix(), 1
+        default: return today.Time - 86400, count
+    }
+}
+
+// Picks the sample to compare against from a reference's window: yesterday's,
+// the last, for daily history; the warmest for "high"; or otherwise the first.
+func getReferenceSample(history provider.List, reference, historyType string) provider.Observation {
+    var sample provider.Observation = history.List[0]
+    if historyType == "day" {
+        sample = history.List[len(history.List)-1]
+    } else if reference == "high" {
+        for _, datum := range history.List {
+            if datum.Main.Temperature > sample.Main.Temperature {
+                sample = datum
+            }
+        }
+    }
+    return sample
+}
+
+// Classifies a temperature difference in degrees Celsius by its direction and
+// magnitude. Differences within 'similarBand' either way are similar. The
+// difference is classified as it is, and only rounded to hundredths to be
+// served.
+func compareTemperatures(diff, similarBand float64) Comparison {
+    var direction, magnitude string
+    if diff >= -similarBand && diff < similarBand {
+        // [-band, band)
+        direction, magnitude = "similar", "none"
+    } else if diff < -5 {
         // (-inf, -5)
-        return today + " is much cooler than " + yesterday + "."
+        direction, magnitude = "cooler", "large"
     } else if diff < -2.5 {
         // [-5, -2.5)
-        return today + " is cooler than " + yesterday + "."
-    } else if diff < -1.0 {
-        // [-2.5, -1.0)
-        return today + " is slightly cooler than " + yesterday + "."
-    } else if diff < 1.0 {
-        // [-1.0, 1.0)
-        return today + "'s temperature is similar to " + yesterday + "."
+        direction, magnitude = "cooler", "moderate"
+    } else if diff < 0 {
+        // [-2.5, -band)
+        direction, magnitude = "cooler", "slight"
     } else if diff < 2.5 {
-        // [1.0, 2.5)
-        return today + " is slightly warmer than " + yesterday + "."
+        // [band, 2.5)
+        direction, magnitude = "warmer", "slight"
     } else if diff < 5.0 {
         // [2.5, 5.0)
-        return today + " is warmer than " + yesterday + "."
+        direction, magnitude = "warmer", "moderate"
     } else {
         // [5.0, inf)
-        return today + " is much warmer than " + yesterday + "."
+        direction, magnitude = "warmer", "large"
     }
+    return Comparison{Diff: roundHundredths(diff), Direction: direction, Magnitude: magnitude}
 }
 
-// Returns the minimum of two integers.
-func min(x, y int) int {
-    if x < y {
-        return x
-    } else {
-        return y
+// Phrases a comparison as a sentence with the difference in the given unit
+// system, such as "Today is 5°F warmer than yesterday." A difference too small
+// to show in whole degrees is only "slightly" warmer or cooler.
+func getComparisonSentence(comparison Comparison, units string, format UnitFormat) string {
+    var today, yesterday string = comparison.Today, comparison.Yesterday
+    var change float64 = math.Abs(convertTemperatureChange(comparison.Diff, units))
+    if comparison.Magnitude == "none" {
+        return today + "'s temperature is similar to " + yesterday + "."
+    } else if roundWhole(change, format.Rounding) == 0 {
+        return today + " is slightly " + comparison.Direction + " than " + yesterday + "."
+    }
+    return today + " is " + format.temperature(change, units) + " " + comparison.Direction + " than " + yesterday + "."
+}
+
+// Determines whether a temperature in Celsius is higher than every sample in a
+// historical window, or lower than every sample. History is in Kelvin.
+func getRecord(temperature float64, history provider.List) (bool, bool) {
+    if len(history.List) == 0 {
+        return false, false
+    }
+
+    var high, low float64 = math.Inf(-1), math.Inf(1)
+    for _, datum := range history.List {
+        high = math.Max(high, datum.Main.Temperature - 273.15)
+        low = math.Min(low, datum.Main.Temperature - 273.15)
+    }
+    return temperature > high, temperature < low
+}
+
+// Returns the average temperature in Celsius of the samples so far today,
+// which are in Kelvin, and whether there were any.
+func getDayAverage(today provider.List) (float64, bool) {
+    if len(today.List) == 0 {
+        return 0, false
+    }
+    var sum float64
+    for _, datum := range today.List {
+        sum = sum + datum.Main.Temperature - 273.15
+    }
+    return sum / float64(len(today.List)), true
+}
+
+// Phrases how a temperature compares with the day's average so far, such as
+// "It's currently warmer than earlier today."
+func getDayAverageNote(temperature, average, similarBand float64) string {
+    var diff float64 = temperature - average
+    if diff >= similarBand {
+        return "It's currently warmer than earlier today."
+    } else if diff <= -similarBand {
+        return "It's currently cooler than earlier today."
     }
+    return "It's about as warm as it has been all day."
+}
+
+// Compares a reading with the average of the hourly samples since midnight in
+// the city, fetched within 'ctx', returning an empty string if there are none
+// yet.
+func (s *Server) getDayAverageComparison(ctx context.Context, today WeatherData) string {
+    var local time.Time = cityTime(today.Time, today.Timezone)
+    var midnight time.Time = time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+    var hours int = int(local.Sub(midnight).Hours())
+    if hours < 1 {
+        return ""
+    }
+
+    history, err := s.weather.Historical(ctx, today.CityId, midnight, provider.Hourly, hours)
+    if err != nil {
+        log.Printf("Couldn't get today's history for %q: %v", today.Name, err)
+        return ""
+    }
+    average, ok := getDayAverage(history)
+    if !ok {
+        return ""
+    }
+    return getDayAverageNote(today.Main.Temperature, average, s.config.SimilarBand)
+}
+
+// Returns the ordered, de-duplicated list of trusted languages to try for a
+// request: the requested languages, most preferred first, the deployment
+// default, then English.
+func (s *Server) getLangChain(requested ...string) []string {
+    var chain []string
+    var seen map[string]bool = make(map[string]bool)
+    for _, lang := range append(requested, s.config.DefaultLang, "en") {
+        lang = strings.ToLower(lang)
+        if s.config.TrustedLangs[lang] && !seen[lang] {
+            chain = append(chain, lang)
+            seen[lang] = true
+        }
+    }
+    return chain
+}
+
+// Returns the languages to try for a request: its 'lang' query parameter,
+// then those in its Accept-Language header; see getLangChain.
+func (s *Server) getRequestLangs(r *http.Request) []string {
+    var requested []string = []string{r.URL.Query().Get("lang")}
+    return s.getLangChain(append(requested, parseAcceptLanguage(r.Header.Get("Accept-Language"))...)...)
+}
+
+/*
+A language accepted by a request and how much it's preferred:
+  - lang: The primary language subtag, such as "fr" for "fr-CH"
+  - q: The weight, from 0 to 1
+*/
+type acceptedLang struct {
+    lang string
+    q float64
+}
+
+// Parses an Accept-Language header such as "fr-CH, fr;q=0.9, en;q=0.8" into
+// its primary language subtags, most preferred first. Languages with a
+// weight of zero and the "*" wildcard are left out.
+func parseAcceptLanguage(header string) []string {
+    var prefs []acceptedLang
+    for _, part := range strings.Split(header, ",") {
+        var fields []string = strings.Split(part, ";")
+        var tag string = strings.TrimSpace(fields[0])
+        var q float64 = 1
+        for _, param := range fields[1:] {
+            if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+                parsed, err := strconv.ParseFloat(value, 64)
+                if err != nil {
+                    parsed = 0
+                }
+                q = parsed
+            }
+        }
+        if tag == "" || tag == "*" || q <= 0 {
+            continue
+        }
+        lang, _, _ := strings.Cut(tag, "-")
+        prefs = append(prefs, acceptedLang{strings.ToLower(lang), q})
+    }
+    sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+    var langs []string = make([]string, len(prefs))
+    for i, pref := range prefs {
+        langs[i] = pref.lang
+    }
+    return langs
+}
+
+// Builds a chronologically-ordered series of at most 'count' points from a
+// list of historical data points, converting temperatures from K to C and
+// rounding them to hundredths to hide floating-point noise.
+func getTrend(history provider.List, count int) []TrendPoint {
+    var points []TrendPoint = make([]TrendPoint, 0, len(history.List))
+    for _, datum := range history.List {
+        points = append(points, TrendPoint{datum.Time, roundHundredths(datum.Main.Temperature - 273.15), datum.Main.Humidity, datum.Main.Pressure})
+    }
+    sort.Slice(points, func(i, j int) bool { return points[i].Time < points[j].Time })
+
+    // Keep only the most recent points
+    return points[len(points)-min(count, len(points)):]
+}
+
+// Returns the coordinates of a line graph of the given points, scaled to fill
+// a width x height box, as an SVG polyline "points" attribute.
+func sparkline(points []TrendPoint, width, height int) string {
+    if len(points) < 2 {
+        return ""
+    }
+
+    var low, high float64 = points[0].Temperature, points[0].Temperature
+    for _, point := range points {
+        low = math.Min(low, point.Temperature)
+        high = math.Max(high, point.Temperature)
+    }
+
+    var coords []string = make([]string, len(points))
+    for i, point := range points {
+        var x float64 = float64(i) * float64(width) / float64(len(points)-1)
+        var y float64 = float64(height) / 2
+        if high > low {
+            y = float64(height) * (high - point.Temperature) / (high - low)
+        }
+        coords[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+    }
+    return strings.Join(coords, " ")
+}
+
+// Creates a server from the given configuration, loading the unit labels,
+// templates and aliases it names.
+func newServer(config *Config) (*Server, error) {
+    var s *Server = &Server{
+        config: config,
+        format: UnitFormat{defaultUnitLabels, config.Rounding},
+        pushes: newPushStore(config.MaxPushSubscriptions),
+        cache: newCache[WeatherData](config.CacheTTL, config.CacheMaxEntries),
+        histories: newCache[provider.List](config.CacheTTL, config.CacheMaxEntries),
+        refreshes: newRefreshTracker(),
+        recent: newRecentViews(),
+        quotas: newQuotaStore(),
+        metrics: newMetrics(),
+    }
+    var err error
+    if config.UnitLabelsFile != "" {
+        s.format.UnitLabels, err = loadUnitLabels(config.UnitLabelsFile)
+        if err != nil {
+            return nil, fmt.Errorf("invalid unit labels in %s: %v", config.UnitLabelsFile, err)
+        }
+    }
+    s.templates, err = loadTemplates(config.TemplateDir, s.format, config.CoarseTemperature)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't load templates: %v", err)
+    }
+    if config.ConditionsFile != "" {
+        err = conditionPhrases.load(config.ConditionsFile)
+        if err != nil {
+            return nil, fmt.Errorf("invalid condition phrases in %s: %v", config.ConditionsFile, err)
+        }
+    }
+    s.aliases, err = loadAliases(config.AliasesFile)
+    if err != nil {
+        return nil, fmt.Errorf("couldn't load city aliases: %v", err)
+    }
+    s.http, err = newUpstreamClient(config)
+    if err != nil {
+        return nil, err
+    }
+    s.health = &provider.Health{}
+    s.weather = newOpenWeatherMap(config, s.http, s.health, s.metrics)
+    if config.VAPIDPrivateKey != "" {
+        s.vapidKey, err = parseVAPIDKey(config.VAPIDPrivateKey)
+        if err != nil {
+            return nil, fmt.Errorf("invalid VAPID_PRIVATE_KEY: %v", err)
+        }
+    }
+    s.providers = newReadingProviders(config, s.weather, s.http)
+    if config.GeoIPURL != "" {
+        s.geoip = newHTTPGeoIP(config.GeoIPURL)
+    }
+    if config.CachePersist {
+        err = s.cache.load(config.CacheFile, now())
+        if err != nil {
+            log.Printf("Couldn't restore the cache from %s: %v", config.CacheFile, err)
+        }
+    }
+    return s, nil
+}
+
+// Returns the handler for all of the server's routes.
+func (s *Server) routes() http.Handler {
+    var mux *http.ServeMux = http.NewServeMux()
+    mux.HandleFunc("/", s.handleIndex)
+    mux.HandleFunc("/weather/{$}", s.handleHome)
+    mux.HandleFunc("/weather/", s.page("weather", s.handleWeather))
+    mux.HandleFunc("/weather/here", s.page("weather", s.handleHere))
+    mux.HandleFunc("/weather/{city}/widget", s.handleWidget)
+    mux.HandleFunc("/forecast/{city}", s.page("forecast", s.handleForecast))
+    mux.HandleFunc("/notfound/", s.handleNotFound)
+    mux.HandleFunc("/compare", s.page("compare", s.handleCompare))
+    mux.HandleFunc("/api/weather/", s.handleAPI)
+    mux.HandleFunc("/api/v1/weather/", s.handleAPI)
+    mux.HandleFunc("/api/weather", s.api(s.handleAPICoords))
+    mux.HandleFunc("/api/v1/weather", s.api(s.handleAPICoords))
+    mux.HandleFunc("/api/conditions", s.api(s.handleConditions))
+    mux.HandleFunc("/healthz", handleHealth)
+    mux.HandleFunc("/status", s.handleStatus)
+    mux.HandleFunc("/metrics", s.handleMetrics)
+    if s.config.AdminToken != "" && s.config.ConditionsFile != "" {
+        mux.HandleFunc("/admin/reload/conditions", s.api(s.handleReloadConditions))
+    }
+    if s.vapidKey != nil {
+        mux.HandleFunc("/push/key", s.handlePushKey)
+        mux.HandleFunc("/push/subscribe", s.handlePushSubscribe)
+    }
+    mux.Handle("/include/", http.StripPrefix("/include/", staticFiles("include")))
+    return s.withMetrics(mux, s.withRecovery(s.withMaintenance(s.withQuota(mux))))
 }
 
 func main() {
-    http.HandleFunc("/", handleIndex)
-    http.HandleFunc("/weather/", handleWeather)
-    http.HandleFunc("/notfound/", handleNotFound)
-    http.Handle("/include/", http.StripPrefix("/include/", http.FileServer(http.Dir("include"))))
+    // Some settings may be given as flags where they can't be put in the
+    // environment, but the environment wins
+    var flags map[string]*string = map[string]*string{
+        "OWM_API_KEY": flag.String("apikey", "", "the OpenWeatherMap API key, if OWM_API_KEY isn't set"),
+        "LISTEN_ADDR": flag.String("addr", "", "the address to listen on, if LISTEN_ADDR isn't set"),
+        "PORT": flag.String("port", "", "the port to listen on, if PORT isn't set"),
+        "CONFIG_FILE": flag.String("config", "", "a file of settings, if CONFIG_FILE isn't set"),
+    }
+    flag.Parse()
+    config, err := loadConfig(func(key string) string {
+        if value := os.Getenv(key); value != "" || flags[key] == nil {
+            return value
+        }
+        return *flags[key]
+    })
+    if err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+    server, err := newServer(config)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    // Check the upstream API is usable before accepting requests
+    if config.SelfTest {
+        if err = selfTest(server.weather, config.SelfTestCity); err == nil {
+            log.Printf("Self-test passed: looked up %q", config.SelfTestCity)
+        } else if config.SelfTestRequired {
+            log.Fatalf("Self-test failed, refusing to start: %v", err)
+        } else {
+            log.Printf("Self-test failed: %v", err)
+        }
+    }
+
+    // Watch subscribed cities for changes worth a push notification
+    if server.vapidKey != nil {
+        go server.runPushChecker(config.PushInterval)
+    }
+
+    // Keep the featured cities cached for the index, refreshing them before
+    // they expire
+    if len(config.FeaturedCities) > 0 && config.CacheTTL > 0 {
+        go server.runFeaturedWarmer(config.CacheTTL / 2)
+    }
+
+    // Keep recently viewed cities' comparisons warm
+    if config.PrefetchInterval > 0 {
+        go server.runPrefetcher(config.PrefetchInterval)
+    }
 
     // Start the server
-    http.ListenAndServe(":8080", nil)
+    var srv *http.Server = &http.Server{
+        Addr: net.JoinHostPort(config.ListenAddr, strconv.Itoa(config.Port)),
+        Handler: server.routes(),
+        ReadHeaderTimeout: 5 * time.Second,
+        ReadTimeout: 10 * time.Second,
+        WriteTimeout: config.WriteTimeout,
+        IdleTimeout: 2 * time.Minute,
+    }
+    log.Printf("Listening on %s", srv.Addr)
+    go func() {
+        err := srv.ListenAndServe()
+        if err != nil && err != http.ErrServerClosed {
+            log.Fatal(err)
+        }
+    }()
+
+    // Finish in-flight requests on SIGINT or SIGTERM, then save the cache. No
+    // response may take longer than the write timeout, so that's long enough
+    var stop chan os.Signal = make(chan os.Signal, 1)
+    signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+    <-stop
+    log.Printf("Shutting down")
+    ctx, cancel := context.WithTimeout(context.Background(), config.WriteTimeout)
+    defer cancel()
+    if err = srv.Shutdown(ctx); err != nil {
+        log.Printf("Couldn't shut down cleanly: %v", err)
+    }
+    if config.CachePersist {
+        if err = server.cache.save(config.CacheFile, now()); err != nil {
+            log.Printf("Couldn't save the cache to %s: %v", config.CacheFile, err)
+        }
+    }
 }
@@ -0,0 +1,1091 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/ksuarz/weather/provider"
+)
+
+func TestFullWeatherDescription(t *testing.T) {
+    var rain provider.WeatherDesc = provider.WeatherDesc{Id: 0, Description: "rain"}
+    var mist provider.WeatherDesc = provider.WeatherDesc{Id: 0, Description: "mist"}
+    var wind provider.WeatherDesc = provider.WeatherDesc{Id: 0, Description: "wind"}
+    var tests = []struct {
+        weather []provider.WeatherDesc
+        want string
+    }{
+        {nil, noConditions},
+        {[]provider.WeatherDesc{}, noConditions},
+        {[]provider.WeatherDesc{rain}, "rain"},
+        {[]provider.WeatherDesc{rain, mist}, "rain and mist"},
+        {[]provider.WeatherDesc{rain, mist, wind}, "rain, mist and wind"},
+    }
+    for _, test := range tests {
+        if got := getFullWeatherDescription(test.weather, "en"); got != test.want {
+            t.Errorf("getFullWeatherDescription(%v) = %q, want %q", test.weather, got, test.want)
+        }
+    }
+}
+
+func TestFallbackCondition(t *testing.T) {
+    var volume float64 = 0.5
+    var tests = []struct {
+        clouds *provider.CloudCover
+        rain *provider.Precipitation
+        snow *provider.Precipitation
+        want int
+        ok bool
+    }{
+        {nil, nil, nil, 0, false},
+        {&provider.CloudCover{All: 90}, nil, nil, 804, true},
+        {&provider.CloudCover{All: 60}, nil, nil, 803, true},
+        {&provider.CloudCover{All: 30}, nil, nil, 802, true},
+        {&provider.CloudCover{All: 15}, nil, nil, 801, true},
+        {&provider.CloudCover{All: 5}, nil, nil, 800, true},
+        {&provider.CloudCover{All: 90}, &provider.Precipitation{OneHour: &volume}, nil, 500, true},
+        {nil, &provider.Precipitation{OneHour: &volume}, &provider.Precipitation{ThreeHours: &volume}, 600, true},
+    }
+    for _, test := range tests {
+        var datum WeatherData
+        datum.Clouds, datum.Rain, datum.Snow = test.clouds, test.rain, test.snow
+        got, ok := getFallbackCondition(datum)
+        if got.Id != test.want || ok != test.ok {
+            t.Errorf("clouds %v: got %d, %v, want %d, %v", test.clouds, got.Id, ok, test.want, test.ok)
+        }
+    }
+}
+
+// The icon comes from the most severe of several conditions, whatever order
+// they're listed in, with ties going to the first.
+func TestPrimaryCondition(t *testing.T) {
+    var clouds provider.WeatherDesc = provider.WeatherDesc{Id: 803, Description: "broken clouds", Icon: "04d"}
+    var rain provider.WeatherDesc = provider.WeatherDesc{Id: 501, Description: "moderate rain", Icon: "10d"}
+    var drizzle provider.WeatherDesc = provider.WeatherDesc{Id: 300, Description: "drizzle", Icon: "09d"}
+    var storm provider.WeatherDesc = provider.WeatherDesc{Id: 211, Description: "thunderstorm", Icon: "11d"}
+    var mist provider.WeatherDesc = provider.WeatherDesc{Id: 701, Description: "mist", Icon: "50d"}
+    var haze provider.WeatherDesc = provider.WeatherDesc{Id: 721, Description: "haze", Icon: "50d"}
+    var tests = []struct {
+        weather []provider.WeatherDesc
+        want provider.WeatherDesc
+    }{
+        {[]provider.WeatherDesc{clouds, storm}, storm},
+        {[]provider.WeatherDesc{storm, clouds}, storm},
+        {[]provider.WeatherDesc{clouds, drizzle, rain}, rain},
+        {[]provider.WeatherDesc{mist, clouds}, mist},
+        {[]provider.WeatherDesc{mist, haze}, mist},
+        {[]provider.WeatherDesc{clouds}, clouds},
+    }
+    for _, test := range tests {
+        if got := getPrimaryCondition(test.weather); got != test.want {
+            t.Errorf("getPrimaryCondition(%v) = %v, want %v", test.weather, got, test.want)
+        }
+        var datum WeatherData
+        datum.Weather = test.weather
+        if got := getMainIcon(datum); got != test.want.Icon {
+            t.Errorf("getMainIcon(%v) = %q, want %q", test.weather, got, test.want.Icon)
+        }
+    }
+}
+
+// Without upstream icons, the icon is derived from the most severe condition
+// and whether it was day or night where the city is.
+func TestDerivedIcon(t *testing.T) {
+    var weather []provider.WeatherDesc = []provider.WeatherDesc{{Id: 803}, {Id: 501}, {Id: 211}, {Id: 701}}
+    var sunrise int64 = time.Date(2024, 5, 1, 5, 30, 0, 0, time.UTC).Unix()
+    var sunset int64 = time.Date(2024, 5, 1, 20, 15, 0, 0, time.UTC).Unix()
+    var tests = []struct {
+        time time.Time
+        sunrise int64
+        sunset int64
+        timezone int
+        want string
+    }{
+        {time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC), sunrise, sunset, 0, "11n"},
+        {time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC), sunrise, sunset, 0, "11n"},
+        {time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), sunrise, sunset, 0, "11d"},
+        {time.Date(2024, 5, 1, 20, 15, 0, 0, time.UTC), sunrise, sunset, 0, "11n"},
+        // Without sun times, night is 18:00 to 06:00 in the city
+        {time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), 0, 0, 8 * 3600, "11n"},
+        {time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), 0, 0, -4 * 3600, "11d"},
+    }
+    for _, test := range tests {
+        var datum WeatherData
+        datum.Weather = weather
+        datum.Time = test.time.Unix()
+        datum.Sys.Sunrise, datum.Sys.Sunset = test.sunrise, test.sunset
+        datum.Timezone = test.timezone
+        if got := getMainIcon(datum); got != test.want {
+            t.Errorf("%v at %+d: icon %q, want %q", test.time, test.timezone, got, test.want)
+        }
+    }
+}
+
+// A place the upstream returns without a name is titled by its coordinates,
+// or by the query when it has none.
+func TestFallbackName(t *testing.T) {
+    var tests = []struct {
+        name string
+        lat float64
+        lon float64
+        want string
+    }{
+        {"", 51.5074, -0.1278, "51.51°N, 0.13°W"},
+        {"  ", -33.87, 151.21, "33.87°S, 151.21°E"},
+        {"", 0, 0, "Somewhere"},
+        {"London", 51.5074, -0.1278, "London"},
+    }
+    for _, test := range tests {
+        var s *Server = newTestServer(t, nil)
+        var mock http.RoundTripper = s.http.Transport
+        stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+            if strings.HasSuffix(req.URL.Path, "/find") {
+                return stubResponse(req, http.StatusOK, fmt.Sprintf(`{"list":[{"name":%q,"id":1,"dt":1714564800,` +
+                    `"coord":{"lat":%v,"lon":%v},"main":{"temp":12}}]}`, test.name, test.lat, test.lon)), nil
+            }
+            return mock.RoundTrip(req)
+        })
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/weather/Somewhere")
+        if w.Code != http.StatusOK {
+            t.Fatalf("%q at %v, %v: status %d", test.name, test.lat, test.lon, w.Code)
+        }
+        if !strings.Contains(w.Body.String(), "<title>" + test.want + " - goweather</title>") {
+            t.Errorf("%q at %v, %v: page isn't titled %q:\n%s", test.name, test.lat, test.lon, test.want, w.Body)
+        }
+    }
+}
+
+func TestClamp(t *testing.T) {
+    if clampInt(0, 1, 5) != 1 || clampInt(9, 1, 5) != 5 || clampInt(3, 1, 5) != 3 {
+        t.Error("clampInt doesn't limit to the range")
+    }
+    if clampFloat(-1, 0, 100) != 0 || clampFloat(101, 0, 100) != 100 || clampFloat(50.5, 0, 100) != 50.5 {
+        t.Error("clampFloat doesn't limit to the range")
+    }
+}
+
+// Sunrise and sunset are shown in the city's time, whatever the server's.
+func TestSunTimesAreLocal(t *testing.T) {
+    var datum WeatherData
+    datum.Sys.Sunrise = time.Date(2024, 5, 1, 4, 12, 0, 0, time.UTC).Unix()
+    datum.Sys.Sunset = time.Date(2024, 5, 1, 19, 48, 0, 0, time.UTC).Unix()
+    datum.Timezone = -4 * 3600
+    if got, want := formatSunTimes(datum), "00:12 – 15:48"; got != want {
+        t.Errorf("formatSunTimes = %q, want %q", got, want)
+    }
+    datum.Clock = "12h"
+    if got, want := formatSunTimes(datum), "12:12 AM – 3:48 PM"; got != want {
+        t.Errorf("formatSunTimes on a 12-hour clock = %q, want %q", got, want)
+    }
+    datum.Sys.Sunrise, datum.Sys.Sunset = 0, 0
+    if got := formatSunTimes(datum); got != "" {
+        t.Errorf("formatSunTimes with no sun times = %q", got)
+    }
+}
+
+// Near the poles, a sunset a day or more after sunrise is polar day, and equal
+// times are polar day or night by the icon; neither is shown as a time.
+func TestPolarSunTimes(t *testing.T) {
+    var sunrise int64 = time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC).Unix()
+    var tests = []struct {
+        sunrise int64
+        sunset int64
+        icon string
+        want string
+        daytime bool
+    }{
+        {sunrise, sunrise + 24 * 3600, "01n", "sun does not set today", true},
+        {sunrise, sunrise + 48 * 3600, "", "sun does not set today", true},
+        {sunrise, sunrise, "13n", "polar night", false},
+        {sunrise, sunrise, "13d", "sun does not set today", true},
+        {0, 0, "04n", "polar night", false},
+        {sunrise + 3 * 3600, sunrise + 21 * 3600, "01d", "03:00 – 21:00", true},
+    }
+    for _, test := range tests {
+        var datum WeatherData
+        datum.Time = sunrise + 12 * 3600
+        datum.Sys.Sunrise, datum.Sys.Sunset = test.sunrise, test.sunset
+        datum.Weather = []provider.WeatherDesc{{Id: 800, Icon: test.icon}}
+        if got := formatSunTimes(datum); got != test.want {
+            t.Errorf("sun %d to %d with %q: %q, want %q", test.sunrise, test.sunset, test.icon, got, test.want)
+        }
+        if got := isDaytime(datum); got != test.daytime {
+            t.Errorf("sun %d to %d with %q: daytime = %v, want %v", test.sunrise, test.sunset, test.icon, got, test.daytime)
+        }
+    }
+}
+
+// Times are shown in the city's zone whatever the server's own zone is.
+func TestServerZoneDoesNotLeak(t *testing.T) {
+    var saved *time.Location = time.Local
+    defer func() { time.Local = saved }()
+
+    for _, zone := range []*time.Location{time.UTC, time.FixedZone("JST", 9 * 3600), time.FixedZone("SST", -11 * 3600)} {
+        time.Local = zone
+
+        var datum WeatherData
+        datum.Time = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).Unix()
+        datum.Sys.Sunrise = time.Date(2024, 5, 1, 4, 12, 0, 0, time.UTC).Unix()
+        datum.Sys.Sunset = time.Date(2024, 5, 1, 19, 48, 0, 0, time.UTC).Unix()
+        datum.Timezone = -4 * 3600
+        if got, want := formatSunTimes(datum), "00:12 – 15:48"; got != want {
+            t.Errorf("%s: formatSunTimes = %q, want %q", zone, got, want)
+        }
+        if today, _ := getComparisonDayPart(cityTime(datum.Time, datum.Timezone)); today != "Today" {
+            t.Errorf("%s: 08:00 in the city is %q, want the morning", zone, today)
+        }
+        var want int64 = time.Date(2024, 4, 30, 4, 0, 0, 0, time.UTC).Unix()
+        if start, _ := getReferenceWindow(datum, "high", "hour", 24); start != want {
+            t.Errorf("%s: yesterday starts at %v, want midnight in the city", zone, time.Unix(start, 0).UTC())
+        }
+
+        var forecast provider.Forecast
+        forecast.City.Timezone = datum.Timezone
+        forecast.List = []provider.Observation{{Time: time.Date(2024, 5, 1, 2, 0, 0, 0, time.UTC).Unix()}}
+        if days := getForecastDays(forecast); len(days) != 1 || days[0].Date.Format("2006-01-02") != "2024-04-30" {
+            t.Errorf("%s: 22:00 on the 30th in the city is forecast for %v", zone, days)
+        }
+    }
+}
+
+func TestStaticFiles(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/include/styles.css")
+    if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/css") {
+        t.Errorf("styles.css: status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+    } else if w.Header().Get("Cache-Control") != "public, max-age=3600" {
+        t.Errorf("styles.css: Cache-Control %q", w.Header().Get("Cache-Control"))
+    }
+    for _, path := range []string{"/include/missing.css", "/include/"} {
+        if w = serve(s, http.MethodGet, path); w.Code != http.StatusNotFound {
+            t.Errorf("%s: status %d, want 404", path, w.Code)
+        }
+    }
+    if !fingerprinted.MatchString("/styles.3f2a9c1b.css") || fingerprinted.MatchString("/styles.css") {
+        t.Error("fingerprinted names aren't told apart")
+    }
+}
+
+// Locates every client at the same place, or fails to.
+type fixedGeoIP struct {
+    lat, lon float64
+    err error
+}
+
+func (g fixedGeoIP) locate(ip string) (float64, float64, error) {
+    return g.lat, g.lon, g.err
+}
+
+func TestWeatherHere(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"GEOIP_FALLBACK_CITY": "Paris"})
+    s.geoip = fixedGeoIP{51.51, -0.13, nil}
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/weather/here")
+    if w.Code != http.StatusOK {
+        t.Fatalf("located: status %d", w.Code)
+    }
+
+    // A client that can't be located gets the fallback city
+    s.geoip = fixedGeoIP{err: errNotLocated}
+    if w = serve(s, http.MethodGet, "/weather/here"); w.Code != http.StatusOK {
+        t.Fatalf("not located: status %d", w.Code)
+    }
+}
+
+func TestWidget(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/weather/London/widget")
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d", w.Code)
+    }
+    for _, want := range []string{"London", "7°C", `href="/weather/London"`} {
+        if !strings.Contains(w.Body.String(), want) {
+            t.Errorf("widget has no %q:\n%s", want, w.Body)
+        }
+    }
+    if w = serve(s, http.MethodGet, "/weather/Lon%3Cdon/widget"); w.Code != http.StatusNotFound {
+        t.Errorf("invalid city: status %d, want 404", w.Code)
+    }
+}
+
+func TestWidgetTrendArrow(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var tests = []struct {
+        comparison *Comparison
+        arrow string
+        title string
+    }{
+        {&Comparison{Diff: 3, Direction: "warmer", Magnitude: "moderate"}, "↑", "warmer than yesterday"},
+        {&Comparison{Diff: -3, Direction: "cooler", Magnitude: "moderate"}, "↓", "cooler than yesterday"},
+        {&Comparison{Diff: 0.5, Direction: "similar", Magnitude: "none"}, "→", "about the same as yesterday"},
+        {nil, "", ""},
+    }
+    for _, test := range tests {
+        var datum WeatherData
+        datum.Name, datum.Units, datum.Main.Temperature = "London", "metric", 7
+        datum.ComparisonDetail = test.comparison
+        var widget Widget = getWidget("London", datum)
+        if widget.Arrow != test.arrow {
+            t.Errorf("%+v: arrow %q, want %q", test.comparison, widget.Arrow, test.arrow)
+        }
+
+        var w *httptest.ResponseRecorder = httptest.NewRecorder()
+        s.renderTemplate(w, http.StatusOK, "widget", widget)
+        if test.arrow == "" {
+            if strings.Contains(w.Body.String(), `class="trend"`) {
+                t.Errorf("no comparison, but the widget shows a trend:\n%s", w.Body)
+            }
+        } else if !strings.Contains(w.Body.String(), `title="` + test.title + `">` + test.arrow + `</span>`) {
+            t.Errorf("%+v: widget doesn't show %s titled %q:\n%s", test.comparison, test.arrow, test.title, w.Body)
+        }
+    }
+}
+
+// Lookups of one city that miss the cache with different comparison options
+// share a single fetch of its weather within MIN_REFRESH, but each is compared
+// as it asked. Another language is fetched separately, for its descriptions.
+func TestMinRefresh(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"CACHE_TTL": "10m", "MIN_REFRESH": "1m", "TRUSTED_LANGS": "fr"})
+    var mock http.RoundTripper = s.http.Transport
+    var finds atomic.Int64
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        if strings.HasSuffix(req.URL.Path, "/find") {
+            finds.Add(1)
+        }
+        return mock.RoundTrip(req)
+    })
+
+    var tests = []struct {
+        query string
+        comparison bool
+        finds int64
+    }{
+        {"", true, 1},
+        {"?comparison=0", false, 1},
+        {"?reference=high", true, 1},
+        {"?reference=morning&comparison=0", false, 1},
+        {"?lang=fr", true, 2},
+        {"?lang=fr&comparison=0", false, 2},
+    }
+    for _, test := range tests {
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London" + test.query)
+        if w.Code != http.StatusOK {
+            t.Fatalf("%q: status %d", test.query, w.Code)
+        }
+        var datum map[string]interface{}
+        if err := json.Unmarshal(w.Body.Bytes(), &datum); err != nil {
+            t.Fatalf("%q: %v", test.query, err)
+        }
+        if _, ok := datum["comparison"]; ok != test.comparison {
+            t.Errorf("%q: has a comparison = %v, want %v", test.query, ok, test.comparison)
+        }
+        if got := finds.Load(); got != test.finds {
+            t.Errorf("%q: %d searches upstream so far, want %d", test.query, got, test.finds)
+        }
+    }
+}
+
+// Each reference fetches its own window of yesterday's history and compares
+// with the sample it picks from it: the first of the hours from this time
+// yesterday, the warmest of yesterday or yesterday at 09:00. Today is 15°C at
+// noon.
+func TestComparisonReference(t *testing.T) {
+    var tests = []struct {
+        reference string
+        count string
+        start string
+        history string
+        want string
+    }{
+        {"hour", "3", "1714478400", `[{"dt":1714478400,"main":{"temp":283.15}},{"dt":1714482000,"main":{"temp":287.15}},{"dt":1714485600,"main":{"temp":285.15}}]`, "This afternoon is 5°C warmer than yesterday."},
+        {"high", "24", "1714435200", `[{"dt":1714435200,"main":{"temp":283.15}},{"dt":1714485600,"main":{"temp":293.15}},{"dt":1714507200,"main":{"temp":288.15}}]`, "This afternoon is 5°C cooler than yesterday's high."},
+        {"morning", "1", "1714467600", `[{"dt":1714467600,"main":{"temp":281.15}}]`, "This afternoon is 7°C warmer than yesterday morning."},
+    }
+    for _, test := range tests {
+        var s *Server = newTestServer(t, nil)
+        var starts map[string]string = make(map[string]string)
+        stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+            var query url.Values = req.URL.Query()
+            starts[query.Get("cnt")] = query.Get("start")
+            if query.Get("cnt") != test.count {
+                return stubResponse(req, http.StatusOK, `{"list":[]}`), nil
+            }
+            return stubResponse(req, http.StatusOK, `{"list":` + test.history + `}`), nil
+        })
+
+        var datum WeatherData
+        datum.Name, datum.CityId, datum.Time, datum.Units = "London", 2643743, 1714564800, "metric"
+        datum.Main.Temperature = 15
+        comparison, _, _ := s.getComparison(context.Background(), datum, test.reference)
+        if starts[test.count] != test.start {
+            t.Errorf("%s: fetched %s samples from %q, want from %s", test.reference, test.count, starts[test.count], test.start)
+        }
+        if comparison == nil {
+            t.Errorf("%s: no comparison", test.reference)
+        } else if got := getComparisonSentence(*comparison, "metric", s.format); got != test.want {
+            t.Errorf("%s: %q, want %q", test.reference, got, test.want)
+        }
+    }
+}
+
+// Records are checked against the whole history window, whichever sample the
+// comparison is with. Today is 15°C and yesterday morning was 7°C.
+func TestRecordUsesWholeWindow(t *testing.T) {
+    var tests = []struct {
+        reference string
+        window string
+        high bool
+        low bool
+    }{
+        {"hour", `{"list":[{"dt":1714478400,"main":{"temp":283.15}},{"dt":1714482000,"main":{"temp":284.15}},{"dt":1714485600,"main":{"temp":285.15}}]}`, true, false},
+        {"morning", `{"list":[{"dt":1714478400,"main":{"temp":283.15}},{"dt":1714482000,"main":{"temp":284.15}},{"dt":1714485600,"main":{"temp":285.15}}]}`, true, false},
+        {"morning", `{"list":[{"dt":1714478400,"main":{"temp":283.15}},{"dt":1714482000,"main":{"temp":293.15}},{"dt":1714485600,"main":{"temp":285.15}}]}`, false, false},
+        {"morning", `{"list":[{"dt":1714478400,"main":{"temp":293.15}},{"dt":1714482000,"main":{"temp":294.15}},{"dt":1714485600,"main":{"temp":295.15}}]}`, false, true},
+    }
+    for i, test := range tests {
+        var s *Server = newTestServer(t, nil)
+        stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+            if req.URL.Query().Get("cnt") == "1" {
+                return stubResponse(req, http.StatusOK, `{"list":[{"dt":1714467600,"main":{"temp":280.15}}]}`), nil
+            }
+            return stubResponse(req, http.StatusOK, test.window), nil
+        })
+
+        var datum WeatherData
+        datum.Name, datum.CityId, datum.Time, datum.Units = "London", 2643743, 1714564800, "metric"
+        datum.Main.Temperature = 15
+        comparison, high, low := s.getComparison(context.Background(), datum, test.reference)
+        if comparison == nil {
+            t.Fatalf("%d: no comparison", i)
+        } else if high != test.high || low != test.low {
+            t.Errorf("%d: %s: record high, low = %v, %v, want %v, %v", i, test.reference, high, low, test.high, test.low)
+        }
+    }
+}
+
+func TestHasBudgetLeft(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"REQUEST_BUDGET": "10s"})
+    if !s.hasBudgetLeft(context.Background()) {
+        t.Error("a request with no deadline has no budget left")
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 8 * time.Second)
+    defer cancel()
+    if !s.hasBudgetLeft(ctx) {
+        t.Error("a request with most of its budget has none left")
+    }
+    ctx, cancel = context.WithTimeout(context.Background(), 2 * time.Second)
+    defer cancel()
+    if s.hasBudgetLeft(ctx) {
+        t.Error("a request with under half its budget has some left")
+    }
+}
+
+// When the current weather is slow to arrive, the page still renders the
+// reading within the budget, and leaves out the comparison rather than wait
+// for yesterday's weather too.
+func TestSlowUpstreamDropsComparison(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"REQUEST_BUDGET": "400ms"})
+    var mock http.RoundTripper = s.http.Transport
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London")
+    var fast WeatherData
+    if err := json.Unmarshal(w.Body.Bytes(), &fast); err != nil || fast.Comparison == "" {
+        t.Fatalf("no comparison without a slow upstream: %v\n%s", err, w.Body)
+    }
+
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        if strings.HasSuffix(req.URL.Path, "/find") {
+            time.Sleep(250 * time.Millisecond)
+        }
+        return mock.RoundTrip(req)
+    })
+    var start time.Time = time.Now()
+    w = serve(s, http.MethodGet, "/weather/London?refresh=true")
+    if elapsed := time.Since(start); elapsed >= 400 * time.Millisecond {
+        t.Errorf("took %v, more than the budget", elapsed)
+    }
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d, want 200", w.Code)
+    } else if !strings.Contains(w.Body.String(), "London") || !strings.Contains(w.Body.String(), "7°C") {
+        t.Errorf("page doesn't show the reading:\n%s", w.Body)
+    } else if strings.Contains(w.Body.String(), fast.Comparison) {
+        t.Errorf("page shows the comparison %q", fast.Comparison)
+    }
+}
+
+// The forecast and trend endpoints give up on a hung upstream once the budget
+// is spent.
+func TestAPIForecastAndTrendKeepToBudget(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"REQUEST_BUDGET": "200ms"})
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        <-req.Context().Done()
+        return nil, req.Context().Err()
+    })
+    for _, path := range []string{"/api/weather/London/forecast", "/api/weather/London/trend"} {
+        var start time.Time = time.Now()
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, path)
+        if elapsed := time.Since(start); elapsed >= time.Second {
+            t.Errorf("%s: took %v, well over the budget", path, elapsed)
+        }
+        if w.Code != http.StatusGatewayTimeout {
+            t.Errorf("%s: status %d, want 504", path, w.Code)
+        }
+    }
+}
+
+func TestReloadConditionsNeedsToken(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"ADMIN_TOKEN": "secret", "CONDITIONS_FILE": "conditions.json"})
+    var tests = []struct {
+        method string
+        authorization string
+        want int
+    }{
+        {http.MethodGet, "Bearer secret", http.StatusMethodNotAllowed},
+        {http.MethodPost, "", http.StatusUnauthorized},
+        {http.MethodPost, "Bearer wrong", http.StatusUnauthorized},
+        {http.MethodPost, "Bearer secret", http.StatusOK},
+    }
+    for _, test := range tests {
+        var w *httptest.ResponseRecorder = httptest.NewRecorder()
+        var r *http.Request = httptest.NewRequest(test.method, "/admin/reload/conditions", nil)
+        r.RemoteAddr = "192.0.2.1:1234"
+        r.Header.Set("Authorization", test.authorization)
+        s.routes().ServeHTTP(w, r)
+        if w.Code != test.want {
+            t.Errorf("%s with %q: status %d, want %d", test.method, test.authorization, w.Code, test.want)
+        }
+    }
+}
+
+// Rewriting the phrases file named in CONFIG_FILE and reloading it changes the
+// phrases served, without a restart.
+func TestReloadConditions(t *testing.T) {
+    t.Cleanup(func() { conditionPhrases.load("conditions.json") })
+    var phrases string = filepath.Join(t.TempDir(), "conditions.json")
+    if err := os.WriteFile(phrases, []byte(`{"800": "clear skies"}`), 0600); err != nil {
+        t.Fatal(err)
+    }
+    var s *Server = newTestServer(t, map[string]string{
+        "CONFIG_FILE": writeConfigFile(t, "ADMIN_TOKEN=secret\nCONDITIONS_FILE=" + phrases + "\n"),
+    })
+    if got, _ := conditionPhrases.get(800); got != "clear skies" {
+        t.Fatalf("phrase for 800 at startup = %q, want clear skies", got)
+    }
+
+    if err := os.WriteFile(phrases, []byte(`{"800": "not a cloud in the sky"}`), 0600); err != nil {
+        t.Fatal(err)
+    }
+    var w *httptest.ResponseRecorder = httptest.NewRecorder()
+    var r *http.Request = httptest.NewRequest(http.MethodPost, "/admin/reload/conditions", nil)
+    r.RemoteAddr = "192.0.2.1:1234"
+    r.Header.Set("Authorization", "Bearer secret")
+    s.routes().ServeHTTP(w, r)
+    if w.Code != http.StatusOK {
+        t.Fatalf("reload: status %d: %s", w.Code, w.Body)
+    }
+
+    w = serve(s, http.MethodGet, "/api/conditions")
+    if !strings.Contains(w.Body.String(), `"800":"not a cloud in the sky"`) {
+        t.Errorf("conditions after reload = %s, want the new phrase", w.Body)
+    }
+}
+
+// Aliases are matched case-insensitively and replace the query sent upstream;
+// other names pass through as given.
+func TestAliases(t *testing.T) {
+    var s *Server = newTestServer(t, nil)
+    var tests = []struct {
+        city string
+        want string
+    }{
+        {"NYC", "New York,US"},
+        {"nyc", "New York,US"},
+        {" SF ", "San Francisco,US"},
+        {"Boston", "Boston"},
+        {"New York", "New York"},
+    }
+    for _, test := range tests {
+        if got := s.resolveAlias(test.city); got != test.want {
+            t.Errorf("resolveAlias(%q) = %q, want %q", test.city, got, test.want)
+        }
+    }
+
+    var queries []string
+    var mock http.RoundTripper = s.http.Transport
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        if strings.HasSuffix(req.URL.Path, "/find") {
+            queries = append(queries, req.URL.Query().Get("q"))
+        }
+        return mock.RoundTrip(req)
+    })
+    for _, path := range []string{"/weather/NYC", "/weather/Boston"} {
+        if w := serve(s, http.MethodGet, path); w.Code != http.StatusOK {
+            t.Fatalf("%s: status %d", path, w.Code)
+        }
+    }
+    if got := strings.Join(queries, ";"); got != "New York,US;Boston" {
+        t.Errorf("searched upstream for %q, want New York,US then Boston", got)
+    }
+
+    // ALIASES_FILE replaces the embedded table
+    var path string = filepath.Join(t.TempDir(), "aliases.json")
+    if err := os.WriteFile(path, []byte(`{"Big Apple": "New York,US"}`), 0600); err != nil {
+        t.Fatal(err)
+    }
+    s = newTestServer(t, map[string]string{"ALIASES_FILE": path})
+    if got := s.resolveAlias("big apple"); got != "New York,US" {
+        t.Errorf("resolveAlias(\"big apple\") = %q from ALIASES_FILE", got)
+    }
+    if got := s.resolveAlias("NYC"); got != "NYC" {
+        t.Errorf("resolveAlias(\"NYC\") = %q, want the embedded aliases replaced", got)
+    }
+}
+
+func TestFeelsLikeNote(t *testing.T) {
+    var format UnitFormat = UnitFormat{defaultUnitLabels, "half-up"}
+    var tests = []struct {
+        temperature float64
+        feelsLike float64
+        units string
+        want string
+    }{
+        {5, -2, "metric", "It's 5°C but feels like -2°C due to the wind."},
+        {30, 36, "metric", "It's 30°C but feels like 36°C due to the humidity."},
+        {12, 12, "metric", ""},
+        {12, 9.5, "metric", ""},
+        {12, 9, "metric", "It's 12°C but feels like 9°C due to the wind."},
+        {50, 45, "imperial", ""},
+        {50, 44, "imperial", "It's 50°F but feels like 44°F due to the wind."},
+    }
+    for _, test := range tests {
+        if got := getFeelsLikeNote(test.temperature, test.feelsLike, test.units, format); got != test.want {
+            t.Errorf("getFeelsLikeNote(%v, %v, %q) = %q, want %q", test.temperature, test.feelsLike, test.units, got, test.want)
+        }
+    }
+}
+
+func TestLangChain(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"TRUSTED_LANGS": "fr,de", "DEFAULT_LANG": "de"})
+    var tests = []struct {
+        requested []string
+        want string
+    }{
+        {nil, "de,en"},
+        {[]string{""}, "de,en"},
+        {[]string{"fr"}, "fr,de,en"},
+        {[]string{"FR", "de"}, "fr,de,en"},
+        {[]string{"ja", "en"}, "en,de"},
+        {[]string{"ja"}, "de,en"},
+    }
+    for _, test := range tests {
+        if got := strings.Join(s.getLangChain(test.requested...), ","); got != test.want {
+            t.Errorf("getLangChain(%q) = %q, want %q", test.requested, got, test.want)
+        }
+    }
+}
+
+// A language whose descriptions come back empty is passed over for the next
+// in the chain.
+func TestLangFallback(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"TRUSTED_LANGS": "fr,de", "DEFAULT_LANG": "de"})
+    var tried []string
+    var mock http.RoundTripper = s.http.Transport
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        if !strings.HasSuffix(req.URL.Path, "/find") {
+            return mock.RoundTrip(req)
+        }
+        var lang string = req.URL.Query().Get("lang")
+        tried = append(tried, lang)
+        var description string
+        if lang == "de" {
+            description = "Mäßiger Regen"
+        }
+        return stubResponse(req, http.StatusOK, `{"list":[{"name":"London","id":2643743,"dt":1714564800,` +
+            `"main":{"temp":7.14},"weather":[{"id":501,"main":"Rain","description":"` + description + `"}]}]}`), nil
+    })
+
+    var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/London?lang=fr")
+    var datum WeatherData
+    if err := json.Unmarshal(w.Body.Bytes(), &datum); err != nil {
+        t.Fatalf("status %d: %v", w.Code, err)
+    }
+    if got := strings.Join(tried, ","); got != "fr,de" {
+        t.Errorf("tried %q, want fr then de", got)
+    }
+    if datum.FullDescription != "Mäßiger Regen" {
+        t.Errorf("description = %q, want the German one", datum.FullDescription)
+    }
+}
+
+// In maintenance mode pages and the API answer 503 without going upstream,
+// while the health check still passes.
+func TestMaintenanceMode(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"MAINTENANCE": "1"})
+    var transport *stubTransport = countUpstream(s)
+    var tests = []struct {
+        path string
+        status int
+        body string
+    }{
+        {"/", http.StatusServiceUnavailable, "Down for maintenance."},
+        {"/weather/London", http.StatusServiceUnavailable, "Down for maintenance."},
+        {"/forecast/London", http.StatusServiceUnavailable, "Down for maintenance."},
+        {"/api/weather/London", http.StatusServiceUnavailable, `"code":"unavailable"`},
+        {"/healthz", http.StatusOK, ""},
+    }
+    for _, test := range tests {
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, test.path)
+        if w.Code != test.status {
+            t.Errorf("%s: status %d, want %d", test.path, w.Code, test.status)
+        } else if !strings.Contains(w.Body.String(), test.body) {
+            t.Errorf("%s: body doesn't contain %q:\n%s", test.path, test.body, w.Body)
+        } else if test.status == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+            t.Errorf("%s: no Retry-After", test.path)
+        }
+    }
+    if calls := transport.calls.Load(); calls != 0 {
+        t.Errorf("made %d upstream requests in maintenance mode", calls)
+    }
+}
+
+// Out-of-range humidity is clamped and implausible pressure flagged, each
+// with a logged warning; plausible readings are left alone, silently.
+func TestSanitizeReadings(t *testing.T) {
+    var logs bytes.Buffer
+    log.SetOutput(&logs)
+    defer log.SetOutput(os.Stderr)
+
+    var tests = []struct {
+        humidity float64
+        pressure float64
+        wantHumidity float64
+        wantImplausible bool
+        wantLog string
+    }{
+        {120, 1013, 100, false, "humidity of 120% for London is out of range"},
+        {-5, 1013, 0, false, "humidity of -5% for London is out of range"},
+        {60, -3, 60, true, "pressure of -3 hPa for London is implausible"},
+        {60, 5000, 60, true, "pressure of 5000 hPa for London is implausible"},
+        {60, 1013, 60, false, ""},
+    }
+    for _, test := range tests {
+        logs.Reset()
+        var datum WeatherData
+        datum.Name = "London"
+        datum.Main.Humidity = test.humidity
+        datum.Main.Pressure = test.pressure
+        sanitizeReadings(&datum)
+        if datum.Main.Humidity != test.wantHumidity || datum.PressureImplausible != test.wantImplausible {
+            t.Errorf("%v%%, %v hPa: got %v%% and implausible = %v", test.humidity, test.pressure, datum.Main.Humidity, datum.PressureImplausible)
+        }
+        if test.wantLog == "" && logs.Len() > 0 {
+            t.Errorf("%v%%, %v hPa: logged %q for a plausible reading", test.humidity, test.pressure, logs.String())
+        } else if !strings.Contains(logs.String(), test.wantLog) {
+            t.Errorf("%v%%, %v hPa: logged %q, want a warning containing %q", test.humidity, test.pressure, logs.String(), test.wantLog)
+        }
+    }
+}
+
+// Readings older than STALE_AFTER, three hours by default, are flagged and
+// carry a warning on the page.
+func TestStaleReadings(t *testing.T) {
+    var tests = []struct {
+        staleAfter string
+        age time.Duration
+        want bool
+    }{
+        {"", 4 * time.Hour, true},
+        {"", time.Hour, false},
+        {"5h", 4 * time.Hour, false},
+        {"30m", time.Hour, true},
+    }
+    for _, test := range tests {
+        var s *Server = newTestServer(t, map[string]string{"STALE_AFTER": test.staleAfter})
+        var dt int64 = now().Add(-test.age).Unix()
+        var mock http.RoundTripper = s.http.Transport
+        stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+            if strings.HasSuffix(req.URL.Path, "/find") {
+                return stubResponse(req, http.StatusOK, `{"list":[{"name":"London","id":2643743,"dt":` + strconv.FormatInt(dt, 10) + `,"main":{"temp":7.14}}]}`), nil
+            }
+            return mock.RoundTrip(req)
+        })
+
+        var datum WeatherData
+        if err := json.Unmarshal(serve(s, http.MethodGet, "/api/weather/London").Body.Bytes(), &datum); err != nil {
+            t.Fatal(err)
+        }
+        if datum.Stale != test.want {
+            t.Errorf("STALE_AFTER=%q, %v old: stale = %v, want %v", test.staleAfter, test.age, datum.Stale, test.want)
+        }
+        var page string = serve(s, http.MethodGet, "/weather/London").Body.String()
+        if got := strings.Contains(page, "These readings are out of date"); got != test.want {
+            t.Errorf("STALE_AFTER=%q, %v old: warning shown = %v, want %v", test.staleAfter, test.age, got, test.want)
+        }
+    }
+}
+
+// HOURLY_GRAPH adds the last day's hourly temperatures to the reading, and
+// the graph to the page, for one more history request.
+func TestHourlyGraph(t *testing.T) {
+    var histories = map[string]int64{}
+    for _, enabled := range []string{"", "1"} {
+        var s *Server = newTestServer(t, map[string]string{"HOURLY_GRAPH": enabled})
+        var mock http.RoundTripper = s.http.Transport
+        var calls atomic.Int64
+        stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+            if strings.HasSuffix(req.URL.Path, "/history/city") {
+                calls.Add(1)
+            }
+            return mock.RoundTrip(req)
+        })
+
+        var datum WeatherData
+        if err := json.Unmarshal(serve(s, http.MethodGet, "/api/weather/London").Body.Bytes(), &datum); err != nil {
+            t.Fatal(err)
+        }
+        histories[enabled] = calls.Load()
+        var page string = serve(s, http.MethodGet, "/weather/London").Body.String()
+        if enabled == "" {
+            if len(datum.Hourly) != 0 || strings.Contains(page, "<polyline") {
+                t.Errorf("HOURLY_GRAPH unset: %d hourly points", len(datum.Hourly))
+            }
+            continue
+        }
+        if len(datum.Hourly) != hourlyGraphPoints {
+            t.Fatalf("HOURLY_GRAPH=1: %d hourly points, want %d", len(datum.Hourly), hourlyGraphPoints)
+        }
+        for i := 1; i < len(datum.Hourly); i = i + 1 {
+            if datum.Hourly[i].Time <= datum.Hourly[i - 1].Time {
+                t.Errorf("hourly points aren't in order at %d: %v", i, datum.Hourly)
+                break
+            }
+        }
+        if !strings.Contains(page, "<polyline") {
+            t.Error("HOURLY_GRAPH=1: the page has no graph")
+        }
+    }
+    if histories["1"] != histories[""] + 1 {
+        t.Errorf("made %d history requests with the graph and %d without, want one more", histories["1"], histories[""])
+    }
+}
+
+// With NEARBY_FALLBACK, a name the search doesn't know is geocoded and the
+// closest city shown in its place, saying so; without it, it's not found.
+func TestNearbyFallback(t *testing.T) {
+    for _, enabled := range []string{"1", ""} {
+        var s *Server = newTestServer(t, map[string]string{"NEARBY_FALLBACK": enabled})
+        var geocoded atomic.Int64
+        var mock http.RoundTripper = s.http.Transport
+        stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+            var query url.Values = req.URL.Query()
+            switch {
+                case strings.HasSuffix(req.URL.Path, "/geo/1.0/direct"):
+                    geocoded.Add(1)
+                    return stubResponse(req, http.StatusOK, `[{"name":"Tinyville","lat":39.8,"lon":-89.64,"country":"US"}]`), nil
+                case strings.HasSuffix(req.URL.Path, "/find") && query.Get("q") == "Tinyville":
+                    return stubResponse(req, http.StatusOK, `{"list":[]}`), nil
+                case strings.HasSuffix(req.URL.Path, "/find") && query.Get("lat") == "39.800000":
+                    return stubResponse(req, http.StatusOK, `{"list":[{"name":"Springfield","id":4250542,"dt":1714564800,"main":{"temp":18}}]}`), nil
+            }
+            return mock.RoundTrip(req)
+        })
+
+        var w *httptest.ResponseRecorder = serve(s, http.MethodGet, "/api/weather/Tinyville")
+        if enabled == "" {
+            if w.Code != http.StatusNotFound || geocoded.Load() != 0 {
+                t.Errorf("NEARBY_FALLBACK unset: status %d after %d geocoding requests, want a 404 without any", w.Code, geocoded.Load())
+            }
+            continue
+        }
+        var datum WeatherData
+        if err := json.Unmarshal(w.Body.Bytes(), &datum); err != nil {
+            t.Fatalf("status %d: %v", w.Code, err)
+        }
+        if datum.Name != "Springfield" || datum.Substitution != "Showing weather for nearby Springfield." {
+            t.Errorf("got %q with substitution %q, want nearby Springfield", datum.Name, datum.Substitution)
+        }
+        if page := serve(s, http.MethodGet, "/weather/Tinyville").Body.String(); !strings.Contains(page, "Showing weather for nearby Springfield.") {
+            t.Errorf("the page doesn't note the substitution:\n%s", page)
+        }
+    }
+}
+
+// With comparison=0 the lookup makes no history requests and the reading has
+// no comparison, even though comparisons are on for the deployment.
+func TestSkipComparison(t *testing.T) {
+    var tests = []struct {
+        query string
+        comparison bool
+    }{
+        {"?comparison=0", false},
+        {"", true},
+        {"?comparison=1", true},
+    }
+    for _, test := range tests {
+        var s *Server = newTestServer(t, nil)
+        var histories atomic.Int64
+        var mock http.RoundTripper = s.http.Transport
+        stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+            if strings.HasSuffix(req.URL.Path, "/history/city") {
+                histories.Add(1)
+            }
+            return mock.RoundTrip(req)
+        })
+
+        for _, path := range []string{"/api/weather/London", "/weather/London"} {
+            var w *httptest.ResponseRecorder = serve(s, http.MethodGet, path + test.query)
+            if w.Code != http.StatusOK {
+                t.Fatalf("%s%s: status %d", path, test.query, w.Code)
+            }
+            if got := strings.Contains(w.Body.String(), "similar to yesterday"); got != test.comparison {
+                t.Errorf("%s%s: has a comparison = %v, want %v", path, test.query, got, test.comparison)
+            }
+        }
+        if got := histories.Load() > 0; got != test.comparison {
+            t.Errorf("%q: made %d history requests", test.query, histories.Load())
+        }
+    }
+}
+
+func TestDayAverageNote(t *testing.T) {
+    var tests = []struct {
+        samples []float64
+        current float64
+        want string
+    }{
+        {[]float64{10, 12, 14}, 14, "It's currently warmer than earlier today."},
+        {[]float64{10, 12, 14}, 13, "It's currently warmer than earlier today."},
+        {[]float64{10, 12, 14}, 12.5, "It's about as warm as it has been all day."},
+        {[]float64{10, 12, 14}, 11, "It's currently cooler than earlier today."},
+        {[]float64{-3, -1}, -6, "It's currently cooler than earlier today."},
+    }
+    for _, test := range tests {
+        var today provider.List
+        for _, celsius := range test.samples {
+            var sample provider.Observation
+            sample.Main.Temperature = celsius + 273.15
+            today.List = append(today.List, sample)
+        }
+        average, ok := getDayAverage(today)
+        if !ok {
+            t.Fatalf("%v: no average", test.samples)
+        }
+        if got := getDayAverageNote(test.current, average, 1); got != test.want {
+            t.Errorf("%v°C against %v: %q, want %q", test.current, test.samples, got, test.want)
+        }
+    }
+    if _, ok := getDayAverage(provider.List{}); ok {
+        t.Error("an average of no samples")
+    }
+}
+
+// With DAY_AVERAGE, the reading is compared with the hourly samples since
+// midnight in the city.
+func TestDayAverageComparison(t *testing.T) {
+    var s *Server = newTestServer(t, map[string]string{"DAY_AVERAGE": "1"})
+    var query url.Values
+    var mock http.RoundTripper = s.http.Transport
+    stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+        switch {
+            case strings.HasSuffix(req.URL.Path, "/find"):
+                return stubResponse(req, http.StatusOK, `{"list":[{"name":"Paris","id":2988507,"dt":1714564800,"timezone":7200,"main":{"temp":18}}]}`), nil
+            case strings.HasSuffix(req.URL.Path, "/history/city") && req.URL.Query().Get("cnt") == "14":
+                query = req.URL.Query()
+                return stubResponse(req, http.StatusOK, `{"list":[{"main":{"temp":283.15}},{"main":{"temp":287.15}}]}`), nil
+        }
+        return mock.RoundTrip(req)
+    })
+
+    var datum WeatherData
+    if err := json.Unmarshal(serve(s, http.MethodGet, "/api/weather/Paris").Body.Bytes(), &datum); err != nil {
+        t.Fatal(err)
+    }
+    // 14:00 in Paris is 14 hours since its midnight, 22:00 UTC the day before
+    if want := strconv.FormatInt(time.Date(2024, 4, 30, 22, 0, 0, 0, time.UTC).Unix(), 10); query.Get("start") != want || query.Get("type") != "hour" {
+        t.Errorf("today's history query = %v, want 14 hours from %s", query, want)
+    }
+    if datum.DayAverageNote != "It's currently warmer than earlier today." {
+        t.Errorf("day average note = %q, want warmer than the 12°C average", datum.DayAverageNote)
+    }
+}
+
+// Cities on COMPARISON_DENYLIST, by ID or name, are shown without a comparison
+// and without asking upstream for their history; others compare as usual.
+func TestComparisonDenylist(t *testing.T) {
+    var tests = []struct {
+        denylist string
+        comparison bool
+    }{
+        {"5104746", false},
+        {"Paris; london ", false},
+        {"Paris;2988507", true},
+        {"", true},
+    }
+    for _, test := range tests {
+        var s *Server = newTestServer(t, map[string]string{"COMPARISON_DENYLIST": test.denylist})
+        var histories atomic.Int64
+        var mock http.RoundTripper = s.http.Transport
+        stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+            if strings.HasSuffix(req.URL.Path, "/history/city") {
+                histories.Add(1)
+            }
+            return mock.RoundTrip(req)
+        })
+
+        var datum WeatherData
+        if err := json.Unmarshal(serve(s, http.MethodGet, "/api/weather/London").Body.Bytes(), &datum); err != nil {
+            t.Fatal(err)
+        }
+        if got := datum.ComparisonDetail != nil; got != test.comparison {
+            t.Errorf("COMPARISON_DENYLIST=%q: has a comparison = %v, want %v", test.denylist, got, test.comparison)
+        }
+        if got := histories.Load() > 0; got != test.comparison {
+            t.Errorf("COMPARISON_DENYLIST=%q: made %d history requests", test.denylist, histories.Load())
+        }
+    }
+}
+
+// With the clock fixed, the same reading is always phrased the same way, and
+// whether it's out of date follows the fixed clock rather than the real one.
+func TestFixedClock(t *testing.T) {
+    var tests = []struct {
+        age time.Duration
+        stale bool
+    }{
+        {time.Hour, false},
+        {4 * time.Hour, true},
+    }
+    for _, test := range tests {
+        // Each page comes from a fresh server, so neither is served from cache
+        var pages []string
+        for i := 0; i < 2; i = i + 1 {
+            var s *Server = newTestServer(t, nil)
+            now = func() time.Time { return time.Unix(1700000000, 0).Add(test.age) }
+            var mock http.RoundTripper = s.http.Transport
+            stubUpstream(s, func(req *http.Request) (*http.Response, error) {
+                if strings.HasSuffix(req.URL.Path, "/find") {
+                    return stubResponse(req, http.StatusOK, stubLondon), nil
+                }
+                return mock.RoundTrip(req)
+            })
+            pages = append(pages, serve(s, http.MethodGet, "/weather/London").Body.String())
+        }
+        if pages[0] != pages[1] {
+            t.Errorf("%v old: the page differs between servers:\n%s\nthen\n%s", test.age, pages[0], pages[1])
+        }
+        if got := strings.Contains(pages[0], "These readings are out of date"); got != test.stale {
+            t.Errorf("%v old: warning shown = %v, want %v", test.age, got, test.stale)
+        }
+    }
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+)
+
+// The arrow shown for each direction of the comparison with yesterday.
+var trendArrows = map[string]string{
+    "warmer": "↑",
+    "cooler": "↓",
+    "similar": "→",
+}
+
+/*
+The data for the embeddable widget:
+  - Name: The city's name
+  - Query: The city as it was asked for, to link back to its page
+  - Temperature: The current temperature, in Units
+  - Units: The unit system the temperature is in
+  - Trend: How today compares with yesterday, "warmer", "cooler" or "similar",
+    or empty if there's no comparison
+  - Arrow: The arrow for Trend, from trendArrows
+*/
+type Widget struct {
+    Name string
+    Query string
+    Temperature float64
+    Units string
+    Trend string
+    Arrow string
+}
+
+// Builds the widget for a city's current weather.
+func getWidget(query string, datum WeatherData) Widget {
+    var widget Widget = Widget{Name: datum.Name, Query: query, Temperature: datum.Main.Temperature, Units: datum.Units}
+    if datum.ComparisonDetail != nil {
+        widget.Trend = datum.ComparisonDetail.Direction
+        widget.Arrow = trendArrows[widget.Trend]
+    }
+    return widget
+}
+
+// Serves a tiny page with a city's temperature and trend, for embedding in an
+// iframe on other sites, in DEFAULT_UNITS. It may be cached for as long as the
+// weather is.
+func (s *Server) handleWidget(w http.ResponseWriter, r *http.Request) {
+    var city string = r.PathValue("city")
+    if !validPath.MatchString("/weather/" + city) {
+        http.NotFound(w, r)
+        return
+    }
+
+    r, cancel := s.withBudget(r)
+    defer cancel()
+    datum, err := s.lookupWeather(city, s.getLookupOptions(r))
+    if err != nil {
+        writeError(w, r, lookupStatus(err), err)
+        return
+    }
+    if s.config.CacheTTL > 0 {
+        w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(s.config.CacheTTL.Seconds())))
+    }
+    s.renderTemplate(w, http.StatusOK, "widget", getWidget(city, convertUnits(datum, s.config.DefaultUnits)))
+}